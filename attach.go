@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// attachedStreams records which stdio streams are wired to the debug task.
+type attachedStreams struct {
+	stdin, stdout, stderr bool
+}
+
+// parseAttach parses a docker-style "-a" selector such as "stdout,stderr".
+func parseAttach(s string) (attachedStreams, error) {
+	var a attachedStreams
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "stdin":
+			a.stdin = true
+		case "stdout":
+			a.stdout = true
+		case "stderr":
+			a.stderr = true
+		default:
+			return a, fmt.Errorf("unknown stream: %s", name)
+		}
+	}
+	return a, nil
+}
+
+// set connects only the selected streams to the session in cfg. Streams
+// left nil are not given a FIFO, so the task sees /dev/null instead; in
+// particular an unattached stdin reads EOF immediately rather than blocking.
+func (a attachedStreams) set(cfg *cdbg.Config, stdin io.Reader, stdout, stderr io.Writer) {
+	if !a.stdin {
+		stdin = nil
+	}
+	if !a.stdout {
+		stdout = nil
+	}
+	if !a.stderr {
+		stderr = nil
+	}
+	cfg.Stdin, cfg.Stdout, cfg.Stderr = stdin, stdout, stderr
+}
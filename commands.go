@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd"
+	units "github.com/docker/go-units"
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// command is a subcommand of cdbg besides run, with flags of its own on
+// top of the connection flags.
+type command struct {
+	usage string
+	flags func(fs *flag.FlagSet)
+	run   func(ctx context.Context, client *containerd.Client, args []string)
+	// offline commands do not connect to containerd, and get no client
+	offline bool
+}
+
+// commands by name; filled in by init, as they refer back to it
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"attach":     {usage: "attach [flags] <session>", flags: ttyFlags, run: attachCommand},
+		"commit":     {usage: "commit [flags] <session> <image>", flags: commitFlags, run: commitCommand},
+		"compare":    {usage: "compare [flags] <containerA> <containerB>", flags: compareFlags, run: compareCommand},
+		"completion": {usage: "completion bash|zsh|fish", run: completionCommand, offline: true},
+		"coredump":   {usage: "coredump [flags] <container>", flags: coredumpFlags, run: coredumpCommand},
+		"cp":         {usage: "cp <session>:<path> <local> | <local> <session>:<path>", run: cpCommand},
+		"dlv":        {usage: "dlv [flags] <container>", flags: dlvFlags, run: dlvCommand},
+		"exec":       {usage: "exec [flags] <session> <command...>", flags: execFlags, run: execCommand},
+		"inspect":    {usage: "inspect [flags] <container>", flags: inspectFlags, run: inspectCommand},
+		"ls":         {usage: "ls [flags]", flags: lsFlags, run: lsCommand},
+		"pcap":       {usage: "pcap [flags] <container>", flags: pcapFlags, run: pcapCommand},
+		"profile":    {usage: "profile [flags] <container>", flags: profileFlags, run: profileCommand},
+		"prune":      {usage: "prune [flags]", flags: pruneFlags, run: pruneCommand},
+		"rm":         {usage: "rm [flags] <session>...", flags: rmFlags, run: rmCommand},
+		"serve":      {usage: "serve [flags]", flags: serveFlags, run: serveCommand},
+		"strace":     {usage: "strace [flags] <container> [-- strace-args...]", flags: straceFlags, run: straceCommand},
+		// called by the completion scripts
+		completeCommand: {usage: completeCommand + " containers|sessions|images", run: completeNames},
+	}
+}
+
+// runCommand parses the flags of the named command and runs it.
+func runCommand(name string, args []string) {
+	cmd := commands[name]
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: cdbg %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	if !cmd.offline {
+		connectionFlags(fs)
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Parse(args)
+	setupLogging()
+	if cmd.offline {
+		cmd.run(context.Background(), nil, fs.Args())
+		return
+	}
+	ctx, client := connect()
+	cmd.run(ctx, client, fs.Args())
+}
+
+// commandNames returns the names of the commands for users: run and the
+// rest, sorted.
+func commandNames() []string {
+	names := []string{"run"}
+	for name := range commands {
+		if name != completeCommand {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// usage fails with the usage of the named command.
+func usage(name string) {
+	fail("usage: cdbg %s", commands[name].usage)
+}
+
+// connectionFlags are the flags of every command that talks to containerd.
+func connectionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Address, "address", config.Address, "Address of containerd (default: $CONTAINERD_ADDRESS, or the first common socket path that exists)")
+	fs.StringVar(&config.Namespace, "namespace", config.Namespace, "Containerd namespace of the target (default: $CONTAINERD_NAMESPACE, or moby)")
+	fs.StringVar(&config.Namespace, "n", config.Namespace, "Short for -namespace")
+	fs.StringVar(&logLevel, "log-level", logLevel, "Log level: error, warn, info, debug (the spec, mounts and more) or trace (also every containerd request, and each stream opened but not its messages)")
+	fs.BoolVar(&verbose, "v", verbose, "Short for -log-level debug")
+}
+
+// registryFlags are the flags of the commands that pull or push images.
+func registryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Proxy.HTTPProxy, "http-proxy", config.Proxy.HTTPProxy, "Proxy for plain HTTP registry requests (default: $HTTP_PROXY)")
+	fs.StringVar(&config.Proxy.HTTPSProxy, "https-proxy", config.Proxy.HTTPSProxy, "Proxy for HTTPS registry requests (default: $HTTPS_PROXY)")
+	fs.StringVar(&config.Proxy.NoProxy, "no-proxy", config.Proxy.NoProxy, "Registry hosts to reach without a proxy (default: $NO_PROXY)")
+	fs.StringVar(&insecureHosts, "insecure-registry", insecureHosts, "Comma-separated registry hosts to pull from without verifying TLS (http://host for plain HTTP)")
+	fs.StringVar(&config.RegistryCA, "registry-ca", config.RegistryCA, "PEM file of CA certificates to trust for registries")
+	fs.StringVar(&config.Username, "username", config.Username, "Registry user for pulling the debug image (default: from ~/.docker/config.json)")
+	fs.BoolVar(&passwordStdin, "password-stdin", passwordStdin, "Read the registry password for -username from stdin")
+}
+
+// readRegistryFlags completes config from the registry flags.
+func readRegistryFlags() {
+	if passwordStdin {
+		if config.Username == "" {
+			fail("-password-stdin requires -username")
+		}
+		line, err := readLine(os.Stdin)
+		if err != nil && line == "" {
+			fail("password: %v", err)
+		}
+		config.Password = strings.TrimRight(line, "\r\n")
+	}
+	config.InsecureRegistries = cdbg.ParseList(insecureHosts)
+}
+
+// readLine reads a line from r a byte at a time, so that nothing after it
+// is consumed: the rest of stdin belongs to the debug process.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+// toolCommand returns the debug command that runs tool from the debug image
+// with args, or else exits with status 127 saying the image has none.
+func toolCommand(tool string, args ...string) []string {
+	return append([]string{"/bin/sh", "-c",
+		`command -v "$0" >/dev/null 2>&1 || { echo "cdbg: no $0 in the debug image; give one with -image" >&2; exit 127; }; exec "$0" "$@"`,
+		tool}, args...)
+}
+
+// ttyFlags are the flags of the commands that connect to a session's stdio.
+func ttyFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&config.TTY, "tty", config.TTY, "Connect to the session's TTY")
+	fs.StringVar(&detachKeys, "detach-keys", detachKeys, "Key sequence that detaches from the session again")
+}
+
+func attachCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage("attach")
+	}
+	readDetachKeys()
+	connectStdio(attachedStreams{stdin: true, stdout: true, stderr: true})
+	code, err := cdbg.Attach(ctx, client, args[0], config)
+	if err != nil {
+		failErr(err, "%v", err)
+	}
+	exitCode = code
+}
+
+func execFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&config.TTY, "tty", config.TTY, "Allocate a TTY for the process")
+	fs.BoolVar(&termEnv, "term-env", termEnv, "In TTY mode, forward TERM, LANG and LC_* to the process")
+	fs.Var(&envVars, "e", "Set KEY=VALUE in the process's environment, or pass KEY through from ours (repeatable)")
+}
+
+func execCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) < 2 {
+		usage("exec")
+	}
+	readEnvFlags()
+	connectStdio(attachedStreams{stdin: true, stdout: true, stderr: true})
+	code, err := cdbg.Exec(ctx, client, args[0], args[1:], config)
+	if err != nil {
+		failErr(err, "%v", err)
+	}
+	exitCode = code
+}
+
+var push bool
+
+func commitFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&push, "push", push, "Push the new image to its registry")
+	registryFlags(fs)
+}
+
+func commitCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 2 {
+		usage("commit")
+	}
+	readRegistryFlags()
+	i, err := cdbg.Commit(ctx, client, args[0], args[1])
+	if err != nil {
+		failErr(err, "commit: %v", err)
+	}
+	fmt.Println(i.Name(), i.Target().Digest)
+	if push {
+		err = cdbg.Push(ctx, client, config, i.Name())
+		if err != nil {
+			failErr(err, "%v", err)
+		}
+	}
+}
+
+func compareFlags(fs *flag.FlagSet) {
+	fs.StringVar(&comparePath, "path", comparePath, "Compare only this path prefix")
+}
+
+func compareCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 2 {
+		usage("compare")
+	}
+	err := compareContainers(ctx, client, args[0], args[1], comparePath, os.Stdout)
+	if err != nil {
+		fail("compare: %v", err)
+	}
+}
+
+func completionCommand(ctx context.Context, client *containerd.Client, args []string) {
+	err := writeCompletion(os.Stdout, args)
+	if err != nil {
+		fail("completion: %v", err)
+	}
+}
+
+func completeNames(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage(completeCommand)
+	}
+	var err error
+	switch args[0] {
+	case "containers":
+		err = listContainerIDs(ctx, client, os.Stdout)
+	case "sessions":
+		err = listSessionIDs(ctx, client, os.Stdout)
+	case "images":
+		err = listImageNames(ctx, client, os.Stdout)
+	default:
+		usage(completeCommand)
+	}
+	if err != nil {
+		fail("complete: %v", err)
+	}
+}
+
+func cpCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 2 {
+		usage("cp")
+	}
+	err := copySession(ctx, client, args[0], args[1])
+	if err != nil {
+		fail("cp: %v", err)
+	}
+}
+
+var (
+	inspectJSON bool
+	inspectOut  string
+)
+
+func inspectFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&inspectJSON, "json", inspectJSON, "Write the report as JSON to stdout instead of a tarball")
+	fs.StringVar(&inspectOut, "out", inspectOut, "Write the tarball here (default: <container>.tgz)")
+}
+
+func inspectCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage("inspect")
+	}
+	c, err := resolveContainer(ctx, client, args[0])
+	if err != nil {
+		failErr(err, "load container: %v", err)
+	}
+	r, err := cdbg.Inspect(ctx, c)
+	if err != nil {
+		failErr(err, "inspect: %v", err)
+	}
+	for _, e := range r.Errors {
+		status("warning: %s\n", e)
+	}
+	if inspectJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fail("inspect: %v", err)
+		}
+		return
+	}
+	out := inspectOut
+	if out == "" {
+		out = c.ID() + ".tgz"
+	}
+	// only for root to read, as the spec and cmdlines may hold secrets
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fail("inspect: %v", err)
+	}
+	defer f.Close()
+	if err := r.WriteTar(f); err != nil {
+		fail("inspect: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		fail("inspect: %v", err)
+	}
+	status("wrote %s\n", out)
+}
+
+var allNamespaces bool
+
+func lsFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&allNamespaces, "a", allNamespaces, "List the sessions of every namespace")
+	fs.BoolVar(&allNamespaces, "any-namespace", allNamespaces, "Same as -a, as it was named before subcommands")
+}
+
+func lsCommand(ctx context.Context, client *containerd.Client, args []string) {
+	sessions, err := cdbg.ListSessions(ctx, client, allNamespaces)
+	if err != nil {
+		failErr(err, "ls: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tNAMESPACE\tTARGET\tIMAGE\tUPTIME\tSTATUS")
+	for _, s := range sessions {
+		image := s.Image
+		if image == "" {
+			image = "(native)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Namespace, s.Target, image,
+			units.HumanDuration(time.Since(s.Created)), s.Status)
+	}
+	w.Flush()
+}
+
+var pruneSnapshots bool
+
+func pruneFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&pruneSnapshots, "snapshots", pruneSnapshots, "Also remove the views kept by -cache-view")
+	fs.StringVar(&config.Snapshotter, "snapshotter", config.Snapshotter, "Snapshotter of the debug images")
+}
+
+func pruneCommand(ctx context.Context, client *containerd.Client, args []string) {
+	snapshotter := config.Snapshotter
+	if snapshotter == "" {
+		snapshotter = containerd.DefaultSnapshotter
+	}
+	ss := client.SnapshotService(snapshotter)
+	removed, err := cdbg.PruneSessions(ctx, client, ss)
+	if err == nil {
+		var views []string
+		views, err = cdbg.PrunePersistedViews(ctx, ss)
+		removed = append(removed, views...)
+	}
+	if err == nil && pruneSnapshots {
+		var cached []string
+		cached, err = cdbg.PruneCachedViews(ctx, client, ss)
+		removed = append(removed, cached...)
+	}
+	for _, key := range removed {
+		fmt.Println("removed", key)
+	}
+	if err != nil {
+		fail("prune: %v", err)
+	}
+}
+
+var force bool
+
+func rmFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&force, "f", force, "Kill the debug process of running sessions")
+}
+
+func rmCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) == 0 {
+		usage("rm")
+	}
+	for _, id := range args {
+		err := cdbg.RemoveSession(ctx, client, id, force)
+		if err != nil {
+			failErr(err, "rm: %v", err)
+		}
+		fmt.Println(id)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/mount"
+)
+
+// change is a single difference reported by compareTrees.
+type change struct {
+	kind byte // '-' only in A, '+' only in B, 'M' differs
+	path string
+}
+
+// compareContainers mounts the root filesystems of containers a and b
+// read-only and writes the files under prefix that differ between them.
+func compareContainers(ctx context.Context, client *containerd.Client, a, b, prefix string, w io.Writer) error {
+	var roots []string
+	for _, query := range []string{a, b} {
+		c, err := resolveContainer(ctx, client, query)
+		if err != nil {
+			return err
+		}
+		spec, err := c.Spec(ctx)
+		if err != nil {
+			return fmt.Errorf("spec: %s: %v", c.ID(), err)
+		}
+		dir, err := ioutil.TempDir("", "cdbg-compare")
+		if err != nil {
+			return err
+		}
+		// only remove the (empty) mount point, never what is mounted on it
+		defer os.Remove(dir)
+		m := mount.Mount{
+			Type:    "bind",
+			Source:  spec.Root.Path,
+			Options: []string{"rbind", "ro"},
+		}
+		if err := m.Mount(dir); err != nil {
+			return fmt.Errorf("mount: %s: %v", c.ID(), err)
+		}
+		defer mount.UnmountAll(dir, 0)
+		roots = append(roots, dir)
+	}
+
+	changes, err := compareTrees(roots[0], roots[1], prefix)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Fprintf(w, "%c %s\n", c.kind, c.path)
+	}
+	fmt.Fprintf(w, "%d differences\n", len(changes))
+	return nil
+}
+
+// compareTrees returns the differences between the trees rooted at a and b,
+// restricted to prefix, sorted by path.
+func compareTrees(a, b, prefix string) ([]change, error) {
+	onlyB := make(map[string]bool)
+	err := walkTree(b, prefix, func(rel string, fi os.FileInfo) error {
+		onlyB[rel] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []change
+	err = walkTree(a, prefix, func(rel string, fi os.FileInfo) error {
+		if !onlyB[rel] {
+			changes = append(changes, change{'-', rel})
+			return nil
+		}
+		delete(onlyB, rel)
+		same, err := sameFile(filepath.Join(a, rel), filepath.Join(b, rel), fi)
+		if err != nil {
+			return err
+		}
+		if !same {
+			changes = append(changes, change{'M', rel})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for rel := range onlyB {
+		changes = append(changes, change{'+', rel})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].path < changes[j].path
+	})
+	return changes, nil
+}
+
+// walkTree calls fn with the root-relative path of everything under prefix.
+// A prefix that does not exist is treated as an empty tree.
+func walkTree(root, prefix string, fn func(rel string, fi os.FileInfo) error) error {
+	start := filepath.Join(root, filepath.Join("/", prefix))
+	err := filepath.Walk(start, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.Join("/", rel), fi)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// sameFile reports whether pb has the same type and content as pa.
+func sameFile(pa, pb string, fa os.FileInfo) (bool, error) {
+	fb, err := os.Lstat(pb)
+	if err != nil {
+		return false, err
+	}
+	if fa.Mode() != fb.Mode() {
+		return false, nil
+	}
+	switch {
+	case fa.Mode()&os.ModeSymlink != 0:
+		la, err := os.Readlink(pa)
+		if err != nil {
+			return false, err
+		}
+		lb, err := os.Readlink(pb)
+		if err != nil {
+			return false, err
+		}
+		return la == lb, nil
+	case fa.Mode().IsRegular():
+		if fa.Size() != fb.Size() {
+			return false, nil
+		}
+		return sameContent(pa, pb)
+	}
+	return true, nil
+}
+
+func sameContent(pa, pb string) (bool, error) {
+	fa, err := os.Open(pa)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(pb)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	ra, rb := bufio.NewReader(fa), bufio.NewReader(fb)
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
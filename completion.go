@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/containerd/containerd"
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// completeCommand is the hidden subcommand the completion scripts call to
+// list running containers, sessions or images from containerd at
+// completion time.
+const completeCommand = "__complete"
+
+// connFlags are the flags the completion scripts pass on to completeCommand,
+// as they choose what it queries.
+var connFlags = []string{"-address", "-namespace", "-n"}
+
+// sessionCommands take a debug session as their first argument.
+var sessionCommands = []string{"attach", "commit", "exec", "rm"}
+
+// writeCompletion writes a completion script for the shell named in args.
+// It completes the flags of run, its container from the running ones, the
+// sessions of the commands that take one and -image from the local images.
+func writeCompletion(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: cdbg completion bash|zsh|fish")
+	}
+	var tmpl *template.Template
+	switch args[0] {
+	case "bash":
+		tmpl = bashCompletion
+	case "zsh":
+		tmpl = zshCompletion
+	case "fish":
+		tmpl = fishCompletion
+	default:
+		return fmt.Errorf("unsupported shell: %s", args[0])
+	}
+
+	type flagInfo struct {
+		Name, Usage string
+		Value       bool
+	}
+	var flags []flagInfo
+	var valueFlags []string
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	connectionFlags(fs)
+	runFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		value := !ok || !b.IsBoolFlag()
+		flags = append(flags, flagInfo{f.Name, f.Usage, value})
+		if value {
+			valueFlags = append(valueFlags, "-"+f.Name)
+		}
+	})
+	return tmpl.Execute(w, map[string]interface{}{
+		"Flags":       flags,
+		"ValueFlags":  strings.Join(valueFlags, "|"),
+		"Subcommands": strings.Join(commandNames(), " "),
+		"Sessions":    strings.Join(sessionCommands, " "),
+		"ConnFlags":   strings.Join(connFlags, "|"),
+		"Complete":    completeCommand,
+	})
+}
+
+// listContainerIDs prints the ID of every running container in the current
+// namespace, other than debug sessions.
+func listContainerIDs(ctx context.Context, client *containerd.Client, w io.Writer) error {
+	sessions, err := cdbg.ListSessions(ctx, client, false)
+	if err != nil {
+		return err
+	}
+	isSession := map[string]bool{}
+	for _, s := range sessions {
+		isSession[s.ID] = true
+	}
+	cs, err := client.Containers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		if isSession[c.ID()] {
+			continue
+		}
+		t, err := c.Task(ctx, nil)
+		if err != nil {
+			continue
+		}
+		if st, err := t.Status(ctx); err == nil && st.Status == containerd.Running {
+			fmt.Fprintln(w, c.ID())
+		}
+	}
+	return nil
+}
+
+// listSessionIDs prints the ID of every debug session in the current
+// namespace.
+func listSessionIDs(ctx context.Context, client *containerd.Client, w io.Writer) error {
+	sessions, err := cdbg.ListSessions(ctx, client, false)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		fmt.Fprintln(w, s.ID)
+	}
+	return nil
+}
+
+// listImageNames prints the name of every image in the current namespace.
+func listImageNames(ctx context.Context, client *containerd.Client, w io.Writer) error {
+	is, err := client.ListImages(ctx)
+	if err != nil {
+		return err
+	}
+	for _, i := range is {
+		fmt.Fprintln(w, i.Name())
+	}
+	return nil
+}
+
+var completionFuncs = template.FuncMap{
+	"quote": func(s string) string {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	},
+}
+
+var bashCompletion = template.Must(template.New("bash").Funcs(completionFuncs).Parse(`# bash completion for cdbg
+_cdbg() {
+	local cur prev i word cmd= conn=() args=()
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+	# the connection flags choose what to query; the first positional
+	# argument is a command or, as for run, a container
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		word="${COMP_WORDS[i]}"
+		case "$word" in
+		{{.ConnFlags}})
+			conn+=("$word" "${COMP_WORDS[i+1]}")
+			((i++))
+			;;
+		{{.ValueFlags}})
+			((i++))
+			;;
+		-*)
+			;;
+		*)
+			if [[ -z "$cmd" && ${#args[@]} -eq 0 && "$word" == run ]]; then
+				cmd=run
+			else
+				args+=("$word")
+			fi
+			;;
+		esac
+	done
+
+	case "$prev" in
+	-image)
+		COMPREPLY=($(compgen -W "$(cdbg {{.Complete}} "${conn[@]}" images 2>/dev/null)" -- "$cur"))
+		return
+		;;
+	{{.ValueFlags}})
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "{{range .Flags}}-{{.Name}} {{end}}" -- "$cur"))
+		return
+	fi
+
+	if [[ ${#args[@]} -eq 0 ]]; then
+		local commands="{{.Subcommands}}"
+		[[ -n "$cmd" ]] && commands=
+		COMPREPLY=($(compgen -W "$commands $(cdbg {{.Complete}} "${conn[@]}" containers 2>/dev/null)" -- "$cur"))
+		return
+	fi
+	[[ -n "$cmd" ]] && return
+	case "${#args[@]} ${args[0]}" in
+	"1 compare"|"2 compare")
+		COMPREPLY=($(compgen -W "$(cdbg {{.Complete}} "${conn[@]}" containers 2>/dev/null)" -- "$cur"))
+		;;
+	"1 "*|[0-9]*" rm")
+		case " {{.Sessions}} " in
+		*" ${args[0]} "*)
+			COMPREPLY=($(compgen -W "$(cdbg {{.Complete}} "${conn[@]}" sessions 2>/dev/null)" -- "$cur"))
+			;;
+		esac
+		;;
+	esac
+}
+complete -F _cdbg cdbg
+`))
+
+var zshCompletion = template.Must(template.Must(bashCompletion.Clone()).New("zsh").Parse(`#compdef cdbg
+autoload -U +X bashcompinit && bashcompinit
+{{template "bash" .}}`))
+
+var fishCompletion = template.Must(template.New("fish").Funcs(completionFuncs).Parse(`# fish completion for cdbg
+complete -c cdbg -f
+{{range .Flags}}{{if ne .Name "image"}}complete -c cdbg -o {{.Name}}{{if .Value}} -r{{end}} -d {{quote .Usage}}
+{{end}}{{end}}complete -c cdbg -o image -x -a '(cdbg {{.Complete}} images 2>/dev/null)'
+complete -c cdbg -n '__fish_is_first_arg' -a {{quote .Subcommands}}
+complete -c cdbg -n '__fish_is_first_arg' -a '(cdbg {{.Complete}} containers 2>/dev/null)'
+complete -c cdbg -n '__fish_seen_subcommand_from {{.Sessions}}' -a '(cdbg {{.Complete}} sessions 2>/dev/null)'
+`))
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containerd/console"
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// isProduction reports whether labels has one matching selector, a
+// comma-separated list of key=value pairs or bare keys.
+func isProduction(labels map[string]string, selector string) bool {
+	for _, s := range strings.Split(selector, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		v, ok := labels[kv[0]]
+		if ok && (len(kv) == 1 || v == kv[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmSession asks before a risky session on a production container.
+// Without a terminal to ask on, the session is refused unless -yes was
+// given.
+func confirmSession(t *cdbg.Target) error {
+	if assumeYes {
+		return nil
+	}
+	risks := cdbg.Risks(config)
+	if len(risks) == 0 {
+		return nil
+	}
+	if !isProduction(t.Labels, prodLabels) {
+		return nil
+	}
+	if _, err := console.ConsoleFromFile(os.Stdin); err != nil {
+		return fmt.Errorf("refusing risky session on production container %s without -yes:\n\t%s",
+			t.ID, strings.Join(risks, "\n\t"))
+	}
+	if !confirm(os.Stdin, os.Stderr, t.ID, risks) {
+		return fmt.Errorf("not confirmed")
+	}
+	return nil
+}
+
+// confirm prints risks on w and reads a yes/no answer from r.
+func confirm(r io.Reader, w io.Writer, id string, risks []string) bool {
+	fmt.Fprintf(w, "%s is a production container and this session is\n", id)
+	for _, risk := range risks {
+		fmt.Fprintf(w, "\t- %s\n", risk)
+	}
+	fmt.Fprint(w, "continue? [y/N] ")
+	line, _ := readLine(r)
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// coreDir is where the host directory gcore writes to is mounted in the
+// debug container.
+const coreDir = "/.cdbg/core"
+
+var (
+	corePid uint
+	coreOut = "core.tgz"
+)
+
+func coredumpFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Image, "image", config.Image, "Reference of a debug image with gdb's gcore")
+	fs.UintVar(&corePid, "pid", corePid, "Dump this process, by its PID in the target (default: the target's main process)")
+	fs.StringVar(&coreOut, "out", coreOut, "Write the gzipped tarball of the dump and its binaries here")
+}
+
+// coredumpCommand dumps the core of a process of the target with gcore,
+// from a debug container in its PID namespace, and bundles it with the
+// binaries and libraries the process maps, so it can be debugged
+// elsewhere.
+func coredumpCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage("coredump")
+	}
+	c, err := resolveContainer(ctx, client, args[0])
+	if err != nil {
+		failErr(err, "load container: %v", err)
+	}
+	p := targetProcess(ctx, c, uint32(corePid))
+
+	dir, err := ioutil.TempDir("", "cdbg-core")
+	if err != nil {
+		fail("coredump: %v", err)
+	}
+	// the raw core holds the process's memory; fail exits through
+	// runtime.Goexit, which runs this too
+	defer os.RemoveAll(dir)
+	config.Mounts = append(config.Mounts, specs.Mount{
+		Destination: coreDir,
+		Type:        "bind",
+		Source:      dir,
+		Options:     []string{"rbind", "rw"},
+	})
+	config.Command = toolCommand("gcore", "-o", coreDir+"/core", strconv.FormatUint(uint64(p.NSPid), 10))
+	config.TTY = false
+	config.Stdin, config.Stdout, config.Stderr = nil, os.Stderr, os.Stderr
+	if err := config.Validate(); err != nil {
+		failErr(err, "%v", err)
+	}
+	debug(ctx, client, c)
+	if exitCode != 0 {
+		fail("coredump: gcore exited with status %d", exitCode)
+	}
+
+	core := filepath.Join(dir, fmt.Sprintf("core.%d", p.NSPid))
+	if err := writeCoreArchive(coreOut, core, p.Pid); err != nil {
+		fail("coredump: %v", err)
+	}
+	status("wrote %s\n", coreOut)
+}
+
+// writeCoreArchive writes a gzipped tarball to out of the core file and,
+// under sysroot/, the files process pid maps, read from its root. An exe
+// symlink points at its executable there, so that
+//
+//	gdb -ex 'set sysroot sysroot' exe core
+//
+// finds everything in the extracted directory.
+func writeCoreArchive(out, core string, pid uint32) error {
+	files, err := mappedFiles(pid)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return err
+	}
+	// it holds the process's memory, secrets and all
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+
+	c, err := os.Open(core)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := addFile(tw, "core", c); err != nil {
+		return err
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	for _, name := range files {
+		f, err := openScoped(root, name, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+		if err == nil {
+			err = addFile(tw, filepath.Join("sysroot", name), f)
+			f.Close()
+		}
+		if err != nil {
+			// a library replaced since it was mapped is not worth failing
+			status("warning: %s: %v\n", name, err)
+		}
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     "exe",
+		Linkname: filepath.Join("sysroot", strings.TrimSuffix(exe, " (deleted)")),
+		Mode:     0777,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// mappedFiles returns the files process pid maps, as paths in its root.
+func mappedFiles(pid uint32) ([]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seen := make(map[string]bool)
+	var files []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// address perms offset dev inode path
+		fields := strings.SplitN(s.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		name := strings.TrimSpace(fields[5])
+		if !strings.HasPrefix(name, "/") || strings.HasSuffix(name, " (deleted)") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		files = append(files, name)
+	}
+	return files, s.Err()
+}
+
+// addFile adds f, which must be a regular file, to tw as name.
+func addFile(tw *tar.Writer, name string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
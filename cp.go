@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks bounds symlink resolution in openScoped, as the kernel does.
+const maxSymlinks = 40
+
+// copySession copies files between a running debug session and the host.
+// Exactly one of src and dst is session:path, a path in the debug container
+// whose ID is session; the other is a host path.
+func copySession(ctx context.Context, client *containerd.Client, src, dst string) error {
+	srcID, srcPath := splitSessionPath(src)
+	dstID, dstPath := splitSessionPath(dst)
+	switch {
+	case srcID != "" && dstID == "":
+		root, err := sessionRoot(ctx, client, srcID)
+		if err != nil {
+			return err
+		}
+		f, err := openScoped(root, srcPath, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return copyOut(f, dst)
+	case srcID == "" && dstID != "":
+		root, err := sessionRoot(ctx, client, dstID)
+		if err != nil {
+			return err
+		}
+		// into dstPath if it is a directory, else as it
+		dir, err := openScoped(root, dstPath, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		name := filepath.Base(src)
+		if err != nil {
+			dir, err = openScoped(root, path.Dir(dstPath), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+			name = path.Base(dstPath)
+		}
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		return copyIn(src, dir, name)
+	}
+	return errors.New("one of source and destination must be session:path")
+}
+
+// splitSessionPath splits session:path; host paths, which may be written
+// ./with:colon, have no session.
+func splitSessionPath(arg string) (string, string) {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.Contains(arg[:i], "/") {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// sessionRoot returns the root directory of the running debug container id
+// as seen from the host, mounts included.
+func sessionRoot(ctx context.Context, client *containerd.Client, id string) (string, error) {
+	c, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("session %s: %v", id, err)
+	}
+	t, err := c.Task(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("session %s: %v", id, err)
+	}
+	return fmt.Sprintf("/proc/%d/root", t.Pid()), nil
+}
+
+// openScoped opens p inside root with flags, following symlinks as if root
+// were the root directory so that none can lead out of it. Each component
+// is opened relative to the directory before it without following
+// symlinks, so one swapped in meanwhile is caught rather than followed.
+func openScoped(root, p string, flags int, perm uint32) (*os.File, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	// the directories from root down to the one being looked in
+	dirs := []int{rootFd}
+	defer func() {
+		for _, fd := range dirs {
+			unix.Close(fd)
+		}
+	}()
+	parts := strings.Split(p, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				unix.Close(dirs[len(dirs)-1])
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		dir := dirs[len(dirs)-1]
+		if lastComponent(parts) {
+			fd, err := unix.Openat(dir, part, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, perm)
+			if err == nil {
+				return os.NewFile(uintptr(fd), path.Join(root, p)), nil
+			}
+			// a symlink fails with ELOOP, or ENOTDIR given O_DIRECTORY
+			if (err != unix.ELOOP && err != unix.ENOTDIR) || !isSymlinkAt(dir, part) {
+				return nil, &os.PathError{Op: "open", Path: p, Err: err}
+			}
+		} else {
+			fd, err := unix.Openat(dir, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err == nil {
+				dirs = append(dirs, fd)
+				continue
+			}
+			if err != unix.ENOTDIR || !isSymlinkAt(dir, part) {
+				return nil, &os.PathError{Op: "open", Path: p, Err: err}
+			}
+		}
+		// a symlink, resolved against the directories walked so far
+		if links++; links > maxSymlinks {
+			return nil, fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := readlinkat(dir, part)
+		if err != nil {
+			return nil, &os.PathError{Op: "readlink", Path: p, Err: err}
+		}
+		if path.IsAbs(target) {
+			for _, fd := range dirs[1:] {
+				unix.Close(fd)
+			}
+			dirs = dirs[:1]
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	// p is a directory walked to, such as root itself
+	fd, err := unix.Openat(dirs[len(dirs)-1], ".", flags|unix.O_CLOEXEC, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path.Join(root, p)), nil
+}
+
+// lastComponent reports whether parts, the rest of a path, name nothing
+// more than the directory they are in.
+func lastComponent(parts []string) bool {
+	for _, part := range parts {
+		if part != "" && part != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// isSymlinkAt reports whether name in directory dir is a symlink.
+func isSymlinkAt(dir int, name string) bool {
+	var st unix.Stat_t
+	err := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	return err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK
+}
+
+func readlinkat(dir int, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		b := make([]byte, size)
+		n, err := unix.Readlinkat(dir, name, b)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(b[:n]), nil
+		}
+	}
+}
+
+// copyOut copies src, an open file or directory, to dst on the host like
+// cp -r: into dst if it is an existing directory, else as dst. Entries of
+// a directory are opened relative to it, without following symlinks, which
+// are copied as they are.
+func copyOut(src *os.File, dst string) error {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src.Name()))
+	}
+	return copyOutFile(src, dst)
+}
+
+func copyOutFile(src *os.File, dst string) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		if err := os.MkdirAll(dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		names, err := src.Readdirnames(-1)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := copyOutEntry(src, name, filepath.Join(dst, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		return copyFile(src, dst, fi.Mode().Perm())
+	}
+	fmt.Fprintf(os.Stderr, "skipping %s: not a regular file\n", src.Name())
+	return nil
+}
+
+// copyOutEntry copies the entry name of directory dir to dst.
+func copyOutEntry(dir *os.File, name, dst string) error {
+	// non-blocking, so that a FIFO is skipped rather than waited on
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err == unix.ELOOP {
+		link, err := readlinkat(int(dir.Fd()), name)
+		if err != nil {
+			return &os.PathError{Op: "readlink", Path: path.Join(dir.Name(), name), Err: err}
+		}
+		return os.Symlink(link, dst)
+	}
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path.Join(dir.Name(), name), Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path.Join(dir.Name(), name))
+	defer f.Close()
+	return copyOutFile(f, dst)
+}
+
+// copyIn copies src on the host into dir, an open directory, as name, like
+// cp -r. Everything is created relative to dir without following
+// symlinks; symlinks in src are copied as they are.
+func copyIn(src string, dir *os.File, name string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	dirFd := int(dir.Fd())
+	switch {
+	case fi.IsDir():
+		err := unix.Mkdirat(dirFd, name, uint32(fi.Mode().Perm()))
+		if err != nil && err != unix.EEXIST {
+			return &os.PathError{Op: "mkdir", Path: path.Join(dir.Name(), name), Err: err}
+		}
+		fd, err := unix.Openat(dirFd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: path.Join(dir.Name(), name), Err: err}
+		}
+		sub := os.NewFile(uintptr(fd), path.Join(dir.Name(), name))
+		defer sub.Close()
+		names, err := readDirNames(src)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err := copyIn(filepath.Join(src, n), sub, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := unix.Symlinkat(link, dirFd, name); err != nil {
+			return &os.PathError{Op: "symlink", Path: path.Join(dir.Name(), name), Err: err}
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		r, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		fd, err := unix.Openat(dirFd, name, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(fi.Mode().Perm()))
+		if err != nil {
+			return &os.PathError{Op: "open", Path: path.Join(dir.Name(), name), Err: err}
+		}
+		return copyTo(os.NewFile(uintptr(fd), path.Join(dir.Name(), name)), r)
+	}
+	fmt.Fprintf(os.Stderr, "skipping %s: not a regular file\n", src)
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// copyFile copies the open regular file src to dst, refusing to write
+// through a symlink at dst.
+func copyFile(src *os.File, dst string, perm os.FileMode) error {
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, perm)
+	if err != nil {
+		return err
+	}
+	return copyTo(w, src)
+}
+
+// copyTo copies r to w, and closes w.
+func copyTo(w *os.File, r io.Reader) error {
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
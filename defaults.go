@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+
+	"github.com/slushie/cdbg/pkg/cdbg"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// systemDefaults is the configuration file for every user of the host; the
+// user's own, under their config directory, is read after it and wins.
+const systemDefaults = "/etc/cdbg/config.yaml"
+
+// defaults is a configuration file of default settings, so a team can
+// standardize on a debug image and options without long command lines.
+// Flags and the environment take precedence over it.
+type defaults struct {
+	Image     string `yaml:"image"`
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+	// Capabilities are added to the debug container, as by -cap-add
+	Capabilities []string `yaml:"capabilities"`
+	// Volumes are host:dest[:ro] bind mounts, as by -v
+	Volumes []string `yaml:"volumes"`
+	// Mounts are given as to -mount
+	Mounts []string `yaml:"mounts"`
+}
+
+// defaultsPaths returns the configuration files to read, in order. Under
+// sudo the user's file is that of the user who ran sudo, not root's.
+func defaultsPaths() []string {
+	paths := []string{systemDefaults}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if name := os.Getenv("SUDO_USER"); name != "" {
+			if u, err := user.Lookup(name); err == nil {
+				home = u.HomeDir
+			}
+		}
+		if home == "" {
+			return paths
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return append(paths, filepath.Join(dir, "cdbg", "config.yaml"))
+}
+
+// loadDefaults applies the configuration files that exist to config. As
+// root, a file that another user could have written is ignored: its image
+// and volumes would otherwise be that user's to choose.
+func loadDefaults() {
+	for _, path := range defaultsPaths() {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fail("config: %v", err)
+		}
+		if os.Geteuid() == 0 && !rootOnly(fi) {
+			status("warning: config: ignoring %s, which is not writable only by root\n", path)
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			fail("config: %v", err)
+		}
+		var d defaults
+		if err := yaml.UnmarshalStrict(b, &d); err != nil {
+			fail("config: %s: %v", path, err)
+		}
+		if err := d.apply(&config); err != nil {
+			fail("config: %s: %v", path, err)
+		}
+	}
+}
+
+// rootOnly reports whether only root can write the file described by fi.
+func rootOnly(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Uid == 0 && fi.Mode().Perm()&0022 == 0
+}
+
+// apply sets the defaults in cfg. The environment's containerd address and
+// namespace win over the file's.
+func (d defaults) apply(cfg *cdbg.Config) error {
+	if d.Image != "" {
+		cfg.Image = d.Image
+	}
+	if d.Address != "" && os.Getenv("CONTAINERD_ADDRESS") == "" {
+		cfg.Address = d.Address
+	}
+	if d.Namespace != "" && os.Getenv("CONTAINERD_NAMESPACE") == "" {
+		cfg.Namespace = d.Namespace
+	}
+	caps, err := cdbg.ParseCapabilities(d.Capabilities)
+	if err != nil {
+		return err
+	}
+	cfg.Capabilities = append(cfg.Capabilities, caps...)
+	for _, v := range d.Volumes {
+		m, err := cdbg.ParseVolume(v)
+		if err != nil {
+			return err
+		}
+		cfg.Mounts = append(cfg.Mounts, m)
+	}
+	for _, v := range d.Mounts {
+		m, err := cdbg.ParseMount(v)
+		if err != nil {
+			return err
+		}
+		cfg.Mounts = append(cfg.Mounts, m)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containerd/containerd"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// dlvPath is where a dlv from the host is mounted in the debug container,
+// for debug images without one.
+const dlvPath = "/.cdbg/dlv"
+
+// dlvPort is the port a headless dlv listens on in the debug container's
+// own network namespace, which -dap publishes.
+const dlvPort = 2345
+
+var (
+	dlvFilter string
+	dlvDAP    string
+	dlvBinary string
+)
+
+func dlvFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Image, "image", config.Image, "Reference of the debug image")
+	fs.StringVar(&dlvFilter, "pid-filter", dlvFilter, "Attach to the Go process whose command name contains this, when the target runs several")
+	fs.StringVar(&dlvDAP, "dap", dlvDAP, "Run dlv headless and publish its API, for DAP and JSON-RPC clients such as IDEs, on [host-ip:]port")
+	fs.StringVar(&dlvBinary, "dlv", dlvBinary, "Statically linked dlv to mount into the debug container (default: dlv next to cdbg, or in $PATH)")
+}
+
+// dlvCommand attaches Delve to the Go process of a target, from a debug
+// container in its PID namespace.
+func dlvCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage("dlv")
+	}
+	c, err := resolveContainer(ctx, client, args[0])
+	if err != nil {
+		failErr(err, "load container: %v", err)
+	}
+	procs, err := cdbg.GoProcesses(targetPid(ctx, c), dlvFilter)
+	if err != nil {
+		failErr(err, "dlv: %v", err)
+	}
+	p := pickProcess(c, procs, "Go processes", "-pid-filter")
+	if err := dlvSession(p); err != nil {
+		fail("dlv: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		failErr(err, "%v", err)
+	}
+	connectStdio(attachedStreams{stdin: true, stdout: true, stderr: true})
+	debug(ctx, client, c)
+}
+
+// dlvSession sets up config to run dlv attached to p, using the debug
+// image's dlv if it has one and else the one from the host.
+func dlvSession(p cdbg.Process) error {
+	dlv := fmt.Sprintf("attach %d", p.NSPid)
+	if dlvDAP != "" {
+		port, err := cdbg.ParsePublish(fmt.Sprintf("%s:%d", dlvDAP, dlvPort))
+		if err != nil {
+			return fmt.Errorf("dap: %v", err)
+		}
+		// a network namespace of its own keeps dlv off the node's ports
+		config.Network = cdbg.NetworkNone
+		config.Publish = append(config.Publish, port)
+		dlv += fmt.Sprintf(" --headless --accept-multiclient --api-version=2 --listen=127.0.0.1:%d", dlvPort)
+		status("dlv: connect to %s:%d once dlv is listening\n", port.HostIP, port.HostPort)
+	}
+
+	host, err := findDlv()
+	if err != nil {
+		status("warning: no dlv on this host (%v); the debug image must have one\n", err)
+	} else {
+		config.Mounts = append(config.Mounts, specs.Mount{
+			Destination: dlvPath,
+			Type:        "bind",
+			Source:      host,
+			Options:     []string{"rbind", "ro"},
+		})
+	}
+	config.Command = []string{"/bin/sh", "-c", fmt.Sprintf(
+		`dlv=dlv; command -v dlv >/dev/null 2>&1 || dlv=%s; exec "$dlv" %s`, dlvPath, dlv)}
+	return nil
+}
+
+// findDlv returns the host's dlv to mount into the debug container: that
+// of -dlv, a dlv installed next to cdbg, or the first in $PATH.
+func findDlv() (string, error) {
+	if dlvBinary != "" {
+		_, err := os.Stat(dlvBinary)
+		return dlvBinary, err
+	}
+	if exe, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(exe), "dlv")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return exec.LookPath("dlv")
+}
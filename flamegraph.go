@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dimensions of a rendered flame graph, in pixels, as flamegraph.pl's.
+const (
+	flameWidth   = 1200
+	flameFrame   = 16
+	flamePadding = 10
+	flameTitle   = 40
+	// frames narrower than this are left out
+	flameMinWidth = 0.1
+)
+
+// flameNode is a frame of a flame graph, with the samples of every stack
+// through it.
+type flameNode struct {
+	name     string
+	samples  int
+	children map[string]*flameNode
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	c := n.children[name]
+	if c == nil {
+		c = &flameNode{name: name, children: make(map[string]*flameNode)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// depth returns the number of levels of frames under n.
+func (n *flameNode) depth() int {
+	d := 0
+	for _, c := range n.children {
+		if cd := c.depth() + 1; cd > d {
+			d = cd
+		}
+	}
+	return d
+}
+
+// writeFlamegraph renders the collapsed stacks read from r, as foldStacks
+// writes them, as an SVG flame graph to w: callers below their callees,
+// each frame as wide as its share of the samples, siblings in
+// alphabetical order. Hovering a frame shows its name and samples.
+func writeFlamegraph(w io.Writer, r io.Reader, title string) error {
+	root := &flameNode{name: "all", children: make(map[string]*flameNode)}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(line[i+1:])
+		if err != nil {
+			continue
+		}
+		root.samples += n
+		node := root
+		for _, frame := range strings.Split(line[:i], ";") {
+			node = node.child(frame)
+			node.samples += n
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	depth := root.depth() + 1
+	height := flameTitle + depth*flameFrame + flamePadding
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" xmlns="http://www.w3.org/2000/svg">
+<rect x="0" y="0" width="100%%" height="100%%" fill="#eeeeee"/>
+<text x="%d" y="24" font-family="Verdana" font-size="17" text-anchor="middle">%s</text>
+`, flameWidth, height, flameWidth/2, html.EscapeString(title))
+	if root.samples > 0 {
+		scale := float64(flameWidth-2*flamePadding) / float64(root.samples)
+		writeFlameFrames(bw, root, root.samples, flamePadding, height-flamePadding-flameFrame, scale)
+	}
+	fmt.Fprintln(bw, "</svg>")
+	return bw.Flush()
+}
+
+// writeFlameFrames writes the frame of n at x and y, and its children
+// above it.
+func writeFlameFrames(w io.Writer, n *flameNode, total int, x float64, y int, scale float64) {
+	width := float64(n.samples) * scale
+	if width < flameMinWidth {
+		return
+	}
+	name := html.EscapeString(n.name)
+	fmt.Fprintf(w, `<g><title>%s (%d samples, %.2f%%)</title><rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s" rx="2" ry="2"/>`,
+		name, n.samples, 100*float64(n.samples)/float64(total), x, y, width, flameFrame-1, flameColor(n.name))
+	// about 7 pixels a character at this size
+	if chars := int(width / 7); chars >= 3 {
+		label := n.name
+		if len(label) > chars {
+			label = label[:chars-2] + ".."
+		}
+		fmt.Fprintf(w, `<text x="%.1f" y="%d" font-family="Verdana" font-size="12">%s</text>`,
+			x+3, y+flameFrame-4, html.EscapeString(label))
+	}
+	fmt.Fprintln(w, "</g>")
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := n.children[name]
+		writeFlameFrames(w, c, total, x, y-flameFrame, scale)
+		x += float64(c.samples) * scale
+	}
+}
+
+// flameColor picks a warm color for a frame by its name, so the same
+// function has the same color throughout.
+func flameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+v%50, (v>>8)%230, (v>>16)%55)
+}
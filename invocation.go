@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// redacted replaces the value of secret flags in a saved invocation.
+const redacted = "REDACTED"
+
+// invocation is the resolved configuration of a debug session, written by
+// -save-invocation and re-run with -replay.
+type invocation struct {
+	Namespace   string            `json:"namespace"`
+	Target      string            `json:"target"`
+	Image       string            `json:"image"`
+	ImageDigest digest.Digest     `json:"imageDigest"`
+	Command     []string          `json:"command"`
+	Flags       map[string]string `json:"flags"`
+}
+
+// isSecretFlag reports whether a flag's value must not be written to disk.
+func isSecretFlag(name string) bool {
+	for _, s := range []string{"password", "secret", "token"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUserinfo reports whether value is a URL with credentials in it, as a
+// proxy address may be.
+func hasUserinfo(value string) bool {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := url.Parse(value)
+	return err == nil && u.User != nil
+}
+
+// isReplayFlag reports whether a flag only controls saving or replaying
+// and so is not part of the session itself.
+func isReplayFlag(name string) bool {
+	return name == "save-invocation" || name == "replay"
+}
+
+func writeInvocation(ctx context.Context, path, target string, i containerd.Image) error {
+	ns, _ := namespaces.Namespace(ctx)
+	inv := invocation{
+		Namespace: ns,
+		Target:    target,
+		Command:   config.Command,
+		Flags:     make(map[string]string),
+	}
+	// there is no debug image in -native mode
+	if i != nil {
+		inv.Image = i.Name()
+		inv.ImageDigest = i.Target().Digest
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		switch {
+		case isReplayFlag(f.Name):
+		case isSecretFlag(f.Name), strings.HasSuffix(f.Name, "-proxy") && hasUserinfo(f.Value.String()):
+			inv.Flags[f.Name] = redacted
+		default:
+			inv.Flags[f.Name] = f.Value.String()
+		}
+	})
+	b, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
+
+func loadInvocation(path string) (*invocation, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inv invocation
+	if err := json.Unmarshal(b, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// apply sets every flag recorded in inv that was not given explicitly on the
+// command line, pins the image to the recorded digest, and returns the
+// positional arguments to use: args if any were given, or the saved target
+// and command.
+func (inv *invocation) apply(args []string) ([]string, error) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range inv.Flags {
+		if explicit[name] || isReplayFlag(name) || value == redacted {
+			continue
+		}
+		values := []string{value}
+		if f := flag.Lookup(name); f != nil {
+			if _, ok := f.Value.(*repeatedFlag); ok {
+				values = nil
+				if value != "" {
+					values = strings.Split(value, "\n")
+				}
+			}
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !explicit["image"] && !explicit["image-archive"] && !explicit["image-tarball"] && config.ImageArchive == "" && inv.ImageDigest != "" {
+		named, err := reference.ParseNormalizedNamed(inv.Image)
+		if err != nil {
+			return nil, err
+		}
+		pinned, err := reference.WithDigest(reference.TrimNamed(named), inv.ImageDigest)
+		if err != nil {
+			return nil, err
+		}
+		config.Image = pinned.String()
+	}
+	if len(args) > 0 {
+		return args, nil
+	}
+	if watch != "" || config.Pod != "" {
+		return inv.Command, nil
+	}
+	return append([]string{inv.Target}, inv.Command...), nil
+}
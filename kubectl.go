@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// kubectlPluginName is the executable name that makes cdbg a kubectl
+// plugin, run as `kubectl cdbg`.
+const kubectlPluginName = "kubectl-cdbg"
+
+// podStatus is the part of `kubectl get pod -o json` cdbg needs.
+type podStatus struct {
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses []struct {
+			Name        string `json:"name"`
+			ContainerID string `json:"containerID"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// kubectlTarget asks kubectl for the container of pod in Kubernetes
+// namespace ns (or kubectl's current one), and returns its ID and the
+// containerd namespace holding it. The pod must be running on this node.
+func kubectlTarget(ns, pod, container string) (id, namespace string, err error) {
+	args := []string{"get", "pod", pod, "-o", "json"}
+	if ns != "" {
+		args = append(args, "-n", ns)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("kubectl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	var p podStatus
+	if err := json.Unmarshal(out, &p); err != nil {
+		return "", "", fmt.Errorf("kubectl: %v", err)
+	}
+
+	var names []string
+	for _, s := range p.Status.ContainerStatuses {
+		names = append(names, s.Name)
+		if container == "" && len(p.Status.ContainerStatuses) == 1 || s.Name == container {
+			id = s.ContainerID
+		}
+	}
+	if id == "" {
+		if container == "" {
+			return "", "", fmt.Errorf("pod %s has containers %s; choose one with -c", pod, strings.Join(names, ", "))
+		}
+		return "", "", fmt.Errorf("pod %s has no running container %s (has: %s)", pod, container, strings.Join(names, ", "))
+	}
+
+	// IDs are runtime://id; dockershim containers live in Docker's namespace
+	runtime := "containerd"
+	if i := strings.Index(id, "://"); i >= 0 {
+		runtime, id = id[:i], id[i+3:]
+	}
+	switch runtime {
+	case "containerd":
+		namespace = cdbg.KubernetesNamespace
+	case "docker":
+		namespace = cdbg.DefaultNamespace
+	default:
+		return "", "", fmt.Errorf("pod %s: unsupported container runtime %s", pod, runtime)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return "", "", err
+	}
+	if node := p.Spec.NodeName; node != host && strings.SplitN(node, ".", 2)[0] != strings.SplitN(host, ".", 2)[0] {
+		return "", "", fmt.Errorf("pod %s runs on node %s; run there:\n\tsudo cdbg -n %s %s", pod, node, namespace, id)
+	}
+	return id, namespace, nil
+}
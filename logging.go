@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd"
+	cdefaults "github.com/containerd/containerd/defaults"
+	"github.com/containerd/containerd/pkg/dialer"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// setupLogging sets the level of cdbg's log from -log-level, or -v, and
+// logs as JSON alongside -output json=<path>.
+func setupLogging() {
+	if verbose {
+		logLevel = "debug"
+	}
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		fail("log-level: %v", err)
+	}
+	logrus.SetLevel(level)
+	if config.Events != nil {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
+
+// clientOpts are the options of the containerd client. At trace level
+// every request to containerd is logged, and the opening of every stream.
+func clientOpts() []containerd.ClientOpt {
+	if !logrus.IsLevelEnabled(logrus.TraceLevel) {
+		return nil
+	}
+	// these replace the client's own dial options, so repeat them
+	return []containerd.ClientOpt{containerd.WithDialOpts([]grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithInsecure(),
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithBackoffMaxDelay(3 * time.Second),
+		grpc.WithDialer(dialer.Dialer),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(cdefaults.DefaultMaxRecvMsgSize)),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(cdefaults.DefaultMaxSendMsgSize)),
+		grpc.WithUnaryInterceptor(traceRPC),
+		grpc.WithStreamInterceptor(traceStream),
+	})}
+}
+
+// traceRPC logs a request to containerd with its duration and outcome.
+func traceRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	entry := logrus.WithFields(logrus.Fields{
+		"method":   method,
+		"duration": time.Since(start),
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Trace("containerd request")
+	return err
+}
+
+// traceStream logs the opening of a stream to containerd, such as of its
+// events or of a content write; the messages on the stream are not logged.
+func traceStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	entry := logrus.WithFields(logrus.Fields{
+		"method":   method,
+		"duration": time.Since(start),
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Trace("containerd stream")
+	return stream, err
+}
@@ -4,328 +4,684 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"runtime"
-
-	"github.com/containerd/containerd/containers"
+	runtimedebug "runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/containerd/console"
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/cio"
-	"github.com/containerd/containerd/log"
-	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/namespaces"
-	"github.com/containerd/containerd/oci"
-	"github.com/opencontainers/image-spec/identity"
-	"github.com/opencontainers/runtime-spec/specs-go"
-	"golang.org/x/sys/unix"
+	units "github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+	"github.com/slushie/cdbg/pkg/cdbg"
 )
 
 var (
-	exitCode  int
-	container string
-	tty       = true
-	address   = "/var/run/containerd/containerd.sock"
-	image     = "docker.io/library/ubuntu:bionic"
-	command   = []string{"/bin/bash", "-l"}
-	id        = "cdbg"
-	readOnly  = true
+	exitCode       int
+	container      string
+	config         = cdbg.DefaultConfig()
+	attach         = "stdin,stdout,stderr"
+	joinNS         = "pid"
+	network        = "host"
+	ipc            = "private"
+	uts            = "private"
+	cgroup         = "own"
+	memory         string
+	mountInclude   string
+	mountExclude   string
+	loops          string
+	transcriptPath string
+	podContainer   string
+	passwordStdin  bool
+	insecureHosts  string
+	termEnv        = true
+	watch          string
+	watchTimeout   time.Duration
+	watchMax       int
+	saveInvocation string
+	replay         string
+	verbose        = false
+	logLevel       = "info"
+	comparePath    = "/"
+	perf           bool
+	perfOut        = "perf.folded"
+	prodLabels     = "env=production,environment=production"
+	assumeYes      bool
+	capAdd         listFlag
+	capDrop        listFlag
+	envVars        repeatedFlag
+	volumes        repeatedFlag
+	mountSpecs     repeatedFlag
+	tmpfsMounts    repeatedFlag
+	detachKeys     = "ctrl-p,ctrl-q"
+	outputFormat   = "text"
+	hostPID        uint
+	hostMode       bool
+	filterSpecs    repeatedFlag
+	publishSpecs   repeatedFlag
+	backend        = "containerd"
 )
 
+// listFlag collects the values of a flag given more than once, each of
+// which may itself be a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, cdbg.ParseList(s)...)
+	return nil
+}
+
+// repeatedFlag collects the values of a flag given more than once, as they
+// are. Its string form separates them with newlines, which a replayed
+// invocation splits again, so saved invocations replay them intact.
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string { return strings.Join(*r, "\n") }
+
+func (r *repeatedFlag) Set(s string) error {
+	*r = append(*r, s)
+	return nil
+}
+
 func fail(msg string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, msg, args...)
-	fmt.Fprintln(os.Stderr)
-	_, file, line, _ := runtime.Caller(1)
-	fmt.Fprintf(os.Stderr, "\t%s:%d\n", file, line)
+	if config.Events != nil {
+		config.Events(cdbg.Event{
+			Type:    cdbg.EventError,
+			Time:    time.Now().UTC(),
+			Session: config.ID,
+			Target:  container,
+			Message: fmt.Sprintf(msg, args...),
+		})
+	} else {
+		fmt.Fprintf(os.Stderr, msg, args...)
+		fmt.Fprintln(os.Stderr)
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Fprintf(os.Stderr, "\t%s:%d\n", file, line)
+	}
 	if exitCode == 0 {
 		exitCode = 1
 	}
 	runtime.Goexit()
 }
 
-func main() {
-	defer os.Exit(exitCode)
-
-	flag.StringVar(&image, "image", image, "Debug image name")
-	flag.StringVar(&address, "address", address, "Address of containerd")
-	flag.StringVar(&id, "id", id, "Unique ID for debug container")
-	flag.BoolVar(&tty, "tty", tty, "Allocate a TTY for the debug container")
-	flag.BoolVar(&readOnly, "ro", readOnly, "Debug container root FS is read-only")
+// exitCodes are the exit statuses of cdbg itself failing, by kind of error.
+// A session that runs exits with the status of the debug command instead.
+var exitCodes = map[error]int{
+	cdbg.ErrInvalidConfig:      64,
+	cdbg.ErrContainerd:         65,
+	cdbg.ErrTargetNotFound:     66,
+	cdbg.ErrAmbiguousTarget:    67,
+	cdbg.ErrTargetNotRunning:   68,
+	cdbg.ErrPermission:         69,
+	cdbg.ErrPullFailed:         70,
+	cdbg.ErrMountFailed:        71,
+	cdbg.ErrOverlayUnsupported: 72,
+	cdbg.ErrDebugFailed:        73,
+	cdbg.ErrCleanup:            74,
+	cdbg.ErrDigestMismatch:     75,
+	cdbg.ErrSessionInUse:       76,
+}
 
-	flag.Parse()
-	args := flag.Args()
-	if len(args) == 0 {
-		fail("no container specified")
-	}
-	container = args[0]
-	if len(args) > 1 {
-		command = args[1:]
+// failErr is fail for errors from the cdbg package, exiting with the status
+// for the kind of err.
+func failErr(err error, msg string, args ...interface{}) {
+	if code, ok := exitCodes[cdbg.KindOf(err)]; ok && exitCode == 0 {
+		exitCode = code
 	}
+	fail(msg, args...)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	ctx = namespaces.WithNamespace(ctx, "moby")
-	signals := make(chan os.Signal)
-	signal.Notify(signals, os.Interrupt, os.Kill)
-	go func() {
-		sig := <-signals
-		fmt.Println(sig)
-		cancel()
-		ctx, cancel = context.WithCancel(context.Background())
-		ctx = namespaces.WithNamespace(ctx, "moby")
+func main() {
+	// exitCode is set on the way out, so read it late
+	defer func() {
+		if r := recover(); r != nil {
+			// the session has cleaned up on its way here; exiting would
+			// otherwise hide the panic
+			fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, runtimedebug.Stack())
+			exitCode = 2
+		}
+		os.Exit(exitCode)
 	}()
 
-	// create client
-	client, err := containerd.New(address)
-	if err != nil {
-		fail("connect: %v", err)
+	if os.Args[0] == cdbg.InitPath {
+		exitCode = cdbg.RunInit(os.Args[1:])
+		return
 	}
 
-	// fetch target container data
-	c, err := client.LoadContainer(ctx, container)
-	if err != nil {
-		fail("load container: %s: %v", container, err)
+	loadDefaults()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "run" {
+		args = args[1:]
+	} else if len(args) > 0 && commands[args[0]] != nil {
+		runCommand(args[0], args[1:])
+		return
 	}
-	spec, err := c.Spec(ctx)
-	if err != nil {
-		fail("spec: %v", err)
-	}
-	t, err := c.Task(ctx, nil)
-	if err != nil {
-		fail("target task: %v", err)
+	run(args)
+}
+
+// run is the run command, and what cdbg does given a container: debug it.
+func run(args []string) {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: cdbg [run] [flags] <container> [command...]\n")
+		fmt.Fprintf(out, "       cdbg <command> [flags] [args...], commands: %s\n", strings.Join(commandNames()[1:], ", "))
+		flag.PrintDefaults()
 	}
+	connectionFlags(flag.CommandLine)
+	runFlags(flag.CommandLine)
 
-	// pull debug container image
-	i, err := client.Pull(ctx, image, containerd.WithPullUnpack)
-	if err != nil {
-		fail("pull: %s: %v", image, err)
+	flag.CommandLine.Parse(args)
+	if sshHost != "" {
+		runSSH(args)
+		return
 	}
-	diffs, err := i.RootFS(ctx)
-	if err != nil {
-		fail("rootFS: %v", err)
+	args = flag.Args()
+	if replay != "" {
+		inv, err := loadInvocation(replay)
+		if err != nil {
+			fail("replay: %v", err)
+		}
+		args, err = inv.apply(args)
+		if err != nil {
+			fail("replay: %s: %v", replay, err)
+		}
 	}
-	digest := identity.ChainID(diffs)
-
-	// create debug image snapshot path
-	ss := client.SnapshotService(containerd.DefaultSnapshotter)
-	snap, err := ss.Stat(ctx, digest.String())
+	if filepath.Base(os.Args[0]) == kubectlPluginName {
+		// as with kubectl, -n is the Kubernetes namespace of the pod
+		var ns string
+		if isFlagSet("namespace") || isFlagSet("n") {
+			ns = config.Namespace
+		}
+		if len(args) == 0 {
+			fail("usage: kubectl cdbg [-n namespace] [-c container] [flags] <pod> [command...]")
+		}
+		id, namespace, err := kubectlTarget(ns, args[0], podContainer)
+		if err != nil {
+			fail("%v", err)
+		}
+		config.Namespace = namespace
+		args[0] = id
+	}
+	if config.Pod != "" && os.Getenv("CONTAINERD_NAMESPACE") == "" && !isFlagSet("namespace") && !isFlagSet("n") {
+		config.Namespace = cdbg.KubernetesNamespace
+	}
+	if hostMode {
+		if hostPID != 0 || config.Pod != "" || watch != "" {
+			fail("-host does not work with -pid, -pod or -watch")
+		}
+		config.Host = true
+		// share everything with the host, unless asked otherwise
+		for name, v := range map[string]*string{"net": &network, "ipc": &ipc, "uts": &uts} {
+			if !isFlagSet(name) {
+				*v = "target"
+			}
+		}
+	} else if hostPID != 0 {
+		if config.Pod != "" || watch != "" {
+			fail("-pid does not work with -pod or -watch")
+		}
+		config.PID = uint32(hostPID)
+		// a bare process is usually debugged for what it does on the network
+		if !isFlagSet("net") {
+			network = "target"
+		}
+	} else if len(filterSpecs) > 0 {
+		if config.Pod != "" || watch != "" {
+			fail("-filter does not work with -pod or -watch")
+		}
+		config.Filters = filterSpecs
+	} else if watch == "" && config.Pod == "" {
+		if len(args) == 0 {
+			fail("no container specified")
+		}
+		container, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		config.Command = args
+	}
+	gdb := len(config.Command) > 0 && filepath.Base(config.Command[0]) == "gdb"
+	if !isFlagSet("debuginfod") && (gdb || config.FetchSymbols) {
+		// symbolized backtraces out of the box
+		config.DebuginfodURLs = cdbg.DebuginfodAuto
+	}
+	err := setOutput(outputFormat)
 	if err != nil {
-		fail("stat: %s: %v", digest.String(), err)
+		fail("output: %v", err)
 	}
-	mounts, err := ss.View(ctx, id, snap.Name)
+	setupLogging()
+	readRegistryFlags()
+	readDetachKeys()
+	streams, err := parseAttach(attach)
 	if err != nil {
-		fail("view: %s: %v", snap.Name, err)
+		fail("attach: %v", err)
 	}
-	defer func() {
-		err := ss.Remove(ctx, id)
+	if network == "target" {
+		joinNS += ",net"
+	} else {
+		config.Network = network
+	}
+	switch ipc {
+	case "target":
+		joinNS += ",ipc"
+	case "private":
+	default:
+		fail("ipc: want target or private, not %q", ipc)
+	}
+	switch uts {
+	case "target":
+		joinNS += ",uts"
+	case "private":
+	default:
+		fail("uts: want target or private, not %q", uts)
+	}
+	switch cgroup {
+	case "target":
+		config.TargetCgroup = true
+	case "own":
+	case "mirror":
+		config.MirrorLimits = true
+	default:
+		fail("cgroup: want target, own or mirror, not %q", cgroup)
+	}
+	if memory != "" {
+		config.Memory, err = units.RAMInBytes(memory)
 		if err != nil {
-			fail("remove: %v", err)
+			fail("memory: %v", err)
 		}
-	}()
-	fmt.Println("mounts:")
-	for _, m := range mounts {
-		fmt.Println("\t-", m)
 	}
-
-	// create scratch workspace
-	scratchDir, err := ioutil.TempDir("", "cdbg")
+	config.Namespaces, err = cdbg.ParseNamespaces(joinNS)
 	if err != nil {
-		fail("temp dir: %v", err)
-	}
-	defer os.RemoveAll(scratchDir)
-	err = makeSubDirs(
-		scratchDir,
-		"dbg",
-		"root",
-		"fifos",
-		"upperdir",
-		"workdir",
-	)
+		fail("ns: %v", err)
+	}
+	if config.ImageArchive != "" && !isFlagSet("image") {
+		// use whatever single image the archive holds
+		config.Image = ""
+	}
+	add, err := cdbg.ParseCapabilities(capAdd)
 	if err != nil {
-		fail("mkdir: %v", err)
+		fail("cap-add: %v", err)
 	}
-
-	// mount debug image snapshot into workspace
-	dbgRoot := filepath.Join(scratchDir, "dbg")
-	err = mount.All(mounts, dbgRoot)
+	config.Capabilities = append(config.Capabilities, add...)
+	config.DropCapabilities, err = cdbg.ParseCapabilities(capDrop)
 	if err != nil {
-		fail("mount all: %+v: %v", mounts, err)
+		fail("cap-drop: %v", err)
 	}
-	defer func() {
-		err = mount.UnmountAll(dbgRoot, 0)
+	readEnvFlags()
+	for _, v := range volumes {
+		m, err := cdbg.ParseVolume(v)
 		if err != nil {
-			fail("unmount: %s: %v", dbgRoot, err)
+			fail("v: %v", err)
 		}
-	}()
-
-	var overlayOpts []string
-	if readOnly {
-		overlayOpts = []string{
-			fmt.Sprintf("lowerdir=%s:%s", dbgRoot, spec.Root.Path),
+		config.Mounts = append(config.Mounts, m)
+	}
+	for _, v := range mountSpecs {
+		m, err := cdbg.ParseMount(v)
+		if err != nil {
+			fail("mount: %v", err)
 		}
-	} else {
-		overlayOpts = []string{
-			fmt.Sprintf("lowerdir=%s", spec.Root.Path),
-			fmt.Sprintf("upperdir=%s", filepath.Join(scratchDir, "upperdir")),
-			fmt.Sprintf("workdir=%s", filepath.Join(scratchDir, "workdir")),
+		config.Mounts = append(config.Mounts, m)
+	}
+	for _, v := range tmpfsMounts {
+		m, err := cdbg.ParseTmpfs(v)
+		if err != nil {
+			fail("tmpfs: %v", err)
 		}
+		config.Mounts = append(config.Mounts, m)
 	}
-
-	// overlay of workspace snapshot over target container fs
-	overlay := mount.Mount{
-		Type:    "overlay",
-		Source:  "overlay",
-		Options: overlayOpts,
+	for _, v := range publishSpecs {
+		p, err := cdbg.ParsePublish(v)
+		if err != nil {
+			fail("publish: %v", err)
+		}
+		config.Publish = append(config.Publish, p)
 	}
-	root := filepath.Join(scratchDir, "root")
-	err = overlay.Mount(root)
+	config.MountInclude = cdbg.ParseList(mountInclude)
+	config.MountExclude = cdbg.ParseList(mountExclude)
+	config.Loops, err = cdbg.ParseLoopDevices(loops)
 	if err != nil {
-		fail("mount: overlay %+v: %v", overlay, err)
+		fail("loop: %v", err)
 	}
-	defer func() {
-		err = mount.UnmountAll(root, 0)
+	if config.AsPID1 {
+		config.InitBinary, err = os.Executable()
 		if err != nil {
-			fail("unmount: %s: %v", root, err)
-		}
-	}()
-
-	// copy non-system mounts
-	var targetMounts []specs.Mount
-	for _, m := range spec.Mounts {
-		if m.Source[0] != '/' {
-			continue
+			fail("executable: %v", err)
 		}
-		targetMounts = append(targetMounts, m)
-	}
-
-	// create debug container in target pid space
-	dbgSpec := oci.Compose(
-		oci.WithDefaultSpec(),
-		oci.WithRootFSPath(root),
-		oci.WithImageConfigArgs(i, command),
-		oci.WithMounts(targetMounts),
-		oci.WithNoNewPrivileges,                 // not privileged
-		WithAddedCapabilities("CAP_SYS_PTRACE"), // for gdb
-		oci.WithHostNamespace(specs.NetworkNamespace),
-		oci.WithLinuxNamespace(specs.LinuxNamespace{
-			Type: "pid",
-			Path: fmt.Sprintf("/proc/%d/ns/pid", t.Pid()),
-		}),
-	)
-	if tty {
-		dbgSpec = oci.Compose(dbgSpec, oci.WithTTY)
 	}
-	dbg, err := client.NewContainer(ctx, id,
-		containerd.WithNewSpec(dbgSpec))
+	err = config.Validate()
 	if err != nil {
-		fail("create: %v", err)
+		failErr(err, "%v", err)
 	}
-	defer func() {
-		err := dbg.Delete(ctx)
+	if saveInvocation != "" {
+		config.Resolved = func(ctx context.Context, target containerd.Container, i containerd.Image) error {
+			return writeInvocation(ctx, saveInvocation, target.ID(), i)
+		}
+	}
+
+	if backend != "containerd" && (config.Pod != "" || config.PID != 0 || config.Host || len(config.Filters) > 0 || watch != "" || perf) {
+		fail("-backend %s takes a container ID, without -pod, -pid, -host, -filter, -watch or -perf", backend)
+	}
+	ctx, client, b := connectBackend()
+	if c, ok := b.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	connectStdio(streams)
+	if transcriptPath != "" {
+		t, err := openTranscript(transcriptPath)
 		if err != nil {
-			fail("delete dbg: %v", err)
+			fail("transcript: %v", err)
 		}
-	}()
+		defer t.Close()
+		config.Stdout = t.tee(config.Stdout)
+		config.Stderr = t.tee(config.Stderr)
+	}
 
-	// create task for debug container with tty
-	var con console.Console
-	opt := []cio.Opt{cio.WithStdio}
-	if tty {
-		con = console.Current()
-		defer con.Reset()
-		err = con.SetRaw()
+	var finishPerf func() error
+	if perf {
+		if watch != "" {
+			fail("-perf does not work with -watch")
+		}
+		finishPerf, err = startPerf(args)
 		if err != nil {
-			fail("console: %v", err)
+			fail("perf: %v", err)
 		}
-		fifos := filepath.Join(scratchDir, "fifos")
-		opt = []cio.Opt{
-			cio.WithTerminal,
-			cio.WithStreams(con, con, nil),
-			cio.WithFIFODir(fifos),
+	}
+
+	if watch != "" {
+		err = watchTargets(ctx, client, watch)
+		if err != nil {
+			fail("watch: %v", err)
 		}
+		return
+	}
+
+	var t *cdbg.Target
+	if client == nil {
+		t, err = b.Target(ctx, container)
+	} else {
+		if config.AnyNamespace && container != "" {
+			config.Namespace, err = cdbg.FindNamespace(ctx, client, container)
+			if err != nil {
+				failErr(err, "load container: %v", err)
+			}
+			ctx = namespaces.WithNamespace(ctx, config.Namespace)
+		}
+		t, err = resolveTarget(ctx, client)
 	}
-	t, err = dbg.NewTask(ctx, cio.NewCreator(opt...))
 	if err != nil {
-		fail("task: %v", err)
+		failErr(err, "load container: %v", err)
 	}
-	defer func() {
-		_, err := t.Delete(ctx, containerd.WithProcessKill)
-		if err != nil {
-			fail("delete task: %v", err)
-		}
-	}()
-	if tty {
-		err := HandleConsoleResize(ctx, t, con)
+	debugTarget(ctx, b, t)
+	if finishPerf != nil {
+		err = finishPerf()
 		if err != nil {
-			fail("resize: %v", err)
+			fail("perf: %v", err)
 		}
+		status("wrote %s\n", perfOut)
+	}
+}
+
+// connectBackend returns -backend, and a context that is cancelled on
+// interrupt, unless a debug process is running to forward the signal to;
+// for containerd, also the client it uses.
+func connectBackend() (context.Context, *containerd.Client, cdbg.Backend) {
+	if backend == "containerd" {
+		ctx, client := connect()
+		return ctx, client, cdbg.NewContainerdBackend(client)
+	}
+	if !isFlagSet("address") {
+		// the default is containerd's
+		config.Address = ""
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	handleSignals(ctx, cancel)
+	b, err := cdbg.NewBackend(backend, config)
+	if err != nil {
+		failErr(err, "%v", err)
 	}
+	return ctx, nil, b
+}
 
-	// run the process and wait for termination
-	exit, err := t.Wait(ctx)
+// resolveTarget finds the containerd target selected by the flags.
+func resolveTarget(ctx context.Context, client *containerd.Client) (*cdbg.Target, error) {
+	var (
+		c   containerd.Container
+		err error
+	)
+	switch {
+	case config.Host:
+		c = cdbg.Host()
+	case config.PID != 0:
+		c, err = cdbg.HostProcess(config.PID)
+	case config.Pod != "":
+		c, err = resolvePod(ctx, client)
+	case len(config.Filters) > 0:
+		c, err = cdbg.ResolveFilter(ctx, client, config.Filters, config.First)
+		c, err = pickAmbiguous(ctx, client, c, err)
+	default:
+		c, err = resolveContainer(ctx, client, container)
+	}
 	if err != nil {
-		fail("wait: %v", err)
+		return nil, err
 	}
-	err = t.Start(ctx)
+	return cdbg.ContainerTarget(ctx, c)
+}
+
+// runFlags are the flags of the run command besides the connection flags.
+func runFlags(fs *flag.FlagSet) {
+	registryFlags(fs)
+	fs.StringVar(&config.Image, "image", config.Image, "Debug image name; name@sha256:... runs only that exact image")
+	fs.StringVar(&config.ImageArchive, "image-archive", config.ImageArchive, "Import the debug image from an OCI layout or docker-save tarball")
+	fs.StringVar(&config.ImageArchive, "image-tarball", config.ImageArchive, "Same as -image-archive")
+	fs.StringVar(&config.Snapshotter, "snapshotter", config.Snapshotter, "Snapshotter for the debug image (default: the target's)")
+	fs.StringVar(&config.PullPolicy, "pull", config.PullPolicy, "When to pull the debug image: always, missing or never")
+	fs.StringVar(&config.Platform, "platform", config.Platform, "Platform of the debug image to use, such as linux/arm64 (default: the host's)")
+	fs.BoolVar(&config.AnyNamespace, "any-namespace", config.AnyNamespace, "Search every containerd namespace for the target")
+	fs.BoolVar(&config.Stopped, "stopped", config.Stopped, "Debug a target that is not running: inspect its filesystem and logs, without joining its namespaces")
+	fs.StringVar(&config.Pod, "pod", config.Pod, "Debug a container of this Kubernetes pod, [namespace/]pod[/container], instead of giving a container ID (uses the k8s.io namespace)")
+	fs.StringVar(&sshHost, "ssh", sshHost, "Run the session on this [user@]node over ssh, copying cdbg there unless -ssh-cdbg is given")
+	fs.StringVar(&sshCdbg, "ssh-cdbg", sshCdbg, "With -ssh, the path of cdbg on the node")
+	fs.BoolVar(&sshSudo, "ssh-sudo", sshSudo, "With -ssh, run cdbg on the node with sudo")
+	fs.StringVar(&backend, "backend", backend, "Runtime that runs the target and the debug container: "+strings.Join(cdbg.Backends(), ", ")+" (then -address is its socket)")
+	fs.Var(&filterSpecs, "filter", "Pick the target by label=key[=value] or image=name instead of giving a container ID; repeat to require all")
+	fs.BoolVar(&config.First, "first", config.First, "With -filter, take the first of several matching containers instead of failing")
+	fs.BoolVar(&hostMode, "host", hostMode, "Debug the node itself: overlay the debug image on / and share the host's namespaces")
+	fs.UintVar(&hostPID, "pid", hostPID, "Debug this host process instead of a container, joining its pid and net namespaces and overlaying /proc/<pid>/root")
+	fs.StringVar(&podContainer, "c", podContainer, "Container of the -pod to debug")
+	fs.StringVar(&config.ID, "id", config.ID, "ID of the debug container (default: cdbg-<target>-<random>)")
+	fs.BoolVar(&config.Force, "force", config.Force, "Reclaim the debug container and snapshot of -id if the session that held them is gone, once they are two minutes old")
+	fs.StringVar(&config.Runtime, "runtime", config.Runtime, "Runtime for the debug container (default: same as the target)")
+	fs.BoolVar(&config.TTY, "tty", config.TTY, "Allocate a TTY for the debug container")
+	fs.StringVar(&detachKeys, "detach-keys", detachKeys, "Key sequence that detaches from a TTY session, such as ctrl-p,ctrl-q or ctrl-a,d")
+	fs.Var(&envVars, "e", "Set KEY=VALUE in the debug process's environment, or pass KEY through from ours (repeatable)")
+	fs.BoolVar(&config.InheritEnv, "inherit-env", config.InheritEnv, "Start from the environment of the target's process")
+	fs.StringVar(&config.DebuginfodURLs, "debuginfod", config.DebuginfodURLs, "DEBUGINFOD_URLS of the debug process, or auto for the server of the target's distribution (default: auto for gdb and -fetch-symbols)")
+	fs.BoolVar(&config.FetchSymbols, "fetch-symbols", config.FetchSymbols, "Fetch the debug info of the target's executable from -debuginfod before the command starts; needs -ro=false")
+	fs.BoolVar(&termEnv, "term-env", termEnv, "In TTY mode, forward TERM, LANG and LC_* to the debug process")
+	fs.StringVar(&transcriptPath, "transcript", transcriptPath, "Append everything the session writes to the terminal to this file, like script(1)")
+	fs.StringVar(&attach, "attach", attach, "Comma-separated stdio streams to attach (stdin,stdout,stderr)")
+	fs.StringVar(&joinNS, "ns", joinNS, "Comma-separated target namespaces to join (pid, net, ipc, uts, user)")
+	fs.BoolVar(&config.JoinUserNS, "userns", config.JoinUserNS, "Join the target's user namespace if it is userns-remapped")
+	fs.StringVar(&ipc, "ipc", ipc, "IPC namespace of the debug container: target (to see its shared memory and semaphores) or private")
+	fs.StringVar(&uts, "uts", uts, "UTS namespace of the debug container: target (to share its hostname) or private")
+	fs.StringVar(&cgroup, "cgroup", cgroup, "Cgroup of the debug container: target (below the target's, sharing its limits), own, or mirror (own, with the target's limits)")
+	fs.StringVar(&memory, "memory", memory, "Memory limit of the debug container's own cgroup, such as 512m")
+	fs.Float64Var(&config.CPUs, "cpus", config.CPUs, "CPU limit of the debug container's own cgroup, such as 0.5")
+	fs.Int64Var(&config.PidsLimit, "pids-limit", config.PidsLimit, "Limit of processes in the debug container's own cgroup")
+	fs.StringVar(&network, "net", network, "Network namespace of the debug container: target, host or none")
+	fs.Var(&publishSpecs, "publish", "Forward [host-ip:]host-port:container-port to the debug container's localhost while it runs; host-ip defaults to 127.0.0.1 (repeatable)")
+	fs.Var(&publishSpecs, "p", "Short for -publish")
+	fs.Var(&volumes, "v", "Bind mount a host path into the debug container, host:dest[:ro] (repeatable)")
+	fs.Var(&mountSpecs, "mount", "Add a mount to the debug container, type=bind|tmpfs,source=...,target=...[,readonly] (repeatable)")
+	fs.Var(&tmpfsMounts, "tmpfs", "Mount a tmpfs for scratch space in the debug container, /path[:size=64m,...] (repeatable)")
+	fs.StringVar(&mountInclude, "mount-include", mountInclude, "Comma-separated globs; copy only target mounts whose destination or source matches one")
+	fs.StringVar(&mountExclude, "mount-exclude", mountExclude, "Comma-separated globs; never copy target mounts whose destination or source matches one")
+	fs.StringVar(&loops, "loop", loops, "Comma-separated image:dest; attach host image files as loop devices, mounting their filesystem at dest (or the device, for dest under /dev)")
+	fs.BoolVar(&config.AsPID1, "as-pid1", config.AsPID1, "Run the command as PID 1 of its own PID namespace, forwarding signals and reaping children")
+	fs.StringVar(&config.StateDir, "state-dir", config.StateDir, "With -ro=false, keep the session's writable layer under this name in "+cdbg.StateRoot+" and mount it again in later sessions")
+	fs.StringVar(&config.ScratchDir, "scratch-dir", config.ScratchDir, "Use this directory for the session workspace and keep it afterwards (default: a temporary directory)")
+	fs.StringVar(&config.User, "user", config.User, "Run the debug command as uid[:gid], or as target for the target process's credentials (default: the image's user)")
+	fs.StringVar(&config.WorkDir, "workdir", config.WorkDir, "Working directory of the debug command, or target for that of the target's process (default: the image's)")
+	fs.StringVar(&config.WorkDir, "w", config.WorkDir, "Short for -workdir")
+	fs.Var(&capAdd, "cap-add", "Add capabilities to the debug container, such as NET_ADMIN for tcpdump (repeatable, or comma-separated; ALL for all)")
+	fs.Var(&capDrop, "cap-drop", "Drop capabilities from the debug container, including the default SYS_PTRACE (repeatable, or comma-separated; ALL for all)")
+	fs.StringVar(&config.Seccomp, "seccomp", config.Seccomp, "Seccomp profile of the debug container: default, unconfined (for strace, perf and bpftrace) or the path of a JSON profile")
+	fs.StringVar(&config.AppArmor, "apparmor", config.AppArmor, "AppArmor profile of the debug container, or unconfined to allow ptrace and mounts it would block")
+	fs.StringVar(&config.SELinuxLabel, "selinux-label", config.SELinuxLabel, "SELinux label (user:role:type:level) of the debug process, or target to use the target's process and mount labels")
+	fs.StringVar(&config.SELinuxMountLabel, "selinux-mount-label", config.SELinuxMountLabel, "SELinux label of the debug container's mounts")
+	fs.BoolVar(&config.SELinuxDisable, "selinux-disable", config.SELinuxDisable, "Apply no SELinux labels to the debug container")
+	fs.BoolVar(&config.Privileged, "privileged", config.Privileged, "Give the debug container all capabilities and host devices, without NoNewPrivileges or /proc and /sys masking")
+	fs.BoolVar(&config.UnmaskProc, "unmask-proc", config.UnmaskProc, "Unmask the paths of /proc and /sys that are masked or read-only, such as /proc/kcore and /sys/firmware, without -privileged")
+	fs.BoolVar(&config.ReadOnly, "ro", config.ReadOnly, "Debug container root FS is read-only")
+	fs.BoolVar(&config.NoOverlay, "no-overlay", config.NoOverlay, "Run on the debug image's own root filesystem, with the target's mounted at "+cdbg.NoOverlayTargetPath+" instead of overlaid")
+	fs.BoolVar(&config.WritableTarget, "rw-target", config.WritableTarget, "With -ro=false, mount the target's root writable where it is not overlaid (-no-overlay, kernels without overlayfs, other backends), changing the live target")
+	fs.StringVar(&config.Layering, "layering", config.Layering, "Whose files win in the overlay: debug-over-target or target-over-debug (default: debug-over-target with -ro, the target alone without)")
+	fs.StringVar(&config.ExportDiff, "export-diff", config.ExportDiff, "With -ro=false, save the session's filesystem changes to this layer tarball on exit")
+	fs.BoolVar(&config.CacheView, "cache-view", config.CacheView, "Keep the debug image view between runs for faster startup (see 'cdbg prune -snapshots')")
+	fs.BoolVar(&config.PersistView, "persist-view", config.PersistView, "Keep a committed snapshot of the debug image for reuse (see 'cdbg prune')")
+	fs.BoolVar(&config.Native, "native", config.Native, "Run the command from the target's own root FS, without the debug image")
+	fs.BoolVar(&config.ExitWithTarget, "exit-with-target", config.ExitWithTarget, "Stop the debug container when the target exits")
+	fs.StringVar(&watch, "watch", watch, "Instead of a container, wait for containers matching an ID prefix or key=value label and attach to each in turn")
+	fs.DurationVar(&config.PullTimeout, "pull-timeout", config.PullTimeout, "Give up getting the debug image after this long (0 waits forever)")
+	fs.DurationVar(&config.StartTimeout, "start-timeout", config.StartTimeout, "Give up creating and starting the debug container after this long (0 waits forever)")
+	fs.DurationVar(&watchTimeout, "watch-timeout", watchTimeout, "Give up waiting for a -watch target after this long (0 waits forever)")
+	fs.IntVar(&watchMax, "watch-max", watchMax, "Stop after attaching to this many -watch targets (0 is unlimited)")
+	fs.BoolVar(&perf, "perf", perf, "Profile a target process with perf: cdbg -perf <container> <pid> <duration>")
+	fs.StringVar(&perfOut, "out", perfOut, "Write the collapsed stacks from -perf to this host path")
+	fs.StringVar(&prodLabels, "prod-labels", prodLabels, "Comma-separated key=value (or key) labels marking production containers")
+	fs.BoolVar(&assumeYes, "yes", assumeYes, "Don't ask before privileged, read-write or namespace-sharing sessions on production containers")
+	fs.StringVar(&outputFormat, "output", outputFormat, "How to report on the session: text, or json=<path> for a JSON record per line written to path, such as /dev/fd/3")
+	fs.StringVar(&saveInvocation, "save-invocation", saveInvocation, "Write the resolved session configuration as JSON to this path")
+	fs.StringVar(&replay, "replay", replay, "Re-run a session saved with -save-invocation (flags given here take precedence)")
+}
+
+// connect returns a client of containerd, and a context in the configured
+// namespace that is cancelled on interrupt, unless a debug process is
+// running to forward the signal to.
+func connect() (context.Context, *containerd.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = namespaces.WithNamespace(ctx, config.Namespace)
+	handleSignals(ctx, cancel)
+
+	// create client
+	if config.Address == "" {
+		config.Address = cdbg.DiscoverAddress(ctx)
+	}
+	client, err := containerd.New(config.Address, clientOpts()...)
 	if err != nil {
-		fail("start: %v", err)
+		exitCode = exitCodes[cdbg.ErrContainerd]
+		fail("connect: %v", err)
 	}
-	status := <-exit
-	exitCode = int(status.ExitCode())
-	fmt.Println("done")
+	return ctx, client
 }
 
-func makeSubDirs(parent string, subdir ...string) error {
-	for _, sub := range subdir {
-		dir := filepath.Join(parent, sub)
-		err := os.MkdirAll(dir, 0777)
-		if err != nil {
-			return fmt.Errorf("%s: %v", dir, err)
+// connectStdio connects the selected streams of the session to our stdio,
+// or the terminal.
+func connectStdio(streams attachedStreams) {
+	if config.TTY && !isTerminal(os.Stdin) {
+		// piped into, as by a script: there is no terminal to hand over
+		logrus.Debug("stdin is not a terminal, running without a TTY")
+		config.TTY = false
+	}
+	if config.TTY {
+		con := console.Current()
+		config.Console = con
+		streams.set(&config, con, con, nil)
+		if termEnv {
+			// under -e, which may override them
+			config.Env = append(terminalEnv(os.Environ()), config.Env...)
 		}
+	} else {
+		streams.set(&config, os.Stdin, os.Stdout, os.Stderr)
 	}
-	return nil
 }
 
-func WithAddedCapabilities(add ...string) oci.SpecOpts {
-	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
-		for _, caps := range []*[]string{
-			&spec.Process.Capabilities.Ambient,
-			&spec.Process.Capabilities.Bounding,
-			&spec.Process.Capabilities.Effective,
-			&spec.Process.Capabilities.Inheritable,
-			&spec.Process.Capabilities.Permitted,
-		} {
-			*caps = append(*caps, add...)
+// readDetachKeys sets config.DetachKeys from -detach-keys.
+func readDetachKeys() {
+	keys, err := cdbg.ParseDetachKeys(detachKeys)
+	if err != nil {
+		fail("detach-keys: %v", err)
+	}
+	config.DetachKeys = keys
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := console.ConsoleFromFile(f)
+	return err == nil
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		return nil
+	})
+	return set
+}
+
+// debug runs a debug container against the containerd target c and
+// records the exit status of the debug command in exitCode.
+func debug(ctx context.Context, client *containerd.Client, c containerd.Container) {
+	t, err := cdbg.ContainerTarget(ctx, c)
+	if err != nil {
+		failErr(err, "load container: %v", err)
 	}
+	debugTarget(ctx, cdbg.NewContainerdBackend(client), t)
 }
 
-// HandleConsoleResize resizes the console
-func HandleConsoleResize(ctx context.Context, task containerd.Task, con console.Console) error {
-	// do an initial resize of the console
-	size, err := con.Size()
+// debugTarget runs a debug container with b against t and records the exit
+// status of the debug command in exitCode.
+func debugTarget(ctx context.Context, b cdbg.Backend, t *cdbg.Target) {
+	container = t.ID
+	err := confirmSession(t)
 	if err != nil {
-		return err
+		fail("%v", err)
 	}
-	if err := task.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
-		log.G(ctx).WithError(err).Error("resize pty")
+	code, err := cdbg.DebugTarget(ctx, b, t, config)
+	proxy.set(nil)
+	if err != nil {
+		failErr(err, "%v", err)
 	}
-	s := make(chan os.Signal, 16)
-	signal.Notify(s, unix.SIGWINCH)
-	go func() {
-		for range s {
-			size, err := con.Size()
-			if err != nil {
-				log.G(ctx).WithError(err).Error("get pty size")
+	exitCode = code
+	logrus.WithField("status", code).Debug("session ended")
+}
+
+// readEnvFlags adds the variables given with -e to config.Env.
+func readEnvFlags() {
+	for _, kv := range envVars {
+		if !strings.Contains(kv, "=") {
+			// like docker run -e KEY
+			v, ok := os.LookupEnv(kv)
+			if !ok {
 				continue
 			}
-			if err := task.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
-				log.G(ctx).WithError(err).Error("resize pty")
-			}
+			kv += "=" + v
 		}
-	}()
-	return nil
+		config.Env = append(config.Env, kv)
+	}
+}
+
+// terminalEnv picks the variables from env that describe the user's
+// terminal and locale, so full-screen tools render correctly over the
+// shared console.
+func terminalEnv(env []string) []string {
+	var term []string
+	for _, kv := range env {
+		switch {
+		case strings.HasPrefix(kv, "TERM="),
+			strings.HasPrefix(kv, "LANG="),
+			strings.HasPrefix(kv, "LC_"):
+			term = append(term, kv)
+		}
+	}
+	return term
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// setOutput sets how cdbg reports on sessions: as text on stderr, or with
+// -output json=<path> as one JSON record per line in the file at path, for
+// tools to read. The records do not share stderr with the debug process's
+// own output; a path such as /dev/fd/3 names a descriptor the caller opened.
+func setOutput(format string) error {
+	if format == "text" {
+		return nil
+	}
+	path := strings.TrimPrefix(format, "json=")
+	if format == "json" || path == "" {
+		return errors.New("json needs a destination, as json=<path>")
+	}
+	if path == format {
+		return fmt.Errorf("unknown format %q: want text or json=<path>", format)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	if isTerminal(f) {
+		// the session may put the terminal in raw mode
+		w = crlfWriter{f}
+	}
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	config.Events = func(e cdbg.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(e)
+	}
+	return nil
+}
+
+// crlfWriter writes to a terminal with each newline as CRLF, which a raw
+// terminal needs to return to the start of the line.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// status reports a status message of the CLI itself.
+func status(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if config.Events != nil {
+		config.Events(cdbg.Event{
+			Type:    cdbg.EventMessage,
+			Time:    time.Now().UTC(),
+			Session: config.ID,
+			Target:  container,
+			Message: strings.TrimSpace(msg),
+		})
+		return
+	}
+	fmt.Fprint(os.Stderr, msg)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	pcapOut      = "capture.pcap"
+	pcapDuration time.Duration
+	pcapFilter   string
+	pcapIface    = "any"
+)
+
+func pcapFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Image, "image", config.Image, "Reference of a debug image with tcpdump")
+	fs.StringVar(&pcapOut, "o", pcapOut, "Write the capture to this pcap file")
+	fs.DurationVar(&pcapDuration, "duration", pcapDuration, "Stop capturing after this long (default: until ctrl-c)")
+	fs.StringVar(&pcapFilter, "filter", pcapFilter, "pcap filter expression of the packets to capture, such as 'port 443'")
+	fs.StringVar(&pcapIface, "i", pcapIface, "Interface of the target's network namespace to capture on")
+}
+
+// pcapCommand captures packets in the target's network namespace with
+// tcpdump, from a debug container that joins it, into a pcap file on the
+// host, until -duration or ctrl-c.
+func pcapCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage("pcap")
+	}
+	c, err := resolveContainer(ctx, client, args[0])
+	if err != nil {
+		failErr(err, "load container: %v", err)
+	}
+
+	// -U writes each packet as it comes, so an interrupted capture is whole
+	config.Command = toolCommand("tcpdump", "-U", "-w", "-", "-i", pcapIface)
+	if pcapFilter != "" {
+		config.Command = append(config.Command, pcapFilter)
+	}
+	config.Namespaces = append(config.Namespaces, specs.NetworkNamespace)
+	config.Capabilities = append(config.Capabilities, "CAP_NET_ADMIN", "CAP_NET_RAW")
+	config.TTY = false
+	config.Stdin, config.Stdout, config.Stderr = nil, nil, os.Stderr
+	if pcapDuration > 0 {
+		started := config.Started
+		config.Started = func(p containerd.Process) {
+			if started != nil {
+				started(p)
+			}
+			// as ctrl-c would: tcpdump flushes and exits
+			time.AfterFunc(pcapDuration, func() {
+				if err := p.Kill(ctx, unix.SIGINT); err != nil {
+					logrus.WithError(err).Debug("stop capture")
+				}
+			})
+		}
+	}
+	if err := config.Validate(); err != nil {
+		failErr(err, "%v", err)
+	}
+	// only for root to read: packets carry whatever the target sends
+	f, err := os.OpenFile(pcapOut, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fail("pcap: %v", err)
+	}
+	defer f.Close()
+	config.Stdout = f
+	debug(ctx, client, c)
+	if err := f.Close(); err != nil {
+		fail("pcap: %v", err)
+	}
+	if exitCode == 0 {
+		status("wrote %s\n", pcapOut)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// perfFrequency is the sampling frequency passed to perf record, off the
+// round 100Hz so samples don't line up with timer-driven work.
+const perfFrequency = 99
+
+// startPerf turns the session into a perf profile of the target's process
+// args[0] for the duration args[1], see recordPerf. The returned function
+// waits for the collapsed stacks and writes them to perfOut.
+func startPerf(args []string) (func() error, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: cdbg -perf [-out file] <container> <pid> <duration>")
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("pid: %v", err)
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil {
+		// a bare number is seconds, as for perf itself
+		n, nerr := strconv.Atoi(args[1])
+		if nerr != nil {
+			return nil, fmt.Errorf("duration: %v", err)
+		}
+		d = time.Duration(n) * time.Second
+	}
+
+	f, err := os.OpenFile(perfOut, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	finish := recordPerf(pid, d, f)
+	return func() error {
+		err := finish()
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
+
+// recordPerf turns the session into a perf profile of process pid, as the
+// target sees it, for the duration d. The debug command's output is folded
+// into collapsed stacks written to w as it arrives; the returned function
+// waits for that to finish.
+func recordPerf(pid int, d time.Duration, w io.Writer) func() error {
+	warnPerfLimits()
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := foldStacks(pr, w)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	config.Command = []string{"/bin/sh", "-c", fmt.Sprintf(
+		"perf record -q -g -F %d -p %d -o - -- sleep %d | perf script -i -",
+		perfFrequency, pid, int(d.Round(time.Second)/time.Second))}
+	config.Capabilities = append(config.Capabilities, "CAP_SYS_ADMIN")
+	config.TTY = false
+	config.Console = nil
+	config.Stdin = nil
+	config.Stdout = pw
+	config.Stderr = os.Stderr
+	return func() error {
+		pw.Close()
+		return <-done
+	}
+}
+
+// warnPerfLimits warns about host settings that keep perf from seeing
+// everything. The debug container gets CAP_SYS_ADMIN, which overrides most
+// of perf_event_paranoid, but kernel frames stay hidden under kptr_restrict.
+func warnPerfLimits() {
+	if v, ok := readSysctl("kernel/perf_event_paranoid"); ok && v > 2 {
+		fmt.Fprintf(os.Stderr, "warning: kernel.perf_event_paranoid is %d; perf may be refused even with CAP_SYS_ADMIN\n", v)
+	}
+	if v, ok := readSysctl("kernel/kptr_restrict"); ok && v != 0 {
+		fmt.Fprintf(os.Stderr, "warning: kernel.kptr_restrict is %d; kernel frames will not be symbolized\n", v)
+	}
+}
+
+func readSysctl(name string) (int, bool) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return v, err == nil
+}
+
+// foldStacks reads `perf script` output from r and writes one line per
+// distinct stack to w, in the collapsed format flamegraph tools expect:
+// the command name and frames from outermost to innermost separated by
+// semicolons, then the number of samples.
+func foldStacks(r io.Reader, w io.Writer) error {
+	counts := make(map[string]int)
+	var (
+		comm   string
+		frames []string
+	)
+	flush := func() {
+		if comm == "" {
+			return
+		}
+		stack := []string{comm}
+		for i := len(frames) - 1; i >= 0; i-- {
+			stack = append(stack, frames[i])
+		}
+		counts[strings.Join(stack, ";")]++
+		comm, frames = "", nil
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case line[0] != ' ' && line[0] != '\t':
+			// sample header: comm pid [cpu] time: period event:
+			comm = strings.Fields(line)[0]
+		default:
+			frames = append(frames, frameName(line))
+		}
+	}
+	flush()
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	stacks := make([]string, 0, len(counts))
+	for stack := range counts {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", stack, counts[stack])
+	}
+	return bw.Flush()
+}
+
+// frameName extracts the function from a perf script frame line,
+// "addr symbol+offset (dso)", falling back to the DSO when the symbol is
+// unknown.
+func frameName(line string) string {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(fields) < 2 {
+		return "[unknown]"
+	}
+	sym, dso := fields[1], ""
+	if i := strings.LastIndex(sym, " ("); i >= 0 {
+		sym, dso = sym[:i], strings.Trim(sym[i+1:], "()")
+	}
+	if i := strings.LastIndex(sym, "+0x"); i >= 0 {
+		sym = sym[:i]
+	}
+	if sym == "[unknown]" && dso != "" {
+		return "[" + filepath.Base(dso) + "]"
+	}
+	return strings.Replace(sym, ";", ":", -1)
+}
@@ -0,0 +1,40 @@
+package cdbg
+
+import (
+	"context"
+	"os"
+
+	"github.com/containerd/containerd/log"
+)
+
+// DefaultAddress is the containerd socket of a stock installation.
+const DefaultAddress = "/var/run/containerd/containerd.sock"
+
+// commonAddresses are where distributions and bundled installs put the
+// containerd socket, in the order they are tried.
+var commonAddresses = []string{
+	"/run/containerd/containerd.sock",
+	DefaultAddress,
+	"/run/k3s/containerd/containerd.sock",
+	"/run/docker/containerd/containerd.sock",
+	"/var/run/docker/containerd/docker-containerd.sock",
+	"/var/snap/microk8s/common/run/containerd.sock",
+}
+
+// DiscoverAddress returns the containerd address to use when none was
+// given: $CONTAINERD_ADDRESS if set, else the first of the common socket
+// paths that exists, else DefaultAddress.
+func DiscoverAddress(ctx context.Context) string {
+	if addr := os.Getenv("CONTAINERD_ADDRESS"); addr != "" {
+		log.G(ctx).Debugf("containerd address %s (from $CONTAINERD_ADDRESS)", addr)
+		return addr
+	}
+	for _, addr := range commonAddresses {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			log.G(ctx).Debugf("containerd address %s (found)", addr)
+			return addr
+		}
+	}
+	log.G(ctx).Debugf("containerd address %s (default)", DefaultAddress)
+	return DefaultAddress
+}
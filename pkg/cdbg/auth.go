@@ -0,0 +1,111 @@
+package cdbg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubAuthKey is the key Docker stores Docker Hub credentials under.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// dockerConfig is the part of ~/.docker/config.json holding registry
+// credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// credentials returns the registry credentials for host: cfg's own if set,
+// else those of the Docker CLI configuration. No credentials means an
+// anonymous pull.
+func (cfg *Config) credentials(host string) (string, string, error) {
+	if cfg.Username != "" {
+		return cfg.Username, cfg.Password, nil
+	}
+	return dockerCredentials(host)
+}
+
+// dockerCredentials looks up host in $DOCKER_CONFIG/config.json, or
+// ~/.docker/config.json, running a credential helper if one is set.
+func dockerCredentials(host string) (string, string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var dc dockerConfig
+	if err := json.Unmarshal(b, &dc); err != nil {
+		return "", "", fmt.Errorf("docker config: %v", err)
+	}
+
+	key := host
+	if host == "registry-1.docker.io" || host == "docker.io" {
+		key = dockerHubAuthKey
+	}
+	if helper := dc.CredHelpers[key]; helper != "" {
+		return helperCredentials(helper, key)
+	}
+	if dc.CredsStore != "" {
+		return helperCredentials(dc.CredsStore, key)
+	}
+	for k, a := range dc.Auths {
+		if k != key && strings.TrimPrefix(strings.TrimPrefix(k, "https://"), "http://") != key {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("docker config: auth for %s: %v", k, err)
+		}
+		kv := strings.SplitN(string(raw), ":", 2)
+		if len(kv) != 2 {
+			return "", "", fmt.Errorf("docker config: auth for %s: want user:password", k)
+		}
+		return kv[0], kv[1], nil
+	}
+	return "", "", nil
+}
+
+// helperCredentials asks docker-credential-<helper> for the credentials of
+// host.
+func helperCredentials(helper, host string) (string, string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers report a missing entry as a failure; pull anonymously
+		if strings.Contains(string(out)+stderr.String(), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("docker-credential-%s: %v: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", fmt.Errorf("docker-credential-%s: %v", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
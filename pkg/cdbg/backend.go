@@ -0,0 +1,384 @@
+package cdbg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+// Backend is a container runtime that cdbg finds targets in and runs debug
+// containers with. Backends are registered by name with RegisterBackend
+// and provide only what differs between runtimes; the session around it,
+// from checking the options through stdio, detaching and events to
+// cleaning up, is DebugTarget's. containerd's, which Run uses, overlays the
+// debug image on the target's root filesystem. The others, for nodes that
+// have no containerd socket to use, join the target's namespaces as far as
+// their runtime allows and show the target's root filesystem at
+// TargetPath.
+type Backend interface {
+	// Target finds the container identified by query, an ID or unique ID
+	// prefix.
+	Target(ctx context.Context, query string) (*Target, error)
+	// Unsupported returns the names of the options set in cfg that the
+	// backend cannot honour.
+	Unsupported(cfg Config) []string
+	// Create gets the debug image and creates the debug container of cfg
+	// against target, without starting it. If it fails, it removes what
+	// it created.
+	Create(ctx context.Context, target *Target, cfg Config) (DebugContainer, error)
+}
+
+// DebugContainer is a debug container created by a Backend.
+type DebugContainer interface {
+	// Start starts the debug process with stdin, stdout and stderr
+	// attached, each nil if not, and returns a channel that delivers its
+	// exit.
+	Start(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (<-chan Exit, error)
+	// Pid returns the host PID of the started debug process, or 0 if the
+	// runtime does not tell.
+	Pid() uint32
+	// Resize resizes the terminal of the debug process.
+	Resize(ctx context.Context, w, h uint32) error
+	// TargetExit returns a channel that delivers the exit of the target
+	// while the debug process runs, or nil if it is not watched.
+	TargetExit() <-chan Exit
+	// Kill kills the debug process.
+	Kill(ctx context.Context) error
+	// Reattach returns the command that reattaches to the debug process
+	// once detached from, or "" if it cannot be left running.
+	Reattach() string
+	// Detach lets go of the running debug process, leaving it and the
+	// debug container to the runtime.
+	Detach()
+	// Remove removes the debug container and whatever was created for it.
+	Remove(ctx context.Context) error
+}
+
+// Exit is how a process exited, or why waiting for it failed.
+type Exit struct {
+	Code uint32
+	Time time.Time
+	Err  error
+}
+
+// BackendFactory returns a Backend for the runtime at cfg.Address, or its
+// default address if that is empty. A backend that holds a connection
+// open implements io.Closer.
+type BackendFactory func(cfg Config) (Backend, error)
+
+// backends are the registered backends by name.
+var backends = map[string]BackendFactory{
+	"containerd": newContainerdBackend,
+	"docker": func(cfg Config) (Backend, error) {
+		return NewDockerBackend(cfg.Address), nil
+	},
+	"podman": func(cfg Config) (Backend, error) {
+		return NewPodmanBackend(cfg.Address), nil
+	},
+	"cri": func(cfg Config) (Backend, error) {
+		return NewCRIBackend(cfg.Address)
+	},
+}
+
+// RegisterBackend makes the backend created by f available to NewBackend
+// as name. It is meant to be called from init functions, and panics if
+// name is taken.
+func RegisterBackend(name string, f BackendFactory) {
+	if _, ok := backends[name]; ok {
+		panic("cdbg: backend " + name + " registered twice")
+	}
+	backends[name] = f
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend returns the registered backend name, configured from cfg.
+func NewBackend(name string, cfg Config) (Backend, error) {
+	f, ok := backends[name]
+	if !ok {
+		return nil, newError(ErrInvalidConfig, fmt.Errorf("want one of %s", strings.Join(Backends(), ", ")), "backend %q", name)
+	}
+	return f(cfg)
+}
+
+// Target is a container found by a Backend.
+type Target struct {
+	ID      string
+	Running bool
+	// Pid is the host PID of its main process
+	Pid uint32
+	// Rootfs is the host path of its root filesystem
+	Rootfs string
+	// ReadOnly is whether it was created with a read-only root filesystem
+	ReadOnly bool
+	// Env is the environment it was started with
+	Env []string
+	// Labels are its labels in the runtime
+	Labels map[string]string
+	// Sandbox is the ID of its pod sandbox, for backends with pods
+	Sandbox string
+
+	// container is the target of the containerd backend
+	container containerd.Container
+}
+
+// RunBackend is Run for backend b: it finds cfg.Target with b and runs a
+// debug session against it, returning the exit code of the debug process.
+func RunBackend(ctx context.Context, b Backend, cfg Config) (int, error) {
+	if err := cfg.Validate(); err != nil {
+		return 0, err
+	}
+	t, err := b.Target(ctx, cfg.Target)
+	if err != nil {
+		return 0, err
+	}
+	return DebugTarget(ctx, b, t, cfg)
+}
+
+// DebugTarget runs a debug session with b against target, as b found it,
+// and returns the exit code of the debug process. What the session created
+// is removed before it returns, unless it is detached from.
+func DebugTarget(ctx context.Context, b Backend, target *Target, cfg Config) (exitCode int, err error) {
+	if err := cfg.Validate(); err != nil {
+		return 0, err
+	}
+	if opts := b.Unsupported(cfg); len(opts) > 0 {
+		return 0, newError(ErrInvalidConfig, errors.New("not supported by this backend"), "%s", strings.Join(opts, ", "))
+	}
+	cfg.setID(target.ID)
+	dbg, err := b.Create(ctx, target, cfg)
+	if err != nil {
+		return 0, err
+	}
+	// teardown must still work after ctx is cancelled by an interrupt
+	cleanupCtx := cleanupContext(ctx)
+	// a detached session leaves everything for the runtime, or Attach
+	var detached bool
+	defer func() {
+		if r := recover(); r != nil {
+			dbg.Remove(cleanupCtx)
+			panic(r)
+		}
+		if detached {
+			return
+		}
+		if rerr := dbg.Remove(cleanupCtx); rerr != nil && err == nil {
+			err = rerr
+		}
+	}()
+
+	// in TTY mode the detach keys leave the session running, if it can be
+	// reattached to
+	stdin := cfg.Stdin
+	var (
+		d      *detachReader
+		detach chan struct{}
+	)
+	if cfg.TTY && stdin != nil && dbg.Reattach() != "" {
+		d = newDetachReader(stdin, cfg.detachKeys())
+		stdin, detach = d, d.detach
+	}
+	if cfg.TTY && cfg.Console != nil {
+		// even when detached from
+		defer cfg.Console.Reset()
+		if err := cfg.Console.SetRaw(); err != nil {
+			return 0, newError(ErrDebugFailed, err, "console")
+		}
+	}
+	exit, err := dbg.Start(ctx, stdin, cfg.Stdout, cfg.Stderr)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.TTY && cfg.Console != nil {
+		if err := HandleConsoleResize(ctx, dbg, cfg.Console); err != nil {
+			return 0, newError(ErrDebugFailed, err, "resize")
+		}
+	}
+	cfg.event(Event{Type: EventStarted, Target: target.ID, Pid: dbg.Pid()})
+
+	var status Exit
+	select {
+	case status = <-exit:
+	case ts := <-dbg.TargetExit():
+		if cfg.Events != nil {
+			cfg.event(exitEvent(EventTargetExited, target.ID, ts.Code))
+		} else {
+			// the console may be raw, so terminate lines explicitly
+			cfg.printf("\r\ntarget %s exited with status %d at %s\r\n",
+				target.ID, ts.Code, ts.Time.Format(time.RFC3339))
+		}
+		if cfg.ExitWithTarget {
+			if err := dbg.Kill(ctx); err != nil {
+				return 0, newError(ErrDebugFailed, err, "kill")
+			}
+		}
+		status = <-exit
+	case <-detach:
+		detached = true
+		dbg.Detach()
+		// ending the input any sooner would hang up the debug process
+		go func() {
+			<-exit
+			d.end()
+		}()
+		if cfg.Events != nil {
+			cfg.event(Event{Type: EventDetached, Target: target.ID})
+		} else {
+			cfg.printf("\r\ndetached from %s; reattach with: %s\r\n", cfg.ID, dbg.Reattach())
+		}
+		return 0, nil
+	}
+	if status.Err != nil {
+		return 0, newError(ErrDebugFailed, status.Err, "wait")
+	}
+	cfg.event(exitEvent(EventExited, target.ID, status.Code))
+	return int(status.Code), nil
+}
+
+// unsupportedOptions returns the names of the options set in cfg that need
+// the snapshots, overlay and tasks of the containerd backend.
+func unsupportedOptions(cfg Config) []string {
+	var opts []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"native", cfg.Native},
+		{"loop devices", len(cfg.Loops) > 0},
+		{"state", cfg.StateDir != ""},
+		{"exported changes", cfg.ExportDiff != ""},
+		{"stopped targets", cfg.Stopped},
+		{"published ports", len(cfg.Publish) > 0},
+		{"fetched symbols", cfg.FetchSymbols},
+		{"mirrored limits", cfg.MirrorLimits},
+		{"layering", cfg.Layering != ""},
+		{"force", cfg.Force},
+	} {
+		if o.set {
+			opts = append(opts, o.name)
+		}
+	}
+	return opts
+}
+
+// checkJoinable checks that target runs and its namespaces may be joined,
+// for the backends that join them with the runtime's own options.
+func checkJoinable(target *Target, cfg Config) error {
+	if !target.Running {
+		return newError(ErrTargetNotRunning, fmt.Errorf("not running"), "target %s", target.ID)
+	}
+	return CheckPrivileges(target.Pid, cfg.Namespaces)
+}
+
+// debugEnv returns the environment of the debug process against t.
+func (t *Target) debugEnv(cfg Config) []string {
+	env := cfg.Env
+	if cfg.InheritEnv {
+		env = append(append([]string(nil), t.Env...), cfg.Env...)
+	}
+	if cfg.DebuginfodURLs != "" {
+		env = append(env[:len(env):len(env)], "DEBUGINFOD_URLS="+debuginfodURLs(cfg.DebuginfodURLs, t.Pid))
+	}
+	return env
+}
+
+// rootReadOnly reports whether t's root filesystem is mounted read-only at
+// TargetPath: unless cfg.WritableTarget it is, and otherwise if t's root
+// is, which the session is warned of.
+func (t *Target) rootReadOnly(cfg Config) bool {
+	if !cfg.WritableTarget {
+		return true
+	}
+	if t.ReadOnly || readOnlyMount(t.Rootfs) {
+		cfg.printf("warning: the target's root filesystem is read-only, so %s is too\n", TargetPath)
+		return true
+	}
+	return false
+}
+
+// debugWorkDir returns the working directory of the debug process against
+// t, with t's root filesystem at TargetPath.
+func (t *Target) debugWorkDir(cfg Config) (string, error) {
+	if cfg.WorkDir != WorkDirTarget {
+		return cfg.WorkDir, nil
+	}
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", t.Pid))
+	if err != nil {
+		return "", newError(ErrTargetNotRunning, err, "working directory")
+	}
+	return filepath.Join(TargetPath, cwd), nil
+}
+
+// debugUser returns the numeric ids of the debug process against t, if
+// cfg.User asks for those of t's process, or else cfg.User.
+func (t *Target) debugUser(cfg Config) (string, error) {
+	if cfg.User != UserTarget {
+		return cfg.User, nil
+	}
+	uid, gid, err := processIDs(t.Pid)
+	if err != nil {
+		return "", newError(ErrTargetNotRunning, err, "user")
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
+// processIDs returns the real uid and gid of process pid.
+func processIDs(pid uint32) (uid, gid uint32, err error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case "Uid:":
+			_, err = fmt.Sscan(f[1], &uid)
+		case "Gid:":
+			_, err = fmt.Sscan(f[1], &gid)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// normalizeCapabilities strips the CAP_ prefix from caps, which older dockerd
+// rejects and CRI runtimes add themselves.
+func normalizeCapabilities(caps []string) []string {
+	var names []string
+	for _, c := range caps {
+		names = append(names, strings.TrimPrefix(c, "CAP_"))
+	}
+	return names
+}
+
+// hasOption reports whether opts has opt.
+func hasOption(opts []string, opt string) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheLabel marks the leases holding views kept by Config.CacheView. The
+// value is the view's snapshot key.
+const cacheLabel = "cdbg.cache"
+
+// cacheKey names the cached view of the snapshot parent; a lease of the
+// same name keeps it from garbage collection.
+func cacheKey(parent string) string {
+	return "cdbg-cache-" + digest.FromString(parent).Hex()
+}
+
+// cachedView returns the mounts of the long-lived view of parent, creating
+// it (under its own lease) on first use. Sessions share the view and do not
+// remove it.
+func cachedView(ctx context.Context, client *containerd.Client, ss snapshots.Snapshotter, parent string) ([]mount.Mount, error) {
+	key := cacheKey(parent)
+	mounts, err := ss.Mounts(ctx, key)
+	if err == nil {
+		return mounts, nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+
+	lm := client.LeasesService()
+	l, err := lm.Create(ctx, leases.WithID(key), leases.WithLabels(map[string]string{cacheLabel: key}))
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("lease: %v", err)
+	}
+	if err != nil {
+		l = leases.Lease{ID: key}
+	}
+	mounts, err = ss.View(leases.WithLease(ctx, l.ID), key, parent)
+	if errdefs.IsAlreadyExists(err) {
+		// a concurrent session created it first, and its lease holds it
+		return ss.Mounts(ctx, key)
+	}
+	if err != nil {
+		lm.Delete(ctx, l)
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// PruneCachedViews removes every view kept by Config.CacheView, and the
+// leases holding them, and returns their keys.
+func PruneCachedViews(ctx context.Context, client *containerd.Client, ss snapshots.Snapshotter) ([]string, error) {
+	lm := client.LeasesService()
+	all, err := lm.List(ctx, fmt.Sprintf("labels.%q", cacheLabel))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, l := range all {
+		key := l.Labels[cacheLabel]
+		if err := ss.Remove(ctx, key); err != nil && !errdefs.IsNotFound(err) {
+			return keys, fmt.Errorf("remove: %s: %v", key, err)
+		}
+		if err := lm.Delete(ctx, l); err != nil && !errdefs.IsNotFound(err) {
+			return keys, fmt.Errorf("lease: %s: %v", l.ID, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
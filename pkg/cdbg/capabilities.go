@@ -0,0 +1,87 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+)
+
+// AllCapabilities stands for every capability in Config.Capabilities and
+// Config.DropCapabilities.
+const AllCapabilities = "ALL"
+
+// ParseCapabilities normalizes capability names: "net_admin", "NET_ADMIN"
+// and "CAP_NET_ADMIN" are all CAP_NET_ADMIN. "all" is AllCapabilities.
+func ParseCapabilities(names []string) ([]string, error) {
+	var caps []string
+	for _, name := range names {
+		c := strings.ToUpper(name)
+		if c == AllCapabilities {
+			caps = append(caps, c)
+			continue
+		}
+		if !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		if !containsCapability(capabilityNames, c) {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// capabilities returns the capabilities added to the debug process: those
+// of cfg.Capabilities, with AllCapabilities expanded, that are not dropped.
+func (cfg *Config) capabilities() []string {
+	caps := cfg.Capabilities
+	if containsCapability(caps, AllCapabilities) {
+		caps = capabilityNames
+	}
+	if containsCapability(cfg.DropCapabilities, AllCapabilities) {
+		return nil
+	}
+	var kept []string
+	for _, c := range caps {
+		if !containsCapability(cfg.DropCapabilities, c) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+func containsCapability(caps []string, c string) bool {
+	for _, name := range caps {
+		if name == c {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDroppedCapabilities removes capabilities from every set of the
+// process, including those the default spec grants.
+func WithDroppedCapabilities(drop ...string) oci.SpecOpts {
+	all := containsCapability(drop, AllCapabilities)
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		for _, caps := range []*[]string{
+			&spec.Process.Capabilities.Ambient,
+			&spec.Process.Capabilities.Bounding,
+			&spec.Process.Capabilities.Effective,
+			&spec.Process.Capabilities.Inheritable,
+			&spec.Process.Capabilities.Permitted,
+		} {
+			var kept []string
+			for _, c := range *caps {
+				if !all && !containsCapability(drop, c) {
+					kept = append(kept, c)
+				}
+			}
+			*caps = kept
+		}
+		return nil
+	}
+}
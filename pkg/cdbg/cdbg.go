@@ -0,0 +1,1103 @@
+// Package cdbg runs a debug container alongside a running target container.
+// The debug image is overlaid on the target's root filesystem and the debug
+// process joins the target's namespaces, so the tools in the image can
+// inspect the target in place.
+package cdbg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/sys/unix"
+)
+
+// Config describes a debug session.
+type Config struct {
+	// Address of the containerd socket, used by Run; if empty it is found
+	// with DiscoverAddress
+	Address string
+	// Namespace is the containerd namespace of the target, used by Run
+	Namespace string
+	// AnyNamespace makes Run search all namespaces for Target instead
+	AnyNamespace bool
+	// Target is the ID (or unique ID prefix) of the container to debug,
+	// used by Run
+	Target string
+	// Pod, if set, is used by Run instead of Target to find the container
+	// of a Kubernetes pod: [namespace/]pod[/container], see ParsePod
+	Pod string
+	// PID, if set, is used by Run instead of Target to debug a process on
+	// the host, see HostProcess
+	PID uint32
+	// Filters, if set, are used by Run instead of Target to pick the
+	// target by label or image, see ResolveFilter; First takes the first
+	// of several matches rather than failing
+	Filters []string
+	First   bool
+	// Host, if set, is used by Run instead of Target to debug the node
+	// itself, see Host; Namespaces should then name all of pid, net, ipc
+	// and uts to share the host's
+	Host bool
+
+	// Image is the reference of the debug image
+	Image string
+	// ImageArchive, if set, is an OCI layout or tarball to import Image
+	// from instead of pulling it; with an empty Image the archive must hold
+	// a single image
+	ImageArchive string
+	// Platform selects the variant of a multi-platform Image, such as
+	// linux/arm64; empty means the host's platform
+	Platform string
+	// Snapshotter holds the debug image; Debug defaults it to the target's
+	// snapshotter, others to containerd's default
+	Snapshotter string
+	// PullPolicy is PullMissing (the default if empty), PullAlways or
+	// PullNever
+	PullPolicy string
+	// PersistView keeps a committed snapshot of Image for later sessions
+	PersistView bool
+	// CacheView keeps the view of Image's snapshot, held by a lease, for
+	// later sessions to mount directly
+	CacheView bool
+	// Proxy overrides the environment's proxy settings for pulling Image
+	Proxy httpproxy.Config
+	// InsecureRegistries are registry hosts whose TLS certificates are not
+	// verified; an entry of http://host uses plain HTTP instead
+	InsecureRegistries []string
+	// RegistryCA is a PEM file of extra CA certificates for registries
+	RegistryCA string
+	// Username and Password authenticate the pull of Image; if unset the
+	// Docker CLI's stored credentials are used
+	Username, Password string
+
+	// ID names the debug container and its snapshot; a new one is made up
+	// for each session unless it is given
+	ID string
+	// Force reclaims the debug container and snapshot of ID if the session
+	// that held them is gone, rather than failing with ErrSessionInUse
+	Force bool
+	// Command overrides the entrypoint and command of the debug image
+	Command []string
+	// Runtime for the debug container; defaults to the target's runtime
+	Runtime string
+	// User runs the debug process as a numeric uid[:gid], or as the
+	// target's process with UserTarget; empty keeps the image's user
+	User string
+	// Capabilities added to the debug process
+	Capabilities []string
+	// DropCapabilities are removed from the debug process, including those
+	// granted by default; AllCapabilities drops them all
+	DropCapabilities []string
+	// Privileged grants all capabilities and devices, lifts
+	// NoNewPrivileges and unmasks /proc and /sys
+	Privileged bool
+	// UnmaskProc unmasks the paths of /proc and /sys the default spec
+	// masks or makes read-only, such as /proc/kcore and /sys/firmware,
+	// without the rest of Privileged
+	UnmaskProc bool
+	// Seccomp is SeccompDefault, SeccompUnconfined or the path of a JSON
+	// seccomp profile; empty leaves the runtime's choice
+	Seccomp string
+	// AppArmor is the AppArmor profile of the debug process, or
+	// AppArmorUnconfined; empty leaves the runtime's choice
+	AppArmor string
+	// SELinuxLabel is the SELinux label (user:role:type:level) of the debug
+	// process, or SELinuxTarget for the target's; empty leaves the
+	// runtime's choice
+	SELinuxLabel string
+	// SELinuxMountLabel is the SELinux label of the debug container's mounts
+	SELinuxMountLabel string
+	// SELinuxDisable applies no SELinux labels at all
+	SELinuxDisable bool
+	// Namespaces of the target joined by the debug process
+	Namespaces []specs.LinuxNamespaceType
+	// JoinUserNS adds the target's user namespace to Namespaces when the
+	// target is userns-remapped
+	JoinUserNS bool
+	// Network is NetworkHost (the default if empty) or NetworkNone, unless
+	// Namespaces has the target's network namespace joined instead
+	Network string
+	// Publish forwards local ports to ports on localhost in the network
+	// namespace of the debug process while it runs
+	Publish []PublishedPort
+	// TargetCgroup puts the debug container in a cgroup below the
+	// target's, under its limits; otherwise it gets a cgroup of its own, limited to Memory
+	// bytes, CPUs and PidsLimit processes if they are not zero
+	TargetCgroup bool
+	Memory       int64
+	CPUs         float64
+	PidsLimit    int64
+	// MirrorLimits gives the debug container's own cgroup the limits of
+	// the target's, under those set above
+	MirrorLimits bool
+	// Mounts added to the debug container after the target's own
+	Mounts []specs.Mount
+	// MountInclude, if not empty, limits the target mounts copied into the
+	// debug container to those whose destination or source matches one of
+	// these globs; MountExclude then removes any that match its globs
+	MountInclude, MountExclude []string
+	// Env is added to the environment of the debug process
+	Env []string
+	// WorkDir is the working directory of the debug process, or
+	// WorkDirTarget for that of the target's process; empty keeps the
+	// image's
+	WorkDir string
+	// InheritEnv adds the environment of the target's process, under Env
+	InheritEnv bool
+	// DebuginfodURLs, if set, is DEBUGINFOD_URLS of the debug process, so
+	// gdb and other tools fetch the symbols of the target's binaries; with
+	// DebuginfodAuto it is the server of the target's distribution
+	DebuginfodURLs string
+	// FetchSymbols fetches the debug info of the target's executable into
+	// a writable session before Command starts
+	FetchSymbols bool
+	// ExportDiff is a path to write the changes of a writable session to,
+	// as a layer tarball, on teardown
+	ExportDiff string
+	// ReadOnly makes the debug root filesystem read-only; otherwise
+	// changes go to an upperdir in the scratch directory
+	ReadOnly bool
+	// NoOverlay runs the debug image as the root filesystem, as it is,
+	// with the target's mounted read-only at NoOverlayTargetPath rather
+	// than overlaid, so neither shadows the other's files
+	NoOverlay bool
+	// WritableTarget mounts the target's root filesystem writable where it
+	// is not overlaid: at NoOverlayTargetPath with NoOverlay, and at
+	// TargetPath on a kernel without overlay support and in the docker,
+	// podman and cri backends.
+	// Changes there are made to the live target. Otherwise it is read-only
+	WritableTarget bool
+	// Layering is LayeringDebugOverTarget or LayeringTargetOverDebug, which
+	// decides whose files win where the debug image and the target's root
+	// filesystem overlap; empty is the former for a read-only session, and
+	// the target's root filesystem alone for a writable one
+	Layering string
+	// ScratchDir holds the session workspace and is kept afterwards. If
+	// empty a temporary directory is used and removed.
+	ScratchDir string
+	// StateDir names a persistent workspace under StateRoot whose writable
+	// layer is mounted again by every session using the same name
+	StateDir string
+	// AsPID1 runs Command under InitBinary as PID 1 of a private PID
+	// namespace, forwarding signals and reaping children
+	AsPID1 bool
+	// InitBinary is the host path of the cdbg binary used for AsPID1
+	InitBinary string
+	// ExitWithTarget kills the debug process when the target exits
+	ExitWithTarget bool
+	// Loops are host image files attached to the debug container through
+	// loop devices
+	Loops []LoopDevice
+	// Native runs Command from the target's own root filesystem, without
+	// pulling or overlaying the debug image
+	Native bool
+
+	// PullTimeout and StartTimeout, if set, limit how long getting the
+	// debug image and creating and starting the debug container may take
+	PullTimeout  time.Duration
+	StartTimeout time.Duration
+
+	// Stopped allows a target without a running task, such as a crashed
+	// or crash-looping container: the session sees its filesystem, and
+	// its logs under LogsPath where they are found, but joins none of its
+	// namespaces
+	Stopped bool
+
+	// TTY allocates a terminal for the debug process
+	TTY bool
+	// DetachKeys is the key sequence that detaches from a TTY session,
+	// DetachKeys (the package variable) if nil
+	DetachKeys []byte
+	// Console, if set, is put in raw mode for a TTY session and the
+	// terminal is resized to follow it
+	Console console.Console
+	// Stdin, Stdout and Stderr are connected to the debug process; nil
+	// streams are not attached. Stderr is unused with TTY.
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+	// Messages receives status and warning messages; nil discards them
+	Messages io.Writer
+
+	// Events, if set, receives the steps of the session as they happen,
+	// and the messages that would otherwise go to Messages
+	Events func(Event)
+
+	// Resolved, if set, is called with the target and the debug image
+	// before any session resources are created
+	Resolved func(ctx context.Context, target containerd.Container, image containerd.Image) error
+	// Started, if set, is called with the debug process once it runs, and
+	// by Exec and Attach with their process, for instance to forward
+	// signals to it
+	Started func(p containerd.Process)
+}
+
+// DefaultNamespace is the containerd namespace of Docker's containers.
+const DefaultNamespace = "moby"
+
+// DefaultConfig returns the configuration of a read-only, interactive
+// session in the target's PID namespace using an Ubuntu debug image. The
+// containerd namespace is $CONTAINERD_NAMESPACE, or DefaultNamespace.
+func DefaultConfig() Config {
+	ns := os.Getenv("CONTAINERD_NAMESPACE")
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+	return Config{
+		Namespace:    ns,
+		Image:        "docker.io/library/ubuntu:bionic",
+		PullPolicy:   PullMissing,
+		Command:      []string{"/bin/bash", "-l"},
+		Capabilities: []string{"CAP_SYS_PTRACE"}, // for gdb
+		Namespaces:   []specs.LinuxNamespaceType{specs.PIDNamespace},
+		JoinUserNS:   true,
+		ReadOnly:     true,
+		TTY:          true,
+		Stdin:        os.Stdin,
+		Stdout:       os.Stdout,
+		Stderr:       os.Stderr,
+		Messages:     os.Stderr,
+	}
+}
+
+// Validate reports configurations that cannot work.
+func (cfg *Config) Validate() error {
+	if cfg.AsPID1 && hasNamespace(cfg.Namespaces, specs.PIDNamespace) {
+		return newError(ErrInvalidConfig, errors.New("cannot be PID 1 of the target's PID namespace"), "AsPID1 requires a private PID namespace")
+	}
+	if cfg.Native && (cfg.ImageArchive != "" || cfg.PersistView) {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("Native uses no debug image: ImageArchive and PersistView do not apply")}
+	}
+	if cfg.Image == "" && (cfg.ImageArchive == "" || cfg.PersistView) && !cfg.Native {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("Image is required unless importing it from ImageArchive")}
+	}
+	switch cfg.Layering {
+	case "", LayeringDebugOverTarget, LayeringTargetOverDebug:
+	default:
+		return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("unknown layering %q: want %s or %s", cfg.Layering, LayeringDebugOverTarget, LayeringTargetOverDebug)}
+	}
+	if cfg.Native && (cfg.Layering != "" || cfg.NoOverlay) {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("Native uses no debug image: Layering and NoOverlay do not apply")}
+	}
+	if cfg.WritableTarget && (cfg.ReadOnly || cfg.Native) {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("WritableTarget requires a writable session, and does not apply to Native")}
+	}
+	if cfg.NoOverlay && cfg.Layering != "" {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("NoOverlay and Layering are exclusive")}
+	}
+	switch cfg.Network {
+	case "", NetworkHost, NetworkNone:
+	default:
+		return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("unknown network %q: want host or none", cfg.Network)}
+	}
+	if cfg.StateDir != "" {
+		if cfg.ScratchDir != "" {
+			return &Error{Kind: ErrInvalidConfig, Err: errors.New("StateDir and ScratchDir are exclusive")}
+		}
+		if cfg.ReadOnly {
+			return &Error{Kind: ErrInvalidConfig, Err: errors.New("StateDir requires a writable session")}
+		}
+		if strings.ContainsAny(cfg.StateDir, "/") || cfg.StateDir == "." || cfg.StateDir == ".." {
+			return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("StateDir %q is not a plain name", cfg.StateDir)}
+		}
+	}
+	if cfg.ExportDiff != "" && cfg.ReadOnly {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("ExportDiff requires a writable session")}
+	}
+	if cfg.ExportDiff != "" && cfg.NoOverlay {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("ExportDiff requires an overlay to take the changes, not NoOverlay")}
+	}
+	if cfg.FetchSymbols && (cfg.ReadOnly || cfg.DebuginfodURLs == "") {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("FetchSymbols requires a writable session and DebuginfodURLs")}
+	}
+	if cfg.TargetCgroup && (cfg.Memory != 0 || cfg.CPUs != 0 || cfg.PidsLimit != 0 || cfg.MirrorLimits) {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("Memory, CPUs, PidsLimit and MirrorLimits do not apply to the target's cgroup")}
+	}
+	if cfg.Memory < 0 || cfg.CPUs < 0 || cfg.PidsLimit < 0 {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("Memory, CPUs and PidsLimit must not be negative")}
+	}
+	switch cfg.PullPolicy {
+	case "", PullAlways, PullMissing, PullNever:
+	default:
+		return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("unknown pull policy %q: want always, missing or never", cfg.PullPolicy)}
+	}
+	if cfg.Platform != "" {
+		if _, err := platforms.Parse(cfg.Platform); err != nil {
+			return newError(ErrInvalidConfig, err, "platform")
+		}
+	}
+	for _, caps := range [][]string{cfg.Capabilities, cfg.DropCapabilities} {
+		for _, c := range caps {
+			if c != AllCapabilities && !containsCapability(capabilityNames, c) {
+				return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("unknown capability %q: want a name like CAP_NET_ADMIN", c)}
+			}
+		}
+	}
+	switch cfg.Seccomp {
+	case "", SeccompDefault, SeccompUnconfined:
+	default:
+		if _, err := loadSeccompProfile(cfg.Seccomp); err != nil {
+			return &Error{Kind: ErrInvalidConfig, Err: err}
+		}
+	}
+	if err := checkAppArmorProfile(cfg.AppArmor); err != nil {
+		return &Error{Kind: ErrInvalidConfig, Err: err}
+	}
+	if cfg.SELinuxDisable && (cfg.SELinuxLabel != "" || cfg.SELinuxMountLabel != "") {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("SELinuxDisable conflicts with SELinux labels")}
+	}
+	if cfg.SELinuxLabel != "" && cfg.SELinuxLabel != SELinuxTarget && !validSELinuxLabel(cfg.SELinuxLabel) {
+		return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("SELinux label %q: want user:role:type:level or target", cfg.SELinuxLabel)}
+	}
+	if cfg.SELinuxMountLabel != "" && !validSELinuxLabel(cfg.SELinuxMountLabel) {
+		return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("SELinux mount label %q: want user:role:type:level", cfg.SELinuxMountLabel)}
+	}
+	if cfg.WorkDir != "" && cfg.WorkDir != WorkDirTarget && !filepath.IsAbs(cfg.WorkDir) {
+		return &Error{Kind: ErrInvalidConfig, Err: fmt.Errorf("WorkDir %q is not absolute", cfg.WorkDir)}
+	}
+	if cfg.User != "" && cfg.User != UserTarget {
+		if _, _, err := ParseUser(cfg.User); err != nil {
+			return &Error{Kind: ErrInvalidConfig, Err: err}
+		}
+	}
+	if err := validatePatterns(cfg.MountInclude); err != nil {
+		return err
+	}
+	if err := validatePatterns(cfg.MountExclude); err != nil {
+		return err
+	}
+	if cfg.AsPID1 && cfg.InitBinary == "" {
+		return &Error{Kind: ErrInvalidConfig, Err: errors.New("AsPID1 requires InitBinary")}
+	}
+	return nil
+}
+
+func (cfg *Config) snapshotter() string {
+	if cfg.Snapshotter == "" {
+		return containerd.DefaultSnapshotter
+	}
+	return cfg.Snapshotter
+}
+
+func (cfg *Config) printf(format string, args ...interface{}) {
+	if cfg.Events != nil {
+		cfg.message(format, args...)
+		return
+	}
+	if cfg.Messages != nil {
+		fmt.Fprintf(cfg.Messages, format, args...)
+	}
+}
+
+// Run connects to containerd, resolves cfg.Target and runs a debug session
+// against it. It returns the exit code of the debug process.
+func Run(ctx context.Context, cfg Config) (int, error) {
+	if cfg.Address == "" {
+		cfg.Address = DiscoverAddress(ctx)
+	}
+	client, err := containerd.New(cfg.Address)
+	if err != nil {
+		return 0, newError(ErrContainerd, err, "connect")
+	}
+	defer client.Close()
+
+	if cfg.AnyNamespace {
+		cfg.Namespace, err = FindNamespace(ctx, client, cfg.Target)
+		if err != nil {
+			return 0, err
+		}
+	}
+	ctx = namespaces.WithNamespace(ctx, cfg.Namespace)
+	var c containerd.Container
+	switch {
+	case cfg.Host:
+		c = Host()
+	case cfg.PID != 0:
+		c, err = HostProcess(cfg.PID)
+	case cfg.Pod != "":
+		ns, pod, name := ParsePod(cfg.Pod, "")
+		c, err = ResolvePod(ctx, client, ns, pod, name)
+	case len(cfg.Filters) > 0:
+		c, err = ResolveFilter(ctx, client, cfg.Filters, cfg.First)
+	default:
+		c, err = ResolveContainer(ctx, client, cfg.Target)
+	}
+	if err != nil {
+		return 0, newError(KindOf(err), err, "load container")
+	}
+	return Debug(ctx, client, c, cfg)
+}
+
+// Debug runs a debug session against the target container c and returns
+// the exit code of the debug process. All resources created for the
+// session are removed before it returns, unless it is detached from; then
+// Attach removes them when the session ends.
+func Debug(ctx context.Context, client *containerd.Client, c containerd.Container, cfg Config) (int, error) {
+	return DebugTarget(ctx, &containerdBackend{client: client}, &Target{ID: c.ID(), container: c}, cfg)
+}
+
+// containerdDebug is a debug container of the containerd backend, with the
+// snapshot, mounts and workspace that cleanup removes along with it.
+type containerdDebug struct {
+	cfg    Config
+	target containerd.Container
+	dbg    containerd.Container
+	ws     Workspace
+	// targetTask is nil for a stopped target
+	targetTask containerd.Task
+	targetExit <-chan Exit
+	task       containerd.Task
+	cleanupCtx context.Context
+	cleanup    cleanupStack
+}
+
+// Create overlays the debug image on the target's root filesystem in a
+// workspace and creates the debug container there, in the target's
+// namespaces.
+func (b *containerdBackend) Create(ctx context.Context, target *Target, cfg Config) (_ DebugContainer, err error) {
+	ctx = b.withNamespace(ctx)
+	client, c := b.client, target.container
+	// teardown must still work after ctx is cancelled by an interrupt
+	d := &containerdDebug{target: c, cleanupCtx: cleanupContext(ctx)}
+	cleanup := &d.cleanup
+	defer func() {
+		if r := recover(); r != nil {
+			// don't leave mounts and snapshots behind on a bug either
+			cleanup.run(d.cleanupCtx)
+			panic(r)
+		}
+		if err != nil {
+			cleanup.run(d.cleanupCtx)
+		}
+	}()
+
+	info, err := c.Info(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "info")
+	}
+	// the debug image goes where the target's layers are, so a snapshotter
+	// the target was created with (stargz, zfs...) is known to work
+	if cfg.Snapshotter == "" {
+		cfg.Snapshotter = info.Snapshotter
+	}
+	ss := client.SnapshotService(cfg.snapshotter())
+	log.G(ctx).Debugf("snapshotter %s", cfg.snapshotter())
+	if err := claimID(ctx, client, ss, cfg); err != nil {
+		return nil, err
+	}
+	spec, err := c.Spec(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "spec")
+	}
+	runtime := cfg.Runtime
+	if runtime == "" {
+		runtime = info.Runtime.Name
+	}
+	if isSandboxedRuntime(info.Runtime.Name) {
+		cfg.printf("warning: target runs under sandboxed runtime %s; "+
+			"its namespaces live inside a VM or user-space kernel and joining them from the host will not work as expected\n",
+			info.Runtime.Name)
+	}
+	targetTask, stopped, err := targetState(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	// pid is 0 for a stopped target, with nothing to join
+	var pid uint32
+	if stopped {
+		if !cfg.Stopped {
+			return nil, newError(ErrTargetNotRunning, errors.New("not running"), "target %s; Stopped debugs its filesystem only", c.ID())
+		}
+		cfg.printf("target %s is not running; debugging its filesystem only\n", c.ID())
+		cfg.Namespaces = nil
+		cfg.JoinUserNS = false
+	} else {
+		pid = targetTask.Pid()
+	}
+	if cfg.JoinUserNS && !hasNamespace(cfg.Namespaces, specs.UserNamespace) {
+		separate, err := InSeparateUserNamespace(pid)
+		if err != nil {
+			return nil, newError(ErrPermission, err, "user namespace")
+		}
+		if separate {
+			log.G(ctx).Debugf("target %s is in a user namespace; joining it", c.ID())
+			cfg.Namespaces = append(cfg.Namespaces[:len(cfg.Namespaces):len(cfg.Namespaces)], specs.UserNamespace)
+		}
+	}
+	err = CheckPrivileges(pid, cfg.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Privileged {
+		cfg.printf("warning: privileged session: all capabilities, all devices, unmasked /proc and writable /sys\n")
+		cfg.Capabilities = capabilityNames
+	}
+	// the runtime rejects capabilities outside our bounding set outright,
+	// so go without them rather than fail with an opaque error
+	caps, missing, err := boundedCapabilities(cfg.capabilities())
+	if err != nil {
+		return nil, newError(ErrPermission, err, "capabilities")
+	}
+	if cfg.Privileged {
+		// all capabilities means all the host allows
+		missing = nil
+	}
+	for _, c := range missing {
+		if c == "CAP_SYS_PTRACE" {
+			cfg.printf("warning: CAP_SYS_PTRACE is not in the host's bounding set; " +
+				"continuing without it, so gdb, strace and other ptrace-based tools will not work\n")
+			continue
+		}
+		cfg.printf("warning: %s is not in the host's bounding set; continuing without it\n", c)
+	}
+	cfg.Capabilities = caps
+	if cfg.DebuginfodURLs != "" {
+		cfg.setupSymbols(pid)
+	}
+
+	// in native mode there is no debug image, and i stays nil
+	var (
+		i      containerd.Image
+		parent string
+	)
+	if !cfg.Native {
+		pullCtx, cancel := withTimeout(ctx, cfg.PullTimeout)
+		i, parent, err = PrepareImage(pullCtx, client, cfg)
+		cancel()
+		if err != nil {
+			return nil, timedOut(pullCtx, err, "getting the debug image", cfg.PullTimeout,
+				"check that the registry is reachable and the image exists")
+		}
+		cfg.event(Event{Type: EventImage, Target: c.ID(), Image: i.Name(), Digest: i.Target().Digest.String()})
+	}
+	if cfg.Resolved != nil {
+		if err := cfg.Resolved(ctx, c, i); err != nil {
+			return nil, err
+		}
+	}
+
+	// without overlay support in the kernel, or NoOverlay, the debug image
+	// itself is the root, in a writable snapshot so the target can be
+	// mounted inside it
+	subpath := !cfg.Native && (cfg.NoOverlay || !overlaySupported())
+	// where the target's root is then, also without an overlay
+	targetPath := TargetPath
+	if cfg.NoOverlay {
+		targetPath = NoOverlayTargetPath
+	}
+
+	// creating and starting the debug container must not hang on a
+	// wedged containerd; the session itself may run for as long as it likes
+	startCtx, cancelStart := withTimeout(ctx, cfg.StartTimeout)
+	defer cancelStart()
+	startErr := func(err error) error {
+		return timedOut(startCtx, err, "starting the debug container", cfg.StartTimeout,
+			"check that containerd and its shims are responsive")
+	}
+
+	// create debug image snapshot path
+	var (
+		mounts   []mount.Mount
+		snapshot string
+	)
+	switch {
+	case cfg.Native:
+	case subpath:
+		snapshot = cfg.ID
+		mounts, err = ss.Prepare(startCtx, cfg.ID, parent, snapshots.WithLabels(map[string]string{sessionSnapshotLabel: cfg.ID, targetLabel: c.ID()}))
+		if errdefs.IsAlreadyExists(err) {
+			return nil, errInUse(cfg.ID)
+		}
+		if err != nil {
+			return nil, startErr(newError(ErrContainerd, err, "prepare: %s", parent))
+		}
+		cleanup.push(func(ctx context.Context) error {
+			if err := ss.Remove(ctx, cfg.ID); err != nil {
+				return newError(ErrCleanup, err, "remove")
+			}
+			return nil
+		})
+	case cfg.CacheView:
+		mounts, err = cachedView(startCtx, client, ss, parent)
+		if err != nil {
+			return nil, startErr(newError(ErrContainerd, err, "cached view: %s", parent))
+		}
+	default:
+		snapshot = cfg.ID
+		mounts, err = ss.View(startCtx, cfg.ID, parent, snapshots.WithLabels(map[string]string{sessionSnapshotLabel: cfg.ID, targetLabel: c.ID()}))
+		if errdefs.IsAlreadyExists(err) {
+			return nil, errInUse(cfg.ID)
+		}
+		if err != nil {
+			return nil, startErr(newError(ErrContainerd, err, "view: %s", parent))
+		}
+		cleanup.push(func(ctx context.Context) error {
+			if err := ss.Remove(ctx, cfg.ID); err != nil {
+				return newError(ErrCleanup, err, "remove")
+			}
+			return nil
+		})
+	}
+	if !cfg.Native {
+		var ms []string
+		for _, m := range mounts {
+			ms = append(ms, fmt.Sprint(m))
+		}
+		cfg.event(Event{Type: EventSnapshot, Target: c.ID(), Snapshot: snapshot, Mounts: ms})
+		log.G(ctx).WithFields(logrus.Fields{
+			"snapshot": snapshot,
+			"types":    mountTypes(mounts),
+			"mounts":   ms,
+		}).Debug("debug image mounts")
+	}
+
+	// create scratch workspace
+	dir := cfg.ScratchDir
+	if cfg.StateDir != "" {
+		dir = filepath.Join(StateRoot, cfg.StateDir)
+	}
+	var ws Workspace
+	if _, host := c.(*hostProcess); host && dir == "" {
+		ws, err = newTmpfsWorkspace()
+	} else {
+		ws, err = NewWorkspace(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StateDir != "" {
+		if prev := ws.stateTarget(); prev != "" && prev != c.ID() {
+			cfg.printf("warning: state %s was last used with %s, not %s\n", cfg.StateDir, prev, c.ID())
+		}
+		if err := ws.setStateTarget(c.ID()); err != nil {
+			return nil, newError(ErrMountFailed, err, "state %s", cfg.StateDir)
+		}
+	}
+	if dir == "" {
+		cleanup.pushIfClean(func(ctx context.Context) error {
+			if err := removeWorkspace(ws.Dir); err != nil {
+				return newError(ErrCleanup, err, "remove: %s", ws.Dir)
+			}
+			return nil
+		})
+		cleanup.push(func(ctx context.Context) error {
+			return unmount(ws.Dir)
+		})
+	}
+
+	// mount debug image snapshot into workspace
+	if !cfg.Native {
+		err = mount.All(mounts, ws.DebugRoot())
+		if err != nil {
+			return nil, newError(ErrMountFailed, err, "mount all: %+v", mounts)
+		}
+		cleanup.push(func(ctx context.Context) error {
+			return unmount(ws.DebugRoot())
+		})
+	}
+
+	// the rootfs of a stopped target is no longer mounted: mount its
+	// snapshot ourselves, read-only
+	var targetRoot string
+	if stopped && info.SnapshotKey != "" {
+		targetRoot = ws.TargetRoot()
+		err = mountTargetSnapshot(ctx, client, info, targetRoot)
+		if err != nil {
+			return nil, err
+		}
+		cleanup.push(func(ctx context.Context) error {
+			return unmount(targetRoot)
+		})
+	} else {
+		targetRoot, err = targetRootfs(ctx, info, spec, pid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.G(ctx).Debugf("target root filesystem %s", targetRoot)
+	targetReadOnly := readOnlyRoot(spec.Root, targetRoot)
+
+	// overlay of workspace snapshot over target container fs; a read-only
+	// native session needs no overlay and uses the target's rootfs directly,
+	// unless that is a /proc magic link the runtime would take for a symlink
+	var extraOpts []oci.SpecOpts
+	rootfs := ws.Root()
+	// the overlay is mounted once the spec is known, with its mountpoints
+	var overlay bool
+	switch {
+	case cfg.Native && cfg.ReadOnly && !strings.HasPrefix(targetRoot, "/proc/"):
+		rootfs = targetRoot
+	case subpath:
+		if cfg.NoOverlay {
+			cfg.printf("the target's root is at %s\n", targetPath)
+		} else {
+			cfg.printf("warning: no overlay filesystem support; the target's root is at %s instead\n", targetPath)
+		}
+		if cfg.ExportDiff != "" {
+			cfg.printf("warning: changes cannot be exported without an overlay upperdir\n")
+		}
+		err = makeSubDirs(filepath.Join(ws.DebugRoot(), targetPath))
+		if err != nil {
+			return nil, newError(ErrMountFailed, err, "mkdir")
+		}
+		if targetReadOnly && cfg.WritableTarget {
+			cfg.printf("warning: the target's root filesystem is read-only, so %s is too\n", targetPath)
+		}
+		rootfs = ws.DebugRoot()
+		// with no overlay to take the changes, they would go to the live
+		// target, so only on request
+		extraOpts = append(extraOpts, withTargetRoot(targetRoot, targetPath, !cfg.WritableTarget || targetReadOnly))
+		if cfg.ReadOnly {
+			extraOpts = append(extraOpts, oci.WithRootFSReadonly())
+		}
+	default:
+		overlay = true
+		// the target's own files, for those the debug image shadows or
+		// the session changed
+		extraOpts = append(extraOpts, withTargetRoot(targetRoot, TargetPath, true))
+	}
+
+	if stopped {
+		if logs := targetLogDir(c.ID(), info.Labels); logs != "" {
+			extraOpts = append(extraOpts, withTargetLogs(logs))
+			cfg.printf("its logs are in %s\n", LogsPath)
+		}
+	}
+
+	if cfg.WorkDir == WorkDirTarget && stopped {
+		// where it would have started
+		if spec.Process != nil && spec.Process.Cwd != "" {
+			extraOpts = append(extraOpts, oci.WithProcessCwd(spec.Process.Cwd))
+		}
+	} else if cfg.WorkDir != "" {
+		var under string
+		if subpath {
+			under = targetPath
+		}
+		dir, err := workDir(cfg.WorkDir, pid, under)
+		if err != nil {
+			return nil, newError(ErrTargetNotRunning, err, "working directory")
+		}
+		extraOpts = append(extraOpts, oci.WithProcessCwd(dir))
+	}
+
+	// attach loop devices, exposing either the device or its filesystem
+	for n, l := range cfg.Loops {
+		var dev string
+		dev, err = attachLoop(l.Image, cfg.ReadOnly)
+		if err != nil {
+			return nil, newError(ErrMountFailed, err, "loop: %s", l.Image)
+		}
+		cleanup.push(func(ctx context.Context) error {
+			if err := detachLoop(dev); err != nil {
+				return newError(ErrCleanup, err, "loop: %s", dev)
+			}
+			return nil
+		})
+		if l.IsDevice() {
+			extraOpts = append(extraOpts, WithBlockDevice(dev, l.Dest, cfg.ReadOnly))
+			continue
+		}
+		dir := ws.LoopDir(n)
+		err = makeSubDirs(dir)
+		if err == nil {
+			err = mountLoop(dev, dir, cfg.ReadOnly)
+		}
+		if err != nil {
+			return nil, newError(ErrMountFailed, err, "loop: %s", l.Image)
+		}
+		cleanup.push(func(ctx context.Context) error {
+			return unmount(dir)
+		})
+		mode := "rw"
+		if cfg.ReadOnly {
+			mode = "ro"
+		}
+		extraOpts = append(extraOpts, oci.WithMounts([]specs.Mount{{
+			Destination: l.Dest,
+			Type:        "bind",
+			Source:      dir,
+			Options:     []string{"rbind", mode},
+		}}))
+	}
+
+	dbgSpec, err := oci.GenerateSpec(ctx, client, &containers.Container{ID: cfg.ID},
+		append([]oci.SpecOpts{DebugSpec(cfg, i, rootfs, spec, pid)}, extraOpts...)...)
+	if err != nil {
+		return nil, newError(ErrDebugFailed, err, "spec")
+	}
+	if overlay {
+		// runc cannot make the mountpoints missing from a read-only
+		// overlay, so they are laid out in its top lowerdir first
+		err = makeMountpoints(ws.MountpointDir(), overlayLowers(ws, targetRoot, cfg.ReadOnly, cfg.Layering), dbgSpec.Mounts)
+		if err != nil {
+			return nil, newError(ErrMountFailed, err, "mountpoints")
+		}
+		opts := OverlayOptions(ws, targetRoot, cfg.ReadOnly, cfg.Layering)
+		log.G(ctx).WithFields(logrus.Fields{"target": ws.Root(), "options": opts}).Debug("mount overlay")
+		err = MountOverlay(ws.Root(), opts)
+		if err != nil {
+			return nil, err
+		}
+		cleanup.push(func(ctx context.Context) error {
+			return unmount(ws.Root())
+		})
+		if cfg.ExportDiff != "" {
+			// once the debug process is gone, before the overlay is
+			cleanup.push(func(ctx context.Context) error {
+				if err := ExportDiff(ws.UpperDir(), cfg.ExportDiff); err != nil {
+					return newError(ErrCleanup, err, "export diff: %s", cfg.ExportDiff)
+				}
+				cfg.printf("changes exported to %s\n", cfg.ExportDiff)
+				return nil
+			})
+		}
+	}
+
+	// create debug container in target namespaces
+	containerOpts := []containerd.NewContainerOpts{
+		containerd.WithContainerLabels(sessionLabels(cfg, c.ID(), ws, dir == "", snapshot)),
+		containerd.WithSpec(dbgSpec),
+	}
+	if runtime != "" {
+		// a host process has none; containerd's default will do
+		containerOpts = append(containerOpts, containerd.WithRuntime(runtime, nil))
+	}
+	if i != nil {
+		// recorded for Commit
+		containerOpts = append(containerOpts, containerd.WithImage(i))
+	}
+	dbg, err := client.NewContainer(startCtx, cfg.ID, containerOpts...)
+	if errdefs.IsAlreadyExists(err) {
+		return nil, errInUse(cfg.ID)
+	}
+	if err != nil {
+		return nil, startErr(newError(ErrDebugFailed, err, "create"))
+	}
+	if log.G(ctx).Logger.IsLevelEnabled(logrus.DebugLevel) {
+		if s, err := dbg.Spec(ctx); err == nil {
+			b, _ := json.Marshal(s)
+			log.G(ctx).WithField("spec", string(b)).Debug("debug container spec")
+		}
+	}
+	cleanup.push(func(ctx context.Context) error {
+		if err := dbg.Delete(ctx); err != nil {
+			return newError(ErrCleanup, err, "delete dbg")
+		}
+		return nil
+	})
+
+	d.cfg, d.dbg, d.ws = cfg, dbg, ws
+	if !stopped {
+		d.targetTask = targetTask
+	}
+	return d, nil
+}
+
+// Start creates the task of the debug container with the streams given,
+// and starts it.
+func (d *containerdDebug) Start(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (<-chan Exit, error) {
+	cfg := d.cfg
+	startCtx, cancelStart := withTimeout(ctx, cfg.StartTimeout)
+	defer cancelStart()
+	startErr := func(err error) error {
+		return timedOut(startCtx, err, "starting the debug container", cfg.StartTimeout,
+			"check that containerd and its shims are responsive")
+	}
+
+	var closer *stdinCloser
+	if !cfg.TTY && stdin != nil {
+		closer = newStdinCloser(stdin)
+		stdin = closer
+	}
+
+	// create task for debug container with tty
+	opt := []cio.Opt{withStreams(stdin, stdout, stderr)}
+	if cfg.TTY {
+		opt = []cio.Opt{
+			cio.WithTerminal,
+			withStreams(stdin, stdout, nil),
+			cio.WithFIFODir(d.ws.FIFODir()),
+		}
+	}
+	t, err := d.dbg.NewTask(startCtx, cio.NewCreator(opt...))
+	if err != nil {
+		return nil, startErr(newError(ErrDebugFailed, err, "task"))
+	}
+	d.task = t
+	d.cleanup.push(func(ctx context.Context) error {
+		if _, err := t.Delete(ctx, containerd.WithProcessKill); err != nil {
+			return newError(ErrCleanup, err, "delete task")
+		}
+		return nil
+	})
+	if closer != nil {
+		closer.setProcess(d.cleanupCtx, t)
+	}
+
+	// watch the target so we notice if it dies under us
+	if d.targetTask != nil {
+		targetExit, err := d.targetTask.Wait(ctx)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "wait target")
+		}
+		d.targetExit = exitOf(targetExit)
+	}
+
+	// run the process and wait for termination
+	exit, err := t.Wait(ctx)
+	if err != nil {
+		return nil, newError(ErrDebugFailed, err, "wait")
+	}
+	err = t.Start(startCtx)
+	if err != nil {
+		return nil, startErr(newError(ErrDebugFailed, err, "start"))
+	}
+	if cfg.Started != nil {
+		cfg.Started(t)
+	}
+	for _, p := range cfg.Publish {
+		l, err := publish(ctx, p, t.Pid())
+		if err != nil {
+			return nil, newError(ErrDebugFailed, err, "publish %s", p)
+		}
+		d.cleanup.push(func(ctx context.Context) error {
+			l.Close()
+			return nil
+		})
+		cfg.printf("forwarding %s to port %d of %s\r\n", l.Addr(), p.ContainerPort, cfg.ID)
+	}
+	return exitOf(exit), nil
+}
+
+func (d *containerdDebug) Pid() uint32 {
+	return d.task.Pid()
+}
+
+func (d *containerdDebug) Resize(ctx context.Context, w, h uint32) error {
+	return d.task.Resize(ctx, w, h)
+}
+
+func (d *containerdDebug) TargetExit() <-chan Exit {
+	return d.targetExit
+}
+
+func (d *containerdDebug) Kill(ctx context.Context) error {
+	return d.task.Kill(ctx, unix.SIGKILL)
+}
+
+// Reattach is cdbg attach, unless the session has loop devices or changes
+// to export that only this process can take care of.
+func (d *containerdDebug) Reattach() string {
+	if len(d.cfg.Loops) > 0 || d.cfg.ExportDiff != "" {
+		return ""
+	}
+	return "cdbg attach " + d.cfg.ID
+}
+
+// Detach leaves the session to Attach, which removes what it leaves once
+// it ends.
+func (d *containerdDebug) Detach() {}
+
+// Remove removes the task, the debug container and everything Create set
+// up for it, last first.
+func (d *containerdDebug) Remove(ctx context.Context) error {
+	return d.cleanup.run(ctx)
+}
+
+// exitOf passes on the exit status delivered on ch as an Exit, with the
+// error of waiting for it if that failed.
+func exitOf(ch <-chan containerd.ExitStatus) <-chan Exit {
+	exit := make(chan Exit, 1)
+	go func() {
+		status := <-ch
+		exit <- Exit{Code: status.ExitCode(), Time: status.ExitTime(), Err: status.Error()}
+	}()
+	return exit
+}
+
+// isSandboxedRuntime reports whether the named runtime isolates containers in a VM or
+// user-space kernel (Kata, gVisor), where host namespace paths are useless.
+func isSandboxedRuntime(name string) bool {
+	for _, s := range []string{"kata", "runsc", "gvisor"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmount unmounts everything mounted at dir.
+func unmount(dir string) error {
+	if err := mount.UnmountAll(dir, 0); err != nil {
+		return newError(ErrCleanup, err, "unmount: %s", dir)
+	}
+	return nil
+}
+
+// unmountUnder unmounts everything mounted at dir or below it, deepest
+// first.
+func unmountUnder(dir string) error {
+	mounts, err := mount.Self()
+	if err != nil {
+		return newError(ErrCleanup, err, "mounts")
+	}
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+	for _, m := range mounts {
+		if within(dir, m.Mountpoint) {
+			if err := unmount(m.Mountpoint); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withTimeout returns ctx with a timeout of d, or without one if d is 0.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// timedOut explains err, if it is from running out of ctx's timeout d, as
+// what did not finish in time and what to check.
+func timedOut(ctx context.Context, err error, what string, d time.Duration, hint string) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	kind := KindOf(err)
+	if kind == nil {
+		kind = ErrContainerd
+	}
+	return newError(kind, err, "%s took longer than %s; %s", what, d, hint)
+}
+
+// cleanupContext returns a context in the same namespace as ctx that is not
+// cancelled along with it.
+func cleanupContext(ctx context.Context) context.Context {
+	ns, _ := namespaces.Namespace(ctx)
+	return namespaces.WithNamespace(context.Background(), ns)
+}
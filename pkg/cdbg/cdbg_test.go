@@ -0,0 +1,59 @@
+package cdbg
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		cfg   func(cfg *Config)
+		valid bool
+	}{
+		{name: "default", cfg: func(cfg *Config) {}, valid: true},
+		{name: "no image", cfg: func(cfg *Config) { cfg.Image = "" }},
+		{name: "image archive", cfg: func(cfg *Config) { cfg.Image, cfg.ImageArchive = "", "debug.tar" }, valid: true},
+		{name: "native", cfg: func(cfg *Config) { cfg.Image, cfg.Native = "", true }, valid: true},
+		{name: "native persist view", cfg: func(cfg *Config) { cfg.Native, cfg.PersistView = true, true }},
+		{name: "pid 1 in target ns", cfg: func(cfg *Config) { cfg.AsPID1, cfg.InitBinary = true, "/sbin/tini" }},
+		{
+			name: "pid 1",
+			cfg: func(cfg *Config) {
+				cfg.AsPID1, cfg.InitBinary = true, "/sbin/tini"
+				cfg.Namespaces = []specs.LinuxNamespaceType{specs.NetworkNamespace}
+			},
+			valid: true,
+		},
+		{name: "layering", cfg: func(cfg *Config) { cfg.Layering = LayeringTargetOverDebug }, valid: true},
+		{name: "unknown layering", cfg: func(cfg *Config) { cfg.Layering = "sideways" }},
+		{name: "read-only writable target", cfg: func(cfg *Config) { cfg.WritableTarget = true }},
+		{name: "writable target", cfg: func(cfg *Config) { cfg.WritableTarget, cfg.ReadOnly = true, false }, valid: true},
+		{name: "export diff", cfg: func(cfg *Config) { cfg.ExportDiff, cfg.ReadOnly = "d.tar", false }, valid: true},
+		{name: "no overlay export diff", cfg: func(cfg *Config) { cfg.ExportDiff, cfg.ReadOnly, cfg.NoOverlay = "d.tar", false, true }},
+		{name: "unknown network", cfg: func(cfg *Config) { cfg.Network = "bridge" }},
+		{name: "read-only state dir", cfg: func(cfg *Config) { cfg.StateDir = "s" }},
+		{name: "state dir", cfg: func(cfg *Config) { cfg.StateDir, cfg.ReadOnly = "s", false }, valid: true},
+		{name: "state dir path", cfg: func(cfg *Config) { cfg.StateDir, cfg.ReadOnly = "../s", false }},
+		{name: "unknown pull policy", cfg: func(cfg *Config) { cfg.PullPolicy = "sometimes" }},
+		{name: "platform", cfg: func(cfg *Config) { cfg.Platform = "linux/arm64" }, valid: true},
+		{name: "bad platform", cfg: func(cfg *Config) { cfg.Platform = "linux/arm64/v8/x" }},
+		{name: "unknown capability", cfg: func(cfg *Config) { cfg.Capabilities = []string{"CAP_FLY"} }},
+		{name: "all capabilities", cfg: func(cfg *Config) { cfg.Capabilities = []string{AllCapabilities} }, valid: true},
+		{name: "negative memory", cfg: func(cfg *Config) { cfg.Memory = -1 }},
+		{name: "relative workdir", cfg: func(cfg *Config) { cfg.WorkDir = "tmp" }},
+		{name: "bad user", cfg: func(cfg *Config) { cfg.User = "root" }},
+		{name: "target user", cfg: func(cfg *Config) { cfg.User = UserTarget }, valid: true},
+	} {
+		cfg := DefaultConfig()
+		tt.cfg(&cfg)
+		err := cfg.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: Validate: %v", tt.name, err)
+		}
+		if !tt.valid && KindOf(err) != ErrInvalidConfig {
+			t.Errorf("%s: Validate = %v, want an ErrInvalidConfig", tt.name, err)
+		}
+	}
+}
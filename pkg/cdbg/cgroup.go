@@ -0,0 +1,122 @@
+package cdbg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// cpuPeriod is the CFS period, in microseconds, that CPUs is a share of.
+const cpuPeriod = 100000
+
+// WithTargetCgroup places the debug container in a cgroup of its own below
+// the target's, so it shares the target's memory and CPU limits. It is not
+// the target's cgroup itself, which the runtime would kill and remove along
+// with the debug container. A systemd cgroup (slice:prefix:name) has no
+// such child, so it is refused, and so is cgroup v2, where the target's
+// cgroup, having processes, may not have children with controllers.
+func WithTargetCgroup(target *oci.Spec) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if target.Linux == nil || target.Linux.CgroupsPath == "" {
+			return errors.New("target cgroup: the target's spec has no cgroups path")
+		}
+		parent := target.Linux.CgroupsPath
+		if !strings.HasPrefix(parent, "/") {
+			return fmt.Errorf("target cgroup: %q is not a cgroupfs path", parent)
+		}
+		if unifiedCgroups() {
+			return errors.New("target cgroup: on cgroup v2 the target's cgroup has processes, so it cannot have a child; mirror its limits instead")
+		}
+		spec.Linux.CgroupsPath = path.Join(parent, c.ID)
+		return nil
+	}
+}
+
+// unifiedCgroups reports whether the host mounts cgroup v2 alone.
+func unifiedCgroups() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup", &st); err != nil {
+		return false
+	}
+	return st.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// WithLimits limits the debug container's own cgroup to memory bytes and
+// cpus CPUs; zero leaves that resource unlimited.
+func WithLimits(memory int64, cpus float64) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if memory == 0 && cpus == 0 {
+			return nil
+		}
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		r := spec.Linux.Resources
+		if memory > 0 {
+			if r.Memory == nil {
+				r.Memory = &specs.LinuxMemory{}
+			}
+			r.Memory.Limit = &memory
+		}
+		if cpus > 0 {
+			if r.CPU == nil {
+				r.CPU = &specs.LinuxCPU{}
+			}
+			period := uint64(cpuPeriod)
+			quota := int64(cpus * cpuPeriod)
+			r.CPU.Period = &period
+			r.CPU.Quota = &quota
+		}
+		return nil
+	}
+}
+
+// WithPidsLimit limits the debug container's own cgroup to n processes;
+// zero leaves it unlimited.
+func WithPidsLimit(n int64) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if n == 0 {
+			return nil
+		}
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		spec.Linux.Resources.Pids = &specs.LinuxPids{Limit: n}
+		return nil
+	}
+}
+
+// WithTargetLimits gives the debug container's own cgroup the memory, CPU
+// and PIDs limits of the target's, so the session cannot take more of the
+// node than the target may. Later limits override them.
+func WithTargetLimits(target *oci.Spec) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if target.Linux == nil || target.Linux.Resources == nil {
+			return nil
+		}
+		t := target.Linux.Resources
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		r := spec.Linux.Resources
+		if t.Memory != nil && t.Memory.Limit != nil {
+			limit := *t.Memory.Limit
+			r.Memory = &specs.LinuxMemory{Limit: &limit}
+		}
+		if t.CPU != nil {
+			cpu := &specs.LinuxCPU{Shares: t.CPU.Shares, Quota: t.CPU.Quota, Period: t.CPU.Period}
+			r.CPU = cpu
+		}
+		if t.Pids != nil {
+			r.Pids = &specs.LinuxPids{Limit: t.Pids.Limit}
+		}
+		return nil
+	}
+}
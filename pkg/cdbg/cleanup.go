@@ -0,0 +1,67 @@
+package cdbg
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+)
+
+// cleanupStack undoes the steps of a session, last first. Every step runs
+// even if an earlier one fails, so one stuck mount does not leave the
+// snapshot and container behind too, except those pushed with pushIfClean.
+type cleanupStack []cleanupStep
+
+type cleanupStep struct {
+	f func(ctx context.Context) error
+	// ifClean is set for a step that runs only if all before it succeeded
+	ifClean bool
+}
+
+// push adds f to undo the step just taken.
+func (s *cleanupStack) push(f func(ctx context.Context) error) {
+	*s = append(*s, cleanupStep{f: f})
+}
+
+// pushIfClean adds f to undo the step just taken, but only once every step
+// pushed after it has succeeded: removing a directory must not follow a
+// failed unmount into the filesystem still mounted in it.
+func (s *cleanupStack) pushIfClean(f func(ctx context.Context) error) {
+	*s = append(*s, cleanupStep{f: f, ifClean: true})
+}
+
+// run runs and removes every step, last first, with ctx. It returns the
+// error of the step that failed, or all of them if several did.
+func (s *cleanupStack) run(ctx context.Context) error {
+	var errs cleanupErrors
+	for i := len(*s) - 1; i >= 0; i-- {
+		step := (*s)[i]
+		if step.ifClean && len(errs) > 0 {
+			log.G(ctx).Debug("cleanup: skipped after an earlier step failed")
+			continue
+		}
+		if err := step.f(ctx); err != nil {
+			log.G(ctx).WithError(err).Debug("cleanup")
+			errs = append(errs, err)
+		}
+	}
+	*s = nil
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return &Error{Kind: ErrCleanup, Op: "cleanup", Err: errs}
+}
+
+// cleanupErrors are the errors of several cleanup steps.
+type cleanupErrors []error
+
+func (errs cleanupErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
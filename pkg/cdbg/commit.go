@@ -0,0 +1,205 @@
+package cdbg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Commit saves the changes of the running, writable debug session id as a
+// new layer on top of its debug image, and stores the result as the image
+// ref.
+func Commit(ctx context.Context, client *containerd.Client, id, ref string) (containerd.Image, error) {
+	c, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		return nil, newError(ErrTargetNotFound, err, "session %s", id)
+	}
+	info, err := c.Info(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "session %s", id)
+	}
+	if info.Image == "" {
+		return nil, newError(ErrInvalidConfig, errors.New("it runs without a debug image"), "session %s", id)
+	}
+	spec, err := c.Spec(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "session %s", id)
+	}
+	// the session's root is the overlay mounted in its workspace
+	ws := Workspace{Dir: filepath.Dir(spec.Root.Path)}
+	if _, err := os.Stat(ws.UpperDir()); err != nil {
+		return nil, newError(ErrInvalidConfig, err, "session %s has no writable layer", id)
+	}
+	base, err := client.GetImage(ctx, info.Image)
+	if err != nil {
+		return nil, newError(ErrPullFailed, err, "debug image %s", info.Image)
+	}
+
+	// keep what we write from garbage collection until the image refers to it
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "lease")
+	}
+	defer done(ctx)
+
+	// the debug image's platform, as the session was started with
+	platform, err := platformMatcher(info.Labels[platformLabel])
+	if err != nil {
+		return nil, newError(ErrInvalidConfig, err, "session %s platform", id)
+	}
+	cs := client.ContentStore()
+	manifest, err := images.Manifest(ctx, cs, base.Target(), platform)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "manifest: %s", info.Image)
+	}
+	b, err := content.ReadBlob(ctx, cs, manifest.Config)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "config: %s", info.Image)
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, newError(ErrContainerd, err, "config: %s", info.Image)
+	}
+
+	docker := manifest.Config.MediaType == images.MediaTypeDockerSchema2Config
+	layer, diffID, err := writeLayer(ctx, cs, ws.UpperDir(), docker)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "layer")
+	}
+	now := time.Now().UTC()
+	config.Created = &now
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	config.History = append(config.History, ocispec.History{
+		Created:   &now,
+		CreatedBy: "cdbg commit " + id,
+	})
+	manifest.Config, err = writeJSON(ctx, cs, manifest.Config.MediaType, config, nil)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "config")
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	// the manifest's labels keep its config and layers alive
+	labels := map[string]string{"containerd.io/gc.ref.content.config": manifest.Config.Digest.String()}
+	for i, l := range manifest.Layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	manifestType := ocispec.MediaTypeImageManifest
+	if docker {
+		manifestType = images.MediaTypeDockerSchema2Manifest
+	}
+	manifest.Versioned = specs.Versioned{SchemaVersion: 2}
+	desc, err := writeJSON(ctx, cs, manifestType, struct {
+		MediaType string `json:"mediaType"`
+		ocispec.Manifest
+	}{manifestType, manifest}, labels)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "manifest")
+	}
+
+	is := client.ImageService()
+	img := images.Image{Name: ref, Target: desc}
+	_, err = is.Create(ctx, img)
+	if errdefs.IsAlreadyExists(err) {
+		_, err = is.Update(ctx, img, "target")
+	}
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "image: %s", ref)
+	}
+	return containerd.NewImageWithPlatform(client, img, platform), nil
+}
+
+// Push pushes the local image ref to its registry, using the registry
+// settings of cfg.
+func Push(ctx context.Context, client *containerd.Client, cfg Config, ref string) error {
+	i, err := client.GetImage(ctx, ref)
+	if err != nil {
+		return newError(ErrPullFailed, err, "push: %s", ref)
+	}
+	resolver, err := newResolver(ctx, cfg)
+	if err != nil {
+		return newError(ErrInvalidConfig, err, "push: %s", ref)
+	}
+	err = client.Push(ctx, ref, i.Target(), containerd.WithResolver(resolver))
+	if err != nil {
+		return newError(ErrPullFailed, err, "push: %s", ref)
+	}
+	return nil
+}
+
+// writeLayer stores the changes in upper as a gzipped layer tarball and
+// returns its descriptor and the digest of the uncompressed tarball.
+func writeLayer(ctx context.Context, cs content.Store, upper string, docker bool) (ocispec.Descriptor, digest.Digest, error) {
+	f, err := ioutil.TempFile("", "cdbg-layer")
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	blob := digest.Canonical.Digester()
+	diff := digest.Canonical.Digester()
+	zw := gzip.NewWriter(io.MultiWriter(f, blob.Hash()))
+	if err := writeDiff(io.MultiWriter(zw, diff.Hash()), upper); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    blob.Digest(),
+		Size:      size,
+	}
+	if docker {
+		desc.MediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+	err = content.WriteBlob(ctx, cs, desc.Digest.String(), f, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	return desc, diff.Digest(), nil
+}
+
+// writeJSON stores v in cs as a blob of mediaType.
+func writeJSON(ctx context.Context, cs content.Store, mediaType string, v interface{}, labels map[string]string) (ocispec.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	var opts []content.Opt
+	if labels != nil {
+		opts = append(opts, content.WithLabels(labels))
+	}
+	err = content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc, opts...)
+	return desc, err
+}
@@ -0,0 +1,44 @@
+package cdbg
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/containerd/console"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// Resizer is a process with a terminal that can be resized, such as a
+// containerd.Process.
+type Resizer interface {
+	Resize(ctx context.Context, w, h uint32) error
+}
+
+// HandleConsoleResize resizes the console of a task or exec process
+func HandleConsoleResize(ctx context.Context, task Resizer, con console.Console) error {
+	// do an initial resize of the console
+	size, err := con.Size()
+	if err != nil {
+		return err
+	}
+	if err := task.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
+		log.G(ctx).WithError(err).Error("resize pty")
+	}
+	s := make(chan os.Signal, 16)
+	signal.Notify(s, unix.SIGWINCH)
+	go func() {
+		for range s {
+			size, err := con.Size()
+			if err != nil {
+				log.G(ctx).WithError(err).Error("get pty size")
+				continue
+			}
+			if err := task.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
+				log.G(ctx).WithError(err).Error("resize pty")
+			}
+		}
+	}()
+	return nil
+}
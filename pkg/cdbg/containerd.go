@@ -0,0 +1,86 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// containerdBackend is the Backend of containerd, in the containerd
+// namespace of the Config it was created from, or else of the context.
+type containerdBackend struct {
+	client    *containerd.Client
+	namespace string
+}
+
+func newContainerdBackend(cfg Config) (Backend, error) {
+	address := cfg.Address
+	if address == "" {
+		address = DiscoverAddress(context.Background())
+	}
+	client, err := containerd.New(address)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "connect")
+	}
+	return &containerdBackend{client: client, namespace: cfg.Namespace}, nil
+}
+
+// NewContainerdBackend returns the Backend of containerd for client, in
+// the containerd namespace of the context it is used with. Unlike the one
+// NewBackend returns, closing it is left to the caller.
+func NewContainerdBackend(client *containerd.Client) Backend {
+	return &containerdBackend{client: client}
+}
+
+// Close closes the connection to containerd.
+func (b *containerdBackend) Close() error {
+	return b.client.Close()
+}
+
+func (b *containerdBackend) withNamespace(ctx context.Context) context.Context {
+	if b.namespace == "" {
+		return ctx
+	}
+	return namespaces.WithNamespace(ctx, b.namespace)
+}
+
+func (b *containerdBackend) Target(ctx context.Context, query string) (*Target, error) {
+	ctx = b.withNamespace(ctx)
+	c, err := ResolveContainer(ctx, b.client, query)
+	if err != nil {
+		return nil, newError(KindOf(err), err, "load container")
+	}
+	return ContainerTarget(ctx, c)
+}
+
+// Unsupported returns nothing: containerd's backend has every option.
+func (b *containerdBackend) Unsupported(cfg Config) []string {
+	return nil
+}
+
+// ContainerTarget returns c, a container of the containerd backend or a
+// host process, as its Target.
+func ContainerTarget(ctx context.Context, c containerd.Container) (*Target, error) {
+	t := &Target{ID: c.ID(), container: c}
+	task, stopped, err := targetState(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if !stopped {
+		t.Running = true
+		t.Pid = task.Pid()
+		t.Rootfs = fmt.Sprintf("/proc/%d/root", t.Pid)
+	}
+	if spec, err := c.Spec(ctx); err == nil {
+		if spec.Process != nil {
+			t.Env = spec.Process.Env
+		}
+		t.ReadOnly = spec.Root != nil && spec.Root.Readonly
+	}
+	if labels, err := c.Labels(ctx); err == nil {
+		t.Labels = labels
+	}
+	return t, nil
+}
@@ -0,0 +1,600 @@
+package cdbg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// CRIAddress is the CRI socket of CRI-O.
+const CRIAddress = "/var/run/crio/crio.sock"
+
+// criPollInterval is how often the status of the debug container is polled
+// while waiting for it to exit; the CRI has no call that waits.
+const criPollInterval = 250 * time.Millisecond
+
+// criClient talks to a container runtime through its CRI gRPC services.
+type criClient struct {
+	conn    *grpc.ClientConn
+	runtime runtime.RuntimeServiceClient
+	images  runtime.ImageServiceClient
+}
+
+// NewCRIBackend returns the Backend for nodes whose runtime is only
+// reachable through the Kubernetes CRI, such as CRI-O, at address
+// (CRIAddress if empty). The debug container is created in the target's
+// pod sandbox, sharing its net and ipc namespaces, and joins the target's
+// pid namespace.
+func NewCRIBackend(address string) (Backend, error) {
+	if address == "" {
+		address = CRIAddress
+	}
+	socket := strings.TrimPrefix(address, "unix://")
+	conn, err := grpc.Dial(socket,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", addr)
+		}),
+		grpc.WithUnaryInterceptor(logCRI),
+	)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "connect %s", address)
+	}
+	return &criClient{
+		conn:    conn,
+		runtime: runtime.NewRuntimeServiceClient(conn),
+		images:  runtime.NewImageServiceClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the runtime.
+func (c *criClient) Close() error {
+	return c.conn.Close()
+}
+
+// logCRI logs a CRI request at debug level.
+func logCRI(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	log.G(ctx).Debugf("cri %s", method)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// criInfo is what cdbg reads of the verbose status of a container, which
+// containerd and CRI-O both report as JSON under "info".
+type criInfo struct {
+	Pid         uint32     `json:"pid"`
+	RuntimeSpec specs.Spec `json:"runtimeSpec"`
+}
+
+func (c *criClient) Target(ctx context.Context, query string) (*Target, error) {
+	// runtimes differ in what prefixes they accept, so match them here
+	list, err := c.runtime.ListContainers(ctx, &runtime.ListContainersRequest{})
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "containers")
+	}
+	var found []*runtime.Container
+	for _, ctr := range list.Containers {
+		if ctr.Id == query {
+			found = []*runtime.Container{ctr}
+			break
+		}
+		if strings.HasPrefix(ctr.Id, query) {
+			found = append(found, ctr)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, newError(ErrTargetNotFound, fmt.Errorf("no such container"), "%s", query)
+	case len(found) > 1:
+		e := &AmbiguousError{Query: query}
+		for _, ctr := range found {
+			e.Candidates = append(e.Candidates, containers.Container{ID: ctr.Id, Labels: ctr.Labels})
+		}
+		return nil, e
+	}
+
+	ctr := found[0]
+	resp, err := c.runtime.ContainerStatus(ctx, &runtime.ContainerStatusRequest{ContainerId: ctr.Id, Verbose: true})
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "status %s", ctr.Id)
+	}
+	t := &Target{
+		ID:      ctr.Id,
+		Running: resp.Status.GetState() == runtime.ContainerState_CONTAINER_RUNNING,
+		Labels:  ctr.Labels,
+		Sandbox: ctr.PodSandboxId,
+	}
+	if !t.Running {
+		return t, nil
+	}
+	var info criInfo
+	if err := json.Unmarshal([]byte(resp.Info["info"]), &info); err != nil {
+		return nil, newError(ErrContainerd, err, "status %s: info", ctr.Id)
+	}
+	t.Pid = info.Pid
+	if info.RuntimeSpec.Process != nil {
+		t.Env = info.RuntimeSpec.Process.Env
+	}
+	if root := info.RuntimeSpec.Root; root != nil {
+		t.ReadOnly = root.Readonly
+	}
+	// CRI-O gives the merged directory; containerd a path in the bundle
+	if root := info.RuntimeSpec.Root; root != nil && filepath.IsAbs(root.Path) {
+		t.Rootfs = root.Path
+	} else {
+		t.Rootfs = fmt.Sprintf("/proc/%d/root", t.Pid)
+	}
+	return t, nil
+}
+
+// sandboxConfig returns the configuration of the pod sandbox id, as far as
+// it can be recovered from its status, for creating containers in it.
+func (c *criClient) sandboxConfig(ctx context.Context, id string) (*runtime.PodSandboxConfig, error) {
+	resp, err := c.runtime.PodSandboxStatus(ctx, &runtime.PodSandboxStatusRequest{PodSandboxId: id})
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "sandbox %s", id)
+	}
+	s := resp.Status
+	sb := &runtime.PodSandboxConfig{
+		Metadata:    s.Metadata,
+		Labels:      s.Labels,
+		Annotations: s.Annotations,
+	}
+	if ns := s.GetLinux().GetNamespaces().GetOptions(); ns != nil {
+		sb.Linux = &runtime.LinuxPodSandboxConfig{
+			SecurityContext: &runtime.LinuxSandboxSecurityContext{NamespaceOptions: ns},
+		}
+	}
+	return sb, nil
+}
+
+// pull pulls image into the runtime unless policy says otherwise.
+func (c *criClient) pull(ctx context.Context, cfg Config, sandbox *runtime.PodSandboxConfig) error {
+	spec := &runtime.ImageSpec{Image: cfg.Image}
+	if cfg.PullPolicy != PullAlways {
+		resp, err := c.images.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: spec})
+		if err != nil {
+			return err
+		}
+		if resp.Image != nil {
+			return nil
+		}
+		if cfg.PullPolicy == PullNever {
+			return fmt.Errorf("%s is not present and pulling is disabled", cfg.Image)
+		}
+	}
+	req := &runtime.PullImageRequest{Image: spec, SandboxConfig: sandbox}
+	if cfg.Username != "" {
+		req.Auth = &runtime.AuthConfig{Username: cfg.Username, Password: cfg.Password}
+	}
+	_, err := c.images.PullImage(ctx, req)
+	return err
+}
+
+// Unsupported returns the options that need the containerd backend, and
+// those the CRI has no settings for: it leaves PIDs limits to the kubelet's
+// pod cgroup, and runtimes differ on what no masked paths mean.
+func (c *criClient) Unsupported(cfg Config) []string {
+	opts := unsupportedOptions(cfg)
+	if cfg.PidsLimit != 0 {
+		opts = append(opts, "pids limit")
+	}
+	if cfg.UnmaskProc {
+		opts = append(opts, "unmasked /proc")
+	}
+	return opts
+}
+
+func (c *criClient) Create(ctx context.Context, target *Target, cfg Config) (DebugContainer, error) {
+	if err := checkJoinable(target, cfg); err != nil {
+		return nil, err
+	}
+	if target.Sandbox == "" {
+		return nil, newError(ErrTargetNotFound, fmt.Errorf("no pod sandbox"), "target %s", target.ID)
+	}
+	sandbox, err := c.sandboxConfig(ctx, target.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+
+	pullCtx, cancel := withTimeout(ctx, cfg.PullTimeout)
+	err = c.pull(pullCtx, cfg, sandbox)
+	cancel()
+	if err != nil {
+		return nil, timedOut(pullCtx, newError(ErrPullFailed, err, "%s", cfg.Image), "getting the debug image",
+			cfg.PullTimeout, "check that the runtime can reach the registry")
+	}
+	cfg.event(Event{Type: EventImage, Target: target.ID, Image: cfg.Image})
+
+	config, err := criContainerConfig(cfg, target)
+	if err != nil {
+		return nil, err
+	}
+	startCtx, cancelStart := withTimeout(ctx, cfg.StartTimeout)
+	defer cancelStart()
+	created, err := c.runtime.CreateContainer(startCtx, &runtime.CreateContainerRequest{
+		PodSandboxId:  target.Sandbox,
+		Config:        config,
+		SandboxConfig: sandbox,
+	})
+	if err != nil {
+		return nil, criStartErr(startCtx, cfg, newError(ErrDebugFailed, err, "create"))
+	}
+	return &criDebug{c: c, id: created.ContainerId, cfg: cfg}, nil
+}
+
+// criStartErr explains err, from creating or starting the debug container
+// with startCtx, if that took too long.
+func criStartErr(startCtx context.Context, cfg Config, err error) error {
+	return timedOut(startCtx, err, "starting the debug container", cfg.StartTimeout,
+		"check that the runtime is responsive")
+}
+
+// criDebug is a debug container created through the CRI.
+type criDebug struct {
+	c   *criClient
+	id  string
+	cfg Config
+	// ws is the attached stream, if any
+	ws *websocket.Conn
+}
+
+// Start starts the debug container and then attaches to it: the CRI
+// attaches only to a running container, so output written before that is
+// not seen.
+func (d *criDebug) Start(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (<-chan Exit, error) {
+	startCtx, cancelStart := withTimeout(ctx, d.cfg.StartTimeout)
+	defer cancelStart()
+	_, err := d.c.runtime.StartContainer(startCtx, &runtime.StartContainerRequest{ContainerId: d.id})
+	if err != nil {
+		return nil, criStartErr(startCtx, d.cfg, newError(ErrDebugFailed, err, "start"))
+	}
+	d.ws, err = d.c.attach(ctx, d.id, d.cfg.TTY, stdin != nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.ws != nil && stdin != nil {
+		go io.Copy(&streamWriter{ws: d.ws, channel: streamStdin}, stdin)
+	}
+	exit := make(chan Exit, 1)
+	go func() {
+		if d.ws != nil {
+			err := demuxStream(d.ws, stdout, stderr)
+			if err != nil && ctx.Err() == nil {
+				exit <- Exit{Err: fmt.Errorf("stream: %v", err)}
+				return
+			}
+		}
+		code, err := d.c.wait(ctx, d.id)
+		exit <- Exit{Code: uint32(code), Time: time.Now(), Err: err}
+	}()
+	return exit, nil
+}
+
+// Pid returns 0: the CRI does not tell.
+func (d *criDebug) Pid() uint32 {
+	return 0
+}
+
+func (d *criDebug) Resize(ctx context.Context, w, h uint32) error {
+	if d.ws == nil {
+		return nil
+	}
+	return (&streamResizer{d.ws}).Resize(ctx, w, h)
+}
+
+// TargetExit returns nil: the target is not watched.
+func (d *criDebug) TargetExit() <-chan Exit {
+	return nil
+}
+
+func (d *criDebug) Kill(ctx context.Context) error {
+	_, err := d.c.runtime.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: d.id})
+	return err
+}
+
+// Reattach returns "": a session through the CRI is not detached from.
+func (d *criDebug) Reattach() string {
+	return ""
+}
+
+func (d *criDebug) Detach() {}
+
+func (d *criDebug) Remove(ctx context.Context) error {
+	if d.ws != nil {
+		d.ws.Close()
+	}
+	var errs cleanupErrors
+	if _, err := d.c.runtime.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: d.id}); err != nil {
+		errs = append(errs, newError(ErrCleanup, err, "stop dbg"))
+	}
+	if _, err := d.c.runtime.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: d.id}); err != nil {
+		errs = append(errs, newError(ErrCleanup, err, "remove dbg"))
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return &Error{Kind: ErrCleanup, Op: "cleanup", Err: errs}
+}
+
+// wait polls the status of container id until it exits, and returns its
+// exit code.
+func (c *criClient) wait(ctx context.Context, id string) (int32, error) {
+	for {
+		resp, err := c.runtime.ContainerStatus(ctx, &runtime.ContainerStatusRequest{ContainerId: id})
+		if err != nil {
+			return 0, err
+		}
+		if resp.Status.GetState() == runtime.ContainerState_CONTAINER_EXITED {
+			return resp.Status.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(criPollInterval):
+		}
+	}
+}
+
+// attach opens a stream to container id through the runtime's streaming
+// server, closed when ctx is done. A container that exited before it could
+// be attached to is not an error, but has no stream.
+func (c *criClient) attach(ctx context.Context, id string, tty, stdin bool) (*websocket.Conn, error) {
+	resp, err := c.runtime.Attach(ctx, &runtime.AttachRequest{
+		ContainerId: id,
+		Stdin:       stdin,
+		Tty:         tty,
+		Stdout:      true,
+		Stderr:      !tty,
+	})
+	if err != nil {
+		if s, serr := c.runtime.ContainerStatus(ctx, &runtime.ContainerStatusRequest{ContainerId: id}); serr == nil &&
+			s.Status.GetState() == runtime.ContainerState_CONTAINER_EXITED {
+			return nil, nil
+		}
+		return nil, newError(ErrDebugFailed, err, "attach")
+	}
+	ws, err := dialStream(resp.Url)
+	if err != nil {
+		return nil, newError(ErrDebugFailed, err, "attach %s", resp.Url)
+	}
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+	return ws, nil
+}
+
+// Channels of the Kubernetes streaming protocol, whose websocket messages
+// start with the channel they belong to.
+const (
+	streamStdin = iota
+	streamStdout
+	streamStderr
+	streamError
+	streamResize
+)
+
+// streamProtocol is the version of the streaming protocol spoken, the
+// first with resizing.
+const streamProtocol = "v4.channel.k8s.io"
+
+// dialStream opens a websocket to the streaming URL returned by the CRI.
+func dialStream(rawurl string) (*websocket.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	origin := u.String()
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{streamProtocol}
+	return websocket.DialConfig(config)
+}
+
+// demuxStream copies the stdout and stderr channels of ws to stdout and
+// stderr until the stream ends, returning the failure reported on its
+// error channel, if any.
+func demuxStream(ws *websocket.Conn, stdout, stderr io.Writer) error {
+	stdout, stderr = discardIfNil(stdout), discardIfNil(stderr)
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		var err error
+		switch msg[0] {
+		case streamStdout:
+			_, err = stdout.Write(msg[1:])
+		case streamStderr:
+			_, err = stderr.Write(msg[1:])
+		case streamError:
+			var status struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(msg[1:], &status) == nil && status.Status != "Success" {
+				err = fmt.Errorf("%s", status.Message)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// streamWriter writes to a channel of a stream.
+type streamWriter struct {
+	ws      *websocket.Conn
+	channel byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	msg := append([]byte{w.channel}, p...)
+	if err := websocket.Message.Send(w.ws, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// streamResizer resizes the TTY at the other end of a stream.
+type streamResizer struct {
+	ws *websocket.Conn
+}
+
+func (r *streamResizer) Resize(ctx context.Context, w, h uint32) error {
+	b, err := json.Marshal(struct{ Width, Height uint32 }{w, h})
+	if err != nil {
+		return err
+	}
+	_, err = (&streamWriter{ws: r.ws, channel: streamResize}).Write(b)
+	return err
+}
+
+// criContainerConfig returns the configuration of the debug container for
+// cfg against target.
+func criContainerConfig(cfg Config, target *Target) (*runtime.ContainerConfig, error) {
+	mounts := []*runtime.Mount{{
+		ContainerPath: TargetPath,
+		HostPath:      target.Rootfs,
+		Readonly:      target.rootReadOnly(cfg),
+	}}
+	for _, m := range cfg.Mounts {
+		if m.Type != "bind" {
+			return nil, newError(ErrInvalidConfig, fmt.Errorf("%s mounts are not supported by the cri backend", m.Type), "mount %s", m.Destination)
+		}
+		mounts = append(mounts, &runtime.Mount{
+			ContainerPath: m.Destination,
+			HostPath:      m.Source,
+			Readonly:      hasOption(m.Options, "ro"),
+		})
+	}
+
+	// the pod's net and ipc namespaces are the target's too; this CRI
+	// version cannot name the target's PID namespace, only the pod's,
+	// which is the target's if the pod shares its process namespace
+	ns := &runtime.NamespaceOption{
+		Network: runtime.NamespaceMode_POD,
+		Ipc:     runtime.NamespaceMode_POD,
+		Pid:     runtime.NamespaceMode_CONTAINER,
+	}
+	for _, n := range cfg.Namespaces {
+		switch n {
+		case specs.PIDNamespace:
+			ns.Pid = runtime.NamespaceMode_POD
+			cfg.printf("warning: the cri backend joins the pod's PID namespace, which has the target's processes only if the pod shares its process namespace\n")
+		case specs.NetworkNamespace, specs.IPCNamespace:
+		default:
+			cfg.printf("warning: the cri backend cannot join the target's %s namespace\n", n)
+		}
+	}
+	if cfg.Network == NetworkNone {
+		cfg.printf("warning: the cri backend always shares the pod's network namespace\n")
+	}
+	security := &runtime.LinuxContainerSecurityContext{
+		Privileged:       cfg.Privileged,
+		NamespaceOptions: ns,
+		Capabilities: &runtime.Capability{
+			AddCapabilities:  normalizeCapabilities(cfg.Capabilities),
+			DropCapabilities: normalizeCapabilities(cfg.DropCapabilities),
+		},
+	}
+	if cfg.Seccomp == SeccompUnconfined {
+		security.SeccompProfilePath = "unconfined"
+	}
+
+	user, err := target.debugUser(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if user != "" {
+		uid, gid, err := parseIDs(user)
+		if err != nil {
+			return nil, newError(ErrInvalidConfig, err, "user %s", user)
+		}
+		security.RunAsUser = &runtime.Int64Value{Value: uid}
+		if gid >= 0 {
+			security.RunAsGroup = &runtime.Int64Value{Value: gid}
+		}
+	}
+	workDir, err := target.debugWorkDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var envs []*runtime.KeyValue
+	for _, e := range target.debugEnv(cfg) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		envs = append(envs, &runtime.KeyValue{Key: kv[0], Value: kv[1]})
+	}
+	resources := &runtime.LinuxContainerResources{MemoryLimitInBytes: cfg.Memory}
+	if cfg.CPUs > 0 {
+		resources.CpuPeriod = 100000
+		resources.CpuQuota = int64(cfg.CPUs * 100000)
+	}
+	return &runtime.ContainerConfig{
+		Metadata:   &runtime.ContainerMetadata{Name: cfg.ID},
+		Image:      &runtime.ImageSpec{Image: cfg.Image},
+		Command:    cfg.Command,
+		WorkingDir: workDir,
+		Envs:       envs,
+		Mounts:     mounts,
+		Labels:     map[string]string{targetLabel: target.ID},
+		Stdin:      cfg.Stdin != nil,
+		StdinOnce:  true,
+		Tty:        cfg.TTY,
+		Linux: &runtime.LinuxContainerConfig{
+			Resources:       resources,
+			SecurityContext: security,
+		},
+	}, nil
+}
+
+// parseIDs parses a numeric uid[:gid]; gid is -1 if not given.
+func parseIDs(user string) (uid, gid int64, err error) {
+	parts := strings.SplitN(user, ":", 2)
+	uid, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return uid, -1, nil
+	}
+	gid, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,276 @@
+package cdbg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+)
+
+// DetachKeys is the default key sequence, ctrl-p ctrl-q, that detaches
+// from a session in TTY mode and leaves it running.
+var DetachKeys = []byte{0x10, 0x11}
+
+// ParseDetachKeys parses a key sequence in the format of docker's
+// --detach-keys: comma-separated keys, each a single character or ctrl-x
+// for x one of a-z, @, [, \, ], ^ or _.
+func ParseDetachKeys(s string) ([]byte, error) {
+	var keys []byte
+	for _, key := range strings.Split(s, ",") {
+		if len(key) == 1 {
+			keys = append(keys, key[0])
+			continue
+		}
+		lower := strings.ToLower(key)
+		if len(key) != len("ctrl-x") || !strings.HasPrefix(lower, "ctrl-") {
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+		c := lower[len("ctrl-")]
+		switch {
+		case c >= 'a' && c <= 'z':
+			keys = append(keys, c-'a'+1)
+		case strings.IndexByte("@[\\]^_", c) >= 0:
+			// ctrl-@ is NUL, and the rest follow ctrl-z
+			keys = append(keys, c-'@')
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+	return keys, nil
+}
+
+func (cfg *Config) detachKeys() []byte {
+	if cfg.DetachKeys == nil {
+		return DetachKeys
+	}
+	return cfg.DetachKeys
+}
+
+// Labels recording on the debug container what a detached session leaves
+// for Attach to clean up.
+const (
+	workspaceLabel   = "cdbg.workspace"
+	tempLabel        = "cdbg.workspace.temp"
+	snapshotterLabel = "cdbg.snapshotter"
+	snapshotLabel    = "cdbg.snapshot"
+	// platformLabel is the Config.Platform of the debug image, for Commit
+	platformLabel = "cdbg.platform"
+)
+
+// detachReader passes input through until it sees keys, then closes
+// detach and blocks until the debug process exits: ending the input any
+// sooner would hang it up.
+type detachReader struct {
+	r       io.Reader
+	keys    []byte
+	held    []byte
+	pending []byte
+	err     error
+	detach  chan struct{}
+	done    chan struct{}
+}
+
+func newDetachReader(r io.Reader, keys []byte) *detachReader {
+	return &detachReader{r: r, keys: keys, detach: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 && d.err == nil {
+		buf := make([]byte, len(p))
+		n, err := d.r.Read(buf)
+		for _, b := range buf[:n] {
+			if d.match(b) {
+				<-d.done
+				return 0, io.EOF
+			}
+		}
+		d.err = err
+	}
+	if len(d.pending) == 0 {
+		return 0, d.err
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// match holds back b while it continues the detach keys, and releases what
+// was held once it does not. It reports whether b completes the keys.
+func (d *detachReader) match(b byte) bool {
+	d.held = append(d.held, b)
+	if bytes.HasPrefix(d.keys, d.held) {
+		if len(d.held) == len(d.keys) {
+			close(d.detach)
+			return true
+		}
+		return false
+	}
+	d.pending = append(d.pending, d.held[:len(d.held)-1]...)
+	d.held = d.held[:0]
+	// b may yet start the sequence afresh
+	if len(d.keys) > 0 && b == d.keys[0] {
+		d.held = append(d.held, b)
+		return false
+	}
+	d.pending = append(d.pending, b)
+	return false
+}
+
+// release ends the input of a detached session once exit, the debug
+// process's exit channel, delivers, and with it the copy of the input.
+func (d *detachReader) release(exit <-chan containerd.ExitStatus) {
+	go func() {
+		<-exit
+		d.end()
+	}()
+}
+
+// end ends the input of a detached session at once, for when it no longer
+// reaches the debug process.
+func (d *detachReader) end() {
+	close(d.done)
+}
+
+// formatDetachKeys formats keys as ParseDetachKeys parses them, for
+// docker's --detach-keys.
+func formatDetachKeys(keys []byte) string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		if k < ' ' {
+			s[i] = "ctrl-" + strings.ToLower(string(rune(k+'@')))
+		} else {
+			s[i] = string(rune(k))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// sessionLabels mark the debug container of target for ListSessions and
+// record what to clean up after a detached session.
+func sessionLabels(cfg Config, target string, ws Workspace, tempWorkspace bool, snapshot string) map[string]string {
+	labels := map[string]string{
+		targetLabel:      target,
+		workspaceLabel:   ws.Dir,
+		tempLabel:        strconv.FormatBool(tempWorkspace),
+		snapshotterLabel: cfg.snapshotter(),
+		snapshotLabel:    snapshot,
+	}
+	if cfg.Platform != "" {
+		labels[platformLabel] = cfg.Platform
+	}
+	return labels
+}
+
+// Attach reconnects cfg's stdio to the running debug session id, waits for
+// it to end and removes what it leaves behind. It returns the exit code of
+// the debug process.
+func Attach(ctx context.Context, client *containerd.Client, id string, cfg Config) (int, error) {
+	c, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		return 0, newError(ErrTargetNotFound, err, "session %s", id)
+	}
+	stdin := cfg.Stdin
+	var (
+		d      *detachReader
+		detach chan struct{}
+	)
+	if cfg.TTY && stdin != nil {
+		d = newDetachReader(stdin, cfg.detachKeys())
+		stdin, detach = d, d.detach
+	}
+	t, err := c.Task(ctx, cio.NewAttach(withStreams(stdin, cfg.Stdout, cfg.Stderr)))
+	if err != nil {
+		return 0, newError(ErrDebugFailed, err, "session %s", id)
+	}
+	if cfg.Started != nil {
+		cfg.Started(t)
+	}
+	if cfg.TTY && cfg.Console != nil {
+		defer cfg.Console.Reset()
+		if err := cfg.Console.SetRaw(); err != nil {
+			return 0, newError(ErrDebugFailed, err, "console")
+		}
+		if err := HandleConsoleResize(ctx, t, cfg.Console); err != nil {
+			return 0, newError(ErrDebugFailed, err, "resize")
+		}
+	}
+	exit, err := t.Wait(ctx)
+	if err != nil {
+		return 0, newError(ErrDebugFailed, err, "wait")
+	}
+	select {
+	case status := <-exit:
+		if err := cleanupSession(cleanupContext(ctx), client, c); err != nil {
+			return 0, err
+		}
+		return int(status.ExitCode()), nil
+	case <-detach:
+		d.release(exit)
+		cfg.printf("\r\ndetached from %s\r\n", id)
+		return 0, nil
+	}
+}
+
+// cleanupSession removes the task, container, mounts, snapshot and
+// workspace of a session that ended while detached. It goes on past steps
+// that fail, and reports them all.
+func cleanupSession(ctx context.Context, client *containerd.Client, c containerd.Container) error {
+	labels, err := c.Labels(ctx)
+	if err != nil {
+		return newError(ErrCleanup, err, "labels")
+	}
+	ws := Workspace{Dir: labels[workspaceLabel]}
+
+	// pushed in the order Debug took the steps, to be undone last first
+	var cleanup cleanupStack
+	if ws.Dir != "" && labels[tempLabel] == "true" {
+		cleanup.pushIfClean(func(ctx context.Context) error {
+			if err := removeWorkspace(ws.Dir); err != nil {
+				return newError(ErrCleanup, err, "remove: %s", ws.Dir)
+			}
+			return nil
+		})
+	}
+	if key := labels[snapshotLabel]; key != "" {
+		cleanup.push(func(ctx context.Context) error {
+			ss := client.SnapshotService(labels[snapshotterLabel])
+			if err := ss.Remove(ctx, key); err != nil && !errdefs.IsNotFound(err) {
+				return newError(ErrCleanup, err, "remove")
+			}
+			return nil
+		})
+	}
+	if ws.Dir != "" {
+		// loop device and stopped target mounts, the overlay and debug
+		// root, and the tmpfs of a host process session, if any
+		cleanup.push(func(ctx context.Context) error {
+			return unmountUnder(ws.Dir)
+		})
+	}
+	cleanup.push(func(ctx context.Context) error {
+		if err := c.Delete(ctx); err != nil {
+			return newError(ErrCleanup, err, "delete dbg")
+		}
+		return nil
+	})
+	cleanup.push(func(ctx context.Context) error {
+		t, err := c.Task(ctx, nil)
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		if err == nil {
+			_, err = t.Delete(ctx, containerd.WithProcessKill)
+		}
+		if err != nil {
+			return newError(ErrCleanup, err, "delete task")
+		}
+		return nil
+	})
+	return cleanup.run(ctx)
+}
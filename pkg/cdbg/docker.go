@@ -0,0 +1,512 @@
+package cdbg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// DockerAddress is the socket of the Docker Engine API.
+const DockerAddress = "/var/run/docker.sock"
+
+// dockerAPIVersion is the oldest Engine API with everything used here
+// (Docker 1.13).
+const dockerAPIVersion = "v1.25"
+
+// dockerClient talks to the Docker Engine API, or an API compatible with
+// it, over a unix socket.
+type dockerClient struct {
+	socket string
+	prefix string
+	http   *http.Client
+	// daemon and cli name the service and its command in messages
+	daemon, cli string
+}
+
+func newDockerClient(address string) *dockerClient {
+	socket := strings.TrimPrefix(address, "unix://")
+	d := &dockerClient{socket: socket, prefix: "/" + dockerAPIVersion, daemon: "dockerd", cli: "docker"}
+	d.http = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.dial(ctx)
+		},
+	}}
+	return d
+}
+
+func (d *dockerClient) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", d.socket)
+}
+
+// dockerError is a failed API request, with the message of its body.
+type dockerError struct {
+	Status  int    `json:"-"`
+	Message string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Status)
+}
+
+// isDockerNotFound reports whether err is an API error of status 404.
+func isDockerNotFound(err error) bool {
+	e, ok := err.(*dockerError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// readDockerError reads the error of a failed request from resp.
+func readDockerError(resp *http.Response) error {
+	e := &dockerError{Status: resp.StatusCode}
+	json.NewDecoder(resp.Body).Decode(e)
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	return e
+}
+
+// do sends a request with body, if not nil, as JSON, and decodes the
+// response into v, if not nil. A failed request returns a *dockerError.
+func (d *dockerClient) do(ctx context.Context, method, path string, query url.Values, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := "http://docker" + d.prefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).Debugf("docker %s %s", method, path)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return readDockerError(resp)
+	}
+	if v == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// hijack sends a request that turns the connection into a raw stream, as
+// attaching does, and returns it.
+func (d *dockerClient) hijack(ctx context.Context, path string, query url.Values) (net.Conn, *bufio.Reader, error) {
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest("POST", "http://docker"+d.prefix+path+"?"+query.Encode(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err := readDockerError(resp)
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, br, nil
+}
+
+// dockerContainer is what cdbg reads of an inspected container.
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	Name  string
+	State struct {
+		Running bool
+		Pid     int
+	}
+	GraphDriver struct {
+		Name string
+		Data map[string]string
+	}
+	Config struct {
+		Env        []string
+		WorkingDir string
+		Labels     map[string]string
+	}
+	HostConfig struct {
+		ReadonlyRootfs bool
+	}
+}
+
+// target returns c as a Target. Its root filesystem is the merged
+// directory of an overlay graph driver, or else its process's root.
+func (c *dockerContainer) target() *Target {
+	t := &Target{
+		ID:       c.ID,
+		Running:  c.State.Running,
+		Pid:      uint32(c.State.Pid),
+		Rootfs:   c.GraphDriver.Data["MergedDir"],
+		ReadOnly: c.HostConfig.ReadonlyRootfs,
+		Env:      c.Config.Env,
+		Labels:   c.Config.Labels,
+	}
+	if t.Rootfs == "" {
+		t.Rootfs = fmt.Sprintf("/proc/%d/root", t.Pid)
+	}
+	return t
+}
+
+// pull pulls image unless policy says otherwise.
+func (d *dockerClient) pull(ctx context.Context, image, policy string) error {
+	if policy != PullAlways {
+		err := d.do(ctx, "GET", "/images/"+image+"/json", nil, nil, nil)
+		if err == nil {
+			return nil
+		}
+		if !isDockerNotFound(err) {
+			return err
+		}
+		if policy == PullNever {
+			return fmt.Errorf("%s is not present and pulling is disabled", image)
+		}
+	}
+	req, err := http.NewRequest("POST", "http://docker"+d.prefix+"/images/create?"+url.Values{"fromImage": {image}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return readDockerError(resp)
+	}
+	// the progress stream reports failures in-band
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+	}
+}
+
+// NewDockerBackend returns the Backend for hosts where only the Docker
+// Engine API is available, at address (DockerAddress if empty). Targets
+// are inspected with Docker, and dockerd runs the debug image in the
+// target's pid, net and ipc namespaces.
+func NewDockerBackend(address string) Backend {
+	if address == "" {
+		address = DockerAddress
+	}
+	return newDockerClient(address)
+}
+
+func (d *dockerClient) Target(ctx context.Context, query string) (*Target, error) {
+	var c dockerContainer
+	err := d.do(ctx, "GET", "/containers/"+query+"/json", nil, nil, &c)
+	if isDockerNotFound(err) {
+		return nil, newError(ErrTargetNotFound, err, "%s", query)
+	}
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "inspect %s", query)
+	}
+	return c.target(), nil
+}
+
+// Unsupported returns the options that need the containerd backend.
+func (d *dockerClient) Unsupported(cfg Config) []string {
+	return unsupportedOptions(cfg)
+}
+
+func (d *dockerClient) Create(ctx context.Context, target *Target, cfg Config) (DebugContainer, error) {
+	if err := checkJoinable(target, cfg); err != nil {
+		return nil, err
+	}
+	pullCtx, cancel := withTimeout(ctx, cfg.PullTimeout)
+	err := d.pull(pullCtx, cfg.Image, cfg.PullPolicy)
+	cancel()
+	if err != nil {
+		return nil, timedOut(pullCtx, newError(ErrPullFailed, err, "%s", cfg.Image), "getting the debug image",
+			cfg.PullTimeout, "check that "+d.daemon+" can reach the registry")
+	}
+	cfg.event(Event{Type: EventImage, Target: target.ID, Image: cfg.Image})
+
+	create, err := dockerCreateRequest(cfg, target)
+	if err != nil {
+		return nil, err
+	}
+	startCtx, cancelStart := withTimeout(ctx, cfg.StartTimeout)
+	defer cancelStart()
+	var created struct {
+		ID       string `json:"Id"`
+		Warnings []string
+	}
+	err = d.do(startCtx, "POST", "/containers/create", url.Values{"name": {cfg.ID}}, create, &created)
+	if e, ok := err.(*dockerError); ok && e.Status == http.StatusConflict {
+		return nil, newError(ErrSessionInUse, err, "session %s", cfg.ID)
+	}
+	if err != nil {
+		return nil, d.startErr(startCtx, cfg, newError(ErrDebugFailed, err, "create"))
+	}
+	for _, w := range created.Warnings {
+		cfg.printf("warning: %s\n", w)
+	}
+	return &dockerDebug{d: d, id: created.ID, cfg: cfg}, nil
+}
+
+// startErr explains err, from creating or starting the debug container
+// with startCtx, if that took too long.
+func (d *dockerClient) startErr(startCtx context.Context, cfg Config, err error) error {
+	return timedOut(startCtx, err, "starting the debug container", cfg.StartTimeout,
+		"check that "+d.daemon+" is responsive")
+}
+
+// dockerDebug is a debug container created through the Docker Engine API.
+type dockerDebug struct {
+	d    *dockerClient
+	id   string
+	cfg  Config
+	conn net.Conn
+}
+
+// Start attaches to the debug container before it starts, so no output is
+// missed, with detach keys that the session catches before they reach the
+// daemon.
+func (c *dockerDebug) Start(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (<-chan Exit, error) {
+	d, cfg := c.d, c.cfg
+	startCtx, cancelStart := withTimeout(ctx, cfg.StartTimeout)
+	defer cancelStart()
+	conn, out, err := d.hijack(startCtx, "/containers/"+c.id+"/attach", url.Values{
+		"stream": {"1"}, "stdin": {"1"}, "stdout": {"1"}, "stderr": {"1"},
+		"detachKeys": {formatDetachKeys(cfg.detachKeys())},
+	})
+	if err != nil {
+		return nil, d.startErr(startCtx, cfg, newError(ErrDebugFailed, err, "attach"))
+	}
+	c.conn = conn
+	go func() {
+		if cfg.TTY {
+			io.Copy(discardIfNil(stdout), out)
+			return
+		}
+		demuxDocker(out, stdout, stderr)
+	}()
+	if stdin != nil {
+		go func() {
+			io.Copy(conn, stdin)
+			if uc, ok := conn.(*net.UnixConn); ok {
+				// at EOF, as docker run -i does
+				uc.CloseWrite()
+			}
+		}()
+	}
+
+	// wait is registered before start so a quick exit is not missed
+	exit := make(chan Exit, 1)
+	go func() {
+		var status struct{ StatusCode int }
+		err := d.do(ctx, "POST", "/containers/"+c.id+"/wait", nil, nil, &status)
+		exit <- Exit{Code: uint32(status.StatusCode), Time: time.Now(), Err: err}
+	}()
+	err = d.do(startCtx, "POST", "/containers/"+c.id+"/start", nil, nil, nil)
+	if err != nil {
+		return nil, d.startErr(startCtx, cfg, newError(ErrDebugFailed, err, "start"))
+	}
+	return exit, nil
+}
+
+// Pid returns 0: the debug container is not inspected for it.
+func (c *dockerDebug) Pid() uint32 {
+	return 0
+}
+
+func (c *dockerDebug) Resize(ctx context.Context, w, h uint32) error {
+	return c.d.do(ctx, "POST", "/containers/"+c.id+"/resize", url.Values{
+		"w": {fmt.Sprint(w)}, "h": {fmt.Sprint(h)},
+	}, nil, nil)
+}
+
+// TargetExit returns nil: the target is not watched.
+func (c *dockerDebug) TargetExit() <-chan Exit {
+	return nil
+}
+
+func (c *dockerDebug) Kill(ctx context.Context) error {
+	return c.d.do(ctx, "POST", "/containers/"+c.id+"/kill", nil, nil, nil)
+}
+
+func (c *dockerDebug) Reattach() string {
+	return c.d.cli + " attach " + c.cfg.ID
+}
+
+// Detach closes the connection attached to the debug container, which
+// leaves its stdin open in TTY mode.
+func (c *dockerDebug) Detach() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *dockerDebug) Remove(ctx context.Context) error {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	err := c.d.do(ctx, "DELETE", "/containers/"+c.id, url.Values{"force": {"1"}}, nil, nil)
+	if err != nil {
+		return newError(ErrCleanup, err, "delete dbg")
+	}
+	return nil
+}
+
+// demuxDocker copies the multiplexed output of a container without a TTY
+// to stdout and stderr: frames of a stream byte, three zero bytes, a
+// big-endian length and the data.
+func demuxDocker(r io.Reader, stdout, stderr io.Writer) error {
+	stdout, stderr = discardIfNil(stdout), discardIfNil(stderr)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
+
+// dockerCreateRequest returns the body of the request that creates the
+// debug container for cfg against target.
+func dockerCreateRequest(cfg Config, target *Target) (map[string]interface{}, error) {
+	mode := "rw"
+	if target.rootReadOnly(cfg) {
+		mode = "ro"
+	}
+	binds := []string{target.Rootfs + ":" + TargetPath + ":" + mode}
+	tmpfs := map[string]string{}
+	for _, m := range cfg.Mounts {
+		switch m.Type {
+		case "bind":
+			bind := m.Source + ":" + m.Destination
+			if hasOption(m.Options, "ro") {
+				bind += ":ro"
+			}
+			binds = append(binds, bind)
+		case "tmpfs":
+			tmpfs[m.Destination] = strings.Join(m.Options, ",")
+		default:
+			return nil, newError(ErrInvalidConfig, fmt.Errorf("%s mounts are not supported by the docker backend", m.Type), "mount %s", m.Destination)
+		}
+	}
+
+	join := "container:" + target.ID
+	host := map[string]interface{}{
+		"Binds":      binds,
+		"Tmpfs":      tmpfs,
+		"CapAdd":     normalizeCapabilities(cfg.Capabilities),
+		"CapDrop":    normalizeCapabilities(cfg.DropCapabilities),
+		"Privileged": cfg.Privileged,
+		"Memory":     cfg.Memory,
+		"NanoCpus":   int64(cfg.CPUs * 1e9),
+		"PidsLimit":  cfg.PidsLimit,
+	}
+	if cfg.UnmaskProc {
+		// empty rather than null, which is the defaults
+		host["MaskedPaths"] = []string{}
+		host["ReadonlyPaths"] = []string{}
+	}
+	switch {
+	case hasNamespace(cfg.Namespaces, specs.NetworkNamespace):
+		host["NetworkMode"] = join
+	case cfg.Network == NetworkNone:
+		host["NetworkMode"] = "none"
+	default:
+		host["NetworkMode"] = "host"
+	}
+	for _, ns := range cfg.Namespaces {
+		switch ns {
+		case specs.PIDNamespace:
+			host["PidMode"] = join
+		case specs.IPCNamespace:
+			host["IpcMode"] = join
+		case specs.NetworkNamespace:
+		default:
+			// Docker joins no other namespace of another container
+			cfg.printf("warning: the docker backend cannot join the target's %s namespace\n", ns)
+		}
+	}
+	if cfg.Seccomp == SeccompUnconfined {
+		host["SecurityOpt"] = []string{"seccomp=unconfined"}
+	}
+
+	user, err := target.debugUser(cfg)
+	if err != nil {
+		return nil, err
+	}
+	workDir, err := target.debugWorkDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"Image":        cfg.Image,
+		"Cmd":          cfg.Command,
+		"Env":          target.debugEnv(cfg),
+		"User":         user,
+		"WorkingDir":   workDir,
+		"Tty":          cfg.TTY,
+		"OpenStdin":    cfg.Stdin != nil,
+		"StdinOnce":    true,
+		"AttachStdin":  cfg.Stdin != nil,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Labels":       map[string]string{targetLabel: target.ID},
+		"HostConfig":   host,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package cdbg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of session failure. Errors returned by this package are *Error
+// values (or *AmbiguousError) whose kind can be found with KindOf.
+var (
+	ErrInvalidConfig      = errors.New("invalid configuration")
+	ErrContainerd         = errors.New("containerd request failed")
+	ErrTargetNotFound     = errors.New("target container not found")
+	ErrAmbiguousTarget    = errors.New("target container is ambiguous")
+	ErrTargetNotRunning   = errors.New("target container is not running")
+	ErrPermission         = errors.New("insufficient privileges")
+	ErrPullFailed         = errors.New("debug image unavailable")
+	ErrDigestMismatch     = errors.New("debug image digest mismatch")
+	ErrMountFailed        = errors.New("mount failed")
+	ErrOverlayUnsupported = errors.New("overlay filesystem unsupported")
+	ErrDebugFailed        = errors.New("debug container failed")
+	ErrCleanup            = errors.New("cleanup failed")
+	ErrSessionInUse       = errors.New("session ID already in use")
+)
+
+// Error is a failure of one step of a debug session. Kind is one of the Err
+// values of this package and Err is the underlying cause.
+type Error struct {
+	Kind error
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Op == "" {
+		return e.Err.Error()
+	}
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of e, so errors.Is(err, ErrPullFailed)
+// works on Go versions that have it.
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// Is reports that an ambiguous query is of kind ErrAmbiguousTarget.
+func (e *AmbiguousError) Is(target error) bool { return target == ErrAmbiguousTarget }
+
+// KindOf returns the kind of err, or nil if it did not come from this
+// package.
+func KindOf(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	case *AmbiguousError:
+		return ErrAmbiguousTarget
+	}
+	return nil
+}
+
+// newError wraps cause as an *Error of kind, described by format and args.
+func newError(kind, cause error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Op: fmt.Sprintf(format, args...), Err: cause}
+}
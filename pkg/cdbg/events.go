@@ -0,0 +1,65 @@
+package cdbg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Types of Event, in the order a session goes through them.
+const (
+	EventImage        = "image"
+	EventSnapshot     = "snapshot"
+	EventStarted      = "started"
+	EventTargetExited = "target-exited"
+	EventDetached     = "detached"
+	EventExited       = "exited"
+	// EventMessage carries a status message or warning
+	EventMessage = "message"
+	// EventError is reported by the cdbg command when it fails
+	EventError = "error"
+)
+
+// Event is a step of a debug session, reported to Config.Events for tools
+// that drive cdbg. Fields that do not apply to its Type are left empty.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	// Image and Digest are the debug image's, for EventImage
+	Image  string `json:"image,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// Snapshot is the key of the session's snapshot of the debug image,
+	// and Mounts its mounts, for EventSnapshot
+	Snapshot string   `json:"snapshot,omitempty"`
+	Mounts   []string `json:"mounts,omitempty"`
+	// Pid is the host PID of the debug process, for EventStarted
+	Pid uint32 `json:"pid,omitempty"`
+	// ExitCode is that of the target for EventTargetExited, and of the
+	// debug process for EventExited
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// event reports e, stamped with the time and the session, to cfg.Events.
+func (cfg *Config) event(e Event) {
+	if cfg.Events == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Session = cfg.ID
+	cfg.Events(e)
+}
+
+// exitEvent is an event of type typ for a process exiting with code.
+func exitEvent(typ, target string, code uint32) Event {
+	c := int(code)
+	return Event{Type: typ, Target: target, ExitCode: &c}
+}
+
+// message is printf for Events: the message without the line breaks meant
+// for a raw console.
+func (cfg *Config) message(format string, args ...interface{}) {
+	cfg.event(Event{Type: EventMessage, Message: strings.TrimSpace(fmt.Sprintf(format, args...))})
+}
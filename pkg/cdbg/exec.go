@@ -0,0 +1,77 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+)
+
+// Exec runs args as another process of the running debug session id, with
+// the session's environment, user and capabilities, connected to cfg's
+// stdio. It returns the exit code of the process.
+func Exec(ctx context.Context, client *containerd.Client, id string, args []string, cfg Config) (int, error) {
+	c, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		return 0, newError(ErrTargetNotFound, err, "session %s", id)
+	}
+	spec, err := c.Spec(ctx)
+	if err != nil {
+		return 0, newError(ErrContainerd, err, "session %s", id)
+	}
+	t, err := c.Task(ctx, nil)
+	if err != nil {
+		return 0, newError(ErrTargetNotRunning, err, "session %s", id)
+	}
+
+	pspec := *spec.Process
+	pspec.Args = args
+	pspec.Terminal = cfg.TTY
+	if len(cfg.Env) > 0 {
+		pspec.Env = append(append([]string(nil), pspec.Env...), cfg.Env...)
+	}
+	var stdin *stdinCloser
+	if !cfg.TTY && cfg.Stdin != nil {
+		stdin = newStdinCloser(cfg.Stdin)
+		cfg.Stdin = stdin
+	}
+	opt := []cio.Opt{withStreams(cfg.Stdin, cfg.Stdout, cfg.Stderr)}
+	if cfg.TTY {
+		opt = []cio.Opt{cio.WithTerminal, withStreams(cfg.Stdin, cfg.Stdout, nil)}
+	}
+	execID := fmt.Sprintf("exec-%d", time.Now().UnixNano())
+	p, err := t.Exec(ctx, execID, &pspec, cio.NewCreator(opt...))
+	if err != nil {
+		return 0, newError(ErrDebugFailed, err, "exec")
+	}
+	defer p.Delete(cleanupContext(ctx), containerd.WithProcessKill)
+	if stdin != nil {
+		stdin.setProcess(cleanupContext(ctx), p)
+	}
+
+	if cfg.TTY && cfg.Console != nil {
+		defer cfg.Console.Reset()
+		if err := cfg.Console.SetRaw(); err != nil {
+			return 0, newError(ErrDebugFailed, err, "console")
+		}
+	}
+	exit, err := p.Wait(ctx)
+	if err != nil {
+		return 0, newError(ErrDebugFailed, err, "wait")
+	}
+	if err := p.Start(ctx); err != nil {
+		return 0, newError(ErrDebugFailed, err, "start")
+	}
+	if cfg.Started != nil {
+		cfg.Started(p)
+	}
+	if cfg.TTY && cfg.Console != nil {
+		if err := HandleConsoleResize(ctx, p, cfg.Console); err != nil {
+			return 0, newError(ErrDebugFailed, err, "resize")
+		}
+	}
+	status := <-exit
+	return int(status.ExitCode()), nil
+}
@@ -0,0 +1,107 @@
+package cdbg
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// whiteoutPrefix and whiteoutOpaque mark deletions in an OCI layer tarball.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// ExportDiff writes the changes kept in the overlay upperdir upper to path
+// as a tarball in the OCI layer format, turning overlay whiteouts and
+// opaque directories into their .wh. entries.
+func ExportDiff(upper, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeDiff(f, upper); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeDiff(w io.Writer, upper string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(upper, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		// overlay records a deleted file as a 0/0 character device
+		if fi.Mode()&os.ModeCharDevice != 0 {
+			if st, ok := fi.Sys().(*unix.Stat_t); ok && st.Rdev == 0 {
+				dir, base := filepath.Split(name)
+				return tw.WriteHeader(&tar.Header{
+					Name:     dir + whiteoutPrefix + base,
+					Typeflag: tar.TypeReg,
+					Mode:     0600,
+				})
+			}
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// an opaque directory hides everything below it in the lower layers
+			if isOpaque(path) {
+				return tw.WriteHeader(&tar.Header{
+					Name:     name + "/" + whiteoutOpaque,
+					Typeflag: tar.TypeReg,
+					Mode:     0600,
+				})
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, "trusted.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
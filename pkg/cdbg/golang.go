@@ -0,0 +1,39 @@
+package cdbg
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// GoProcesses returns the processes running Go programs in the PID
+// namespace of pid, as Processes does.
+func GoProcesses(pid uint32, filter string) ([]Process, error) {
+	procs, err := Processes(pid, filter)
+	if err != nil {
+		return nil, err
+	}
+	var gos []Process
+	for _, p := range procs {
+		if isGoBinary(fmt.Sprintf("/proc/%d/exe", p.Pid)) {
+			gos = append(gos, p)
+		}
+	}
+	return gos, nil
+}
+
+// isGoBinary reports whether the executable at path was built by the Go
+// toolchain, which leaves its build ID note and line table in every
+// binary, stripped or not.
+func isGoBinary(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for _, name := range []string{".note.go.buildid", ".go.buildinfo", ".gopclntab"} {
+		if f.Section(name) != nil {
+			return true
+		}
+	}
+	return false
+}
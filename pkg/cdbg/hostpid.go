@@ -0,0 +1,248 @@
+package cdbg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/api/types"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/oci"
+	prototypes "github.com/gogo/protobuf/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// hostProcess is a process on the host posing as a target container, for
+// processes started by runtimes containerd doesn't know about. What Debug
+// does not use fails with errdefs.ErrNotImplemented.
+type hostProcess struct {
+	pid uint32
+	id  string
+}
+
+// HostTarget is the target ID of the node itself, see Host.
+const HostTarget = "host"
+
+// Host returns the node itself as a target for Debug: its init process,
+// whose namespaces are the host's and whose root is /. The debug image is
+// overlaid on the host's root filesystem, which stays read-only beneath.
+func Host() containerd.Container {
+	return &hostProcess{pid: 1, id: HostTarget}
+}
+
+// HostProcess returns host process pid as a target for Debug. The session
+// joins its namespaces and overlays its root, /proc/<pid>/root.
+func HostProcess(pid uint32) (containerd.Container, error) {
+	if pid == 0 {
+		return nil, newError(ErrInvalidConfig, fmt.Errorf("no pid"), "host process")
+	}
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, newError(ErrTargetNotFound, err, "host process %d", pid)
+		}
+		return nil, newError(ErrPermission, err, "host process %d", pid)
+	}
+	return &hostProcess{pid: pid}, nil
+}
+
+func (h *hostProcess) ID() string {
+	if h.id != "" {
+		return h.id
+	}
+	return fmt.Sprintf("pid-%d", h.pid)
+}
+
+// Info leaves the runtime and snapshotter empty, for containerd's defaults.
+func (h *hostProcess) Info(ctx context.Context) (containers.Container, error) {
+	return containers.Container{ID: h.ID(), Labels: map[string]string{}}, nil
+}
+
+func (h *hostProcess) Labels(ctx context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// Spec describes the process as far as /proc tells: its root, arguments,
+// environment and working directory. It leaves out the process's cgroup,
+// most likely that of a whole host service, which is not the session's
+// to join or to have the runtime remove.
+func (h *hostProcess) Spec(ctx context.Context) (*oci.Spec, error) {
+	proc := fmt.Sprintf("/proc/%d", h.pid)
+	spec := &oci.Spec{
+		Root:    &specs.Root{Path: proc + "/root"},
+		Process: &specs.Process{},
+	}
+	if b, err := ioutil.ReadFile(proc + "/cmdline"); err == nil {
+		spec.Process.Args = splitNul(b)
+	}
+	// environ and cwd are only readable with ptrace access; go without
+	if b, err := ioutil.ReadFile(proc + "/environ"); err == nil {
+		spec.Process.Env = splitNul(b)
+	}
+	if cwd, err := os.Readlink(proc + "/cwd"); err == nil {
+		spec.Process.Cwd = cwd
+	}
+	return spec, nil
+}
+
+func (h *hostProcess) Task(ctx context.Context, attach cio.Attach) (containerd.Task, error) {
+	return &hostTask{pid: h.pid}, nil
+}
+
+func (h *hostProcess) Delete(ctx context.Context, opts ...containerd.DeleteOpts) error {
+	return errHostProcess("delete")
+}
+
+func (h *hostProcess) NewTask(ctx context.Context, ioCreate cio.Creator, opts ...containerd.NewTaskOpts) (containerd.Task, error) {
+	return nil, errHostProcess("new task")
+}
+
+func (h *hostProcess) Image(ctx context.Context) (containerd.Image, error) {
+	return nil, errHostProcess("image")
+}
+
+func (h *hostProcess) SetLabels(ctx context.Context, labels map[string]string) (map[string]string, error) {
+	return nil, errHostProcess("set labels")
+}
+
+func (h *hostProcess) Extensions(ctx context.Context) (map[string]prototypes.Any, error) {
+	return map[string]prototypes.Any{}, nil
+}
+
+func (h *hostProcess) Update(ctx context.Context, opts ...containerd.UpdateContainerOpts) error {
+	return errHostProcess("update")
+}
+
+// hostTask is the running "task" of a hostProcess. What Debug does not
+// use fails with errdefs.ErrNotImplemented, as for hostProcess.
+type hostTask struct {
+	pid uint32
+}
+
+var (
+	_ containerd.Container = &hostProcess{}
+	_ containerd.Task      = &hostTask{}
+)
+
+func (t *hostTask) ID() string {
+	return fmt.Sprintf("pid-%d", t.pid)
+}
+
+func (t *hostTask) Pid() uint32 {
+	return t.pid
+}
+
+func (t *hostTask) Status(ctx context.Context) (containerd.Status, error) {
+	if !t.alive() {
+		return containerd.Status{Status: containerd.Stopped}, nil
+	}
+	return containerd.Status{Status: containerd.Running}, nil
+}
+
+// Wait polls for the process to go away. Its exit status is not ours to
+// collect, and containerd has no way to make an unknown one, so it is the
+// zero ExitStatus.
+func (t *hostTask) Wait(ctx context.Context) (<-chan containerd.ExitStatus, error) {
+	ch := make(chan containerd.ExitStatus, 1)
+	go func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				if !t.alive() {
+					ch <- containerd.ExitStatus{}
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Kill signals the process, which is all the options can mean for it.
+func (t *hostTask) Kill(ctx context.Context, sig syscall.Signal, opts ...containerd.KillOpts) error {
+	return unix.Kill(int(t.pid), sig)
+}
+
+// Pids returns the process itself; its children are not tracked.
+func (t *hostTask) Pids(ctx context.Context) ([]containerd.ProcessInfo, error) {
+	return []containerd.ProcessInfo{{Pid: t.pid}}, nil
+}
+
+// IO returns nil: the process's stdio is not containerd's.
+func (t *hostTask) IO() cio.IO {
+	return nil
+}
+
+func (t *hostTask) Start(ctx context.Context) error {
+	return errHostProcess("start")
+}
+
+func (t *hostTask) Delete(ctx context.Context, opts ...containerd.ProcessDeleteOpts) (*containerd.ExitStatus, error) {
+	return nil, errHostProcess("delete")
+}
+
+func (t *hostTask) CloseIO(ctx context.Context, opts ...containerd.IOCloserOpts) error {
+	return errHostProcess("close io")
+}
+
+func (t *hostTask) Resize(ctx context.Context, w, h uint32) error {
+	return errHostProcess("resize")
+}
+
+func (t *hostTask) Pause(ctx context.Context) error {
+	return errHostProcess("pause")
+}
+
+func (t *hostTask) Resume(ctx context.Context) error {
+	return errHostProcess("resume")
+}
+
+func (t *hostTask) Exec(ctx context.Context, id string, spec *specs.Process, ioCreate cio.Creator) (containerd.Process, error) {
+	return nil, errHostProcess("exec")
+}
+
+func (t *hostTask) Checkpoint(ctx context.Context, opts ...containerd.CheckpointTaskOpts) (containerd.Image, error) {
+	return nil, errHostProcess("checkpoint")
+}
+
+func (t *hostTask) Update(ctx context.Context, opts ...containerd.UpdateTaskOpts) error {
+	return errHostProcess("update")
+}
+
+func (t *hostTask) LoadProcess(ctx context.Context, id string, attach cio.Attach) (containerd.Process, error) {
+	return nil, errHostProcess("load process")
+}
+
+func (t *hostTask) Metrics(ctx context.Context) (*types.Metric, error) {
+	return nil, errHostProcess("metrics")
+}
+
+// errHostProcess is the error of op, which a host process does not have.
+func errHostProcess(op string) error {
+	return newError(ErrInvalidConfig, errdefs.ErrNotImplemented, "%s: host process", op)
+}
+
+// alive reports whether the process still exists.
+func (t *hostTask) alive() bool {
+	return unix.Kill(int(t.pid), 0) != unix.ESRCH
+}
+
+// splitNul splits the NUL-terminated strings of a /proc file.
+func splitNul(b []byte) []string {
+	var s []string
+	for _, f := range bytes.Split(bytes.TrimRight(b, "\x00"), []byte{0}) {
+		s = append(s, string(f))
+	}
+	return s
+}
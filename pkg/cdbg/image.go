@@ -0,0 +1,286 @@
+package cdbg
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+)
+
+// PrepareImage pulls (or imports) cfg.Image and returns it along with the key
+// of the snapshot to view as the debug image's root filesystem.
+func PrepareImage(ctx context.Context, client *containerd.Client, cfg Config) (containerd.Image, string, error) {
+	ss := client.SnapshotService(cfg.snapshotter())
+
+	// reuse a persisted debug image snapshot if we have one
+	if cfg.PersistView {
+		if parent, i := loadPersistedView(ctx, client, ss, cfg.Image, cfg.Platform); i != nil {
+			if err := verifyDigest(cfg.Image, i); err != nil {
+				return nil, "", err
+			}
+			return i, parent, nil
+		}
+	}
+
+	var (
+		i   containerd.Image
+		err error
+	)
+	if cfg.ImageArchive != "" {
+		i, err = importImage(ctx, client, cfg.ImageArchive, cfg.Image, cfg.Platform, cfg.snapshotter())
+		if err != nil {
+			return nil, "", newError(ErrPullFailed, err, "import: %s", cfg.ImageArchive)
+		}
+	} else {
+		i, err = pullImage(ctx, client, cfg)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err = verifyDigest(cfg.Image, i)
+	if err != nil {
+		return nil, "", err
+	}
+	diffs, err := i.RootFS(ctx)
+	if err != nil {
+		return nil, "", newError(ErrPullFailed, err, "rootFS")
+	}
+	// the diff IDs come from the image config, which an imported archive
+	// controls, and a one-layer chain ID is its diff ID verbatim
+	chainID, err := digest.Parse(identity.ChainID(diffs).String())
+	if err != nil {
+		return nil, "", newError(ErrPullFailed, err, "chain ID")
+	}
+
+	snap, err := ss.Stat(ctx, chainID.String())
+	if err != nil {
+		return nil, "", newError(ErrPullFailed, err, "stat: %s", chainID)
+	}
+	parent := snap.Name
+	if cfg.PersistView {
+		parent, err = createPersistedView(ctx, ss, cfg.Image, cfg.Platform, parent)
+		if err != nil {
+			return nil, "", newError(ErrContainerd, err, "persist view")
+		}
+	}
+	return i, parent, nil
+}
+
+// Pull policies for Config.PullPolicy.
+const (
+	// PullAlways pulls the debug image on every run
+	PullAlways = "always"
+	// PullMissing uses the local image if there is one
+	PullMissing = "missing"
+	// PullNever only uses the local image, never the network
+	PullNever = "never"
+)
+
+// pullImage returns cfg.Image, unpacked, from the local image store or the
+// registry as cfg.PullPolicy allows.
+func pullImage(ctx context.Context, client *containerd.Client, cfg Config) (containerd.Image, error) {
+	if cfg.PullPolicy != PullAlways {
+		i, err := localImage(ctx, client, cfg.Image, cfg.Platform, cfg.snapshotter())
+		if err == nil {
+			log.G(ctx).Debugf("using local image %s", cfg.Image)
+			return i, nil
+		}
+		if cfg.PullPolicy == PullNever {
+			return nil, newError(ErrPullFailed, err, "%s (pull policy is never)", cfg.Image)
+		}
+	}
+
+	resolver, err := newResolver(ctx, cfg)
+	if err != nil {
+		return nil, newError(ErrInvalidConfig, err, "pull: %s", cfg.Image)
+	}
+	opts := []containerd.RemoteOpt{
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(cfg.snapshotter()),
+		containerd.WithResolver(resolver),
+	}
+	if cfg.Platform != "" {
+		opts = append(opts, containerd.WithPlatform(cfg.Platform))
+	}
+	i, err := client.Pull(ctx, cfg.Image, opts...)
+	if err != nil {
+		return nil, newError(ErrPullFailed, err, "pull: %s", cfg.Image)
+	}
+	return i, nil
+}
+
+// localImage returns the image ref for platform from the local image
+// store, unpacking it into snapshotter if it is not yet.
+func localImage(ctx context.Context, client *containerd.Client, ref, platform, snapshotter string) (containerd.Image, error) {
+	p, err := platformMatcher(platform)
+	if err != nil {
+		return nil, err
+	}
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	i := containerd.NewImageWithPlatform(client, img, p)
+	unpacked, err := i.IsUnpacked(ctx, snapshotter)
+	if err != nil {
+		return nil, err
+	}
+	if !unpacked {
+		err = i.Unpack(ctx, snapshotter)
+		if err != nil {
+			return nil, fmt.Errorf("unpack: %v", err)
+		}
+	}
+	return i, nil
+}
+
+// importImage loads the image named ref out of an OCI layout directory or
+// a tarball (OCI or docker save format) and unpacks it. An empty ref picks
+// the only image of the archive. The variant for platform, or the host's if
+// empty, is unpacked into snapshotter.
+func importImage(ctx context.Context, client *containerd.Client, path, ref, platform, snapshotter string) (containerd.Image, error) {
+	p, err := platformMatcher(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	imgs, err := client.Import(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, img := range imgs {
+		if sameRef(img.Name, ref) || sameDigest(ref, img.Target.Digest) || ref == "" && len(imgs) == 1 {
+			i := containerd.NewImageWithPlatform(client, img, p)
+			err = i.Unpack(ctx, snapshotter)
+			if err != nil {
+				return nil, fmt.Errorf("unpack: %v", err)
+			}
+			return i, nil
+		}
+		names = append(names, img.Name)
+	}
+	return nil, fmt.Errorf("image %s not found in archive (has: %s)",
+		ref, strings.Join(names, ", "))
+}
+
+// openArchive returns a tar stream for path. Directories are assumed to be
+// OCI image layouts and are tarred up on the fly.
+func openArchive(path string) (io.ReadCloser, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return os.Open(path)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDir(pw, path))
+	}()
+	return pr, nil
+}
+
+func tarDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// platformMatcher matches the named platform, or the host's if empty.
+func platformMatcher(platform string) (platforms.MatchComparer, error) {
+	if platform == "" {
+		return platforms.Default(), nil
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, err
+	}
+	return platforms.Only(p), nil
+}
+
+// verifyDigest refuses image i if ref pins a digest that i does not have.
+func verifyDigest(ref string, i containerd.Image) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil
+	}
+	pinned, ok := named.(reference.Digested)
+	if !ok {
+		return nil
+	}
+	if got := i.Target().Digest; got != pinned.Digest() {
+		return newError(ErrDigestMismatch,
+			fmt.Errorf("want %s, got %s", pinned.Digest(), got), "verify: %s", ref)
+	}
+	return nil
+}
+
+// sameDigest reports whether ref pins digest d.
+func sameDigest(ref string, d digest.Digest) bool {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return false
+	}
+	pinned, ok := named.(reference.Digested)
+	return ok && pinned.Digest() == d
+}
+
+// sameRef compares two image references after docker-style normalization,
+// so "ubuntu:bionic" matches "docker.io/library/ubuntu:bionic".
+func sameRef(a, b string) bool {
+	return normalizeRef(a) == normalizeRef(b)
+}
+
+func normalizeRef(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
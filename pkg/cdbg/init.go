@@ -0,0 +1,94 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// InitPath is where the cdbg binary is mounted inside the debug container
+// when it acts as PID 1 for Config.AsPID1. A binary started with this argv[0]
+// should call RunInit.
+const InitPath = "/.cdbg/init"
+
+// WithInit runs the debug command under a copy of the cdbg binary at exe,
+// acting as a minimal init. It must be composed after the process args are set.
+func WithInit(exe string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: InitPath,
+			Type:        "bind",
+			Source:      exe,
+			Options:     []string{"rbind", "ro"},
+		})
+		spec.Process.Args = append([]string{InitPath, "--"}, spec.Process.Args...)
+		return nil
+	}
+}
+
+// RunInit starts args as a child, forwards every signal it receives to the
+// child and reaps all zombies until the child exits. It returns the exit code
+// to use for the child's status.
+func RunInit(args []string) int {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "init: no command")
+		return 127
+	}
+
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return 127
+	}
+	child := cmd.Process.Pid
+
+	for sig := range sigs {
+		if sig == unix.SIGCHLD {
+			if code, exited := reap(child); exited {
+				return code
+			}
+			continue
+		}
+		unix.Kill(child, sig.(syscall.Signal))
+	}
+	return 0
+}
+
+// reap collects every exited child and reports whether child was among them.
+func reap(child int) (int, bool) {
+	code, exited := 0, false
+	for {
+		var ws unix.WaitStatus
+		pid, err := unix.Wait4(-1, &ws, unix.WNOHANG, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return code, exited
+		}
+		if pid == child {
+			exited = true
+			code = ws.ExitStatus()
+			if ws.Signaled() {
+				code = 128 + int(ws.Signal())
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package cdbg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/oci"
+)
+
+// Report is a diagnostics snapshot of a running target, taken from the
+// host without a debug container. Files that could not be read are left
+// out and their errors listed in Errors.
+type Report struct {
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+	Spec   *oci.Spec `json:"spec"`
+	// Processes of the target's PID namespace
+	Processes []ProcessReport `json:"processes"`
+	// Mounts is the mountinfo of the target's main process
+	Mounts string `json:"mounts"`
+	// Sockets are the socket tables of the target's network namespace,
+	// such as tcp and unix, by their name under /proc/net
+	Sockets map[string]string `json:"sockets"`
+	// Cgroup holds the statistics and limits of the target's cgroup, by
+	// file name, under the controller's directory on cgroup v1
+	Cgroup map[string]string `json:"cgroup"`
+	Errors []string          `json:"errors,omitempty"`
+}
+
+// ProcessReport is a process of a Report, with its /proc files.
+type ProcessReport struct {
+	Process
+	Cmdline []string `json:"cmdline"`
+	Status  string   `json:"status"`
+	Limits  string   `json:"limits"`
+	Maps    string   `json:"maps"`
+	// FDs are the targets of its open file descriptors, by number
+	FDs map[string]string `json:"fds"`
+}
+
+// socketTables are the files of /proc/<pid>/net in a Report.
+var socketTables = []string{"tcp", "tcp6", "udp", "udp6", "raw", "raw6", "unix", "netlink", "sockstat", "sockstat6", "dev", "snmp"}
+
+// cgroupFiles are the files of the target's cgroup in a Report, by
+// cgroup v1 controller; the unified hierarchy of v2 is under "".
+var cgroupFiles = map[string][]string{
+	"":        {"cgroup.procs", "cpu.max", "cpu.stat", "cpu.pressure", "io.stat", "io.pressure", "memory.current", "memory.max", "memory.events", "memory.stat", "memory.pressure", "pids.current", "pids.max"},
+	"memory":  {"memory.usage_in_bytes", "memory.limit_in_bytes", "memory.max_usage_in_bytes", "memory.failcnt", "memory.stat", "memory.oom_control"},
+	"cpu":     {"cpu.cfs_period_us", "cpu.cfs_quota_us", "cpu.shares", "cpu.stat"},
+	"cpuacct": {"cpuacct.usage", "cpuacct.stat"},
+	"pids":    {"pids.current", "pids.max"},
+	"blkio":   {"blkio.throttle.io_service_bytes", "blkio.throttle.io_serviced"},
+}
+
+// cgroupRoot is where the host mounts its cgroup hierarchies.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Inspect takes a Report of the running target c.
+func Inspect(ctx context.Context, c containerd.Container) (*Report, error) {
+	task, stopped, err := targetState(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if stopped {
+		return nil, newError(ErrTargetNotRunning, fmt.Errorf("not running"), "target %s", c.ID())
+	}
+	pid := task.Pid()
+	r := &Report{
+		Target:  c.ID(),
+		Time:    time.Now().UTC(),
+		Sockets: make(map[string]string),
+		Cgroup:  make(map[string]string),
+	}
+	r.Spec, err = c.Spec(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "spec")
+	}
+	procs, err := Processes(pid, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range procs {
+		r.Processes = append(r.Processes, r.process(p))
+	}
+	r.Mounts = r.read(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	for _, name := range socketTables {
+		if s := r.read(fmt.Sprintf("/proc/%d/net/%s", pid, name)); s != "" {
+			r.Sockets[name] = s
+		}
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+		return r, nil
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			dir := filepath.Join(cgroupRoot, controller, parts[2])
+			if controller == "" && parts[0] != "0" {
+				continue
+			}
+			for _, name := range cgroupFiles[controller] {
+				if s := r.read(filepath.Join(dir, name)); s != "" {
+					r.Cgroup[path.Join(controller, name)] = s
+				}
+			}
+		}
+	}
+	return r, nil
+}
+
+// process reports on p.
+func (r *Report) process(p Process) ProcessReport {
+	proc := fmt.Sprintf("/proc/%d", p.Pid)
+	pr := ProcessReport{
+		Process: p,
+		Status:  r.read(proc + "/status"),
+		Limits:  r.read(proc + "/limits"),
+		Maps:    r.read(proc + "/maps"),
+		FDs:     make(map[string]string),
+	}
+	if b, err := ioutil.ReadFile(proc + "/cmdline"); err == nil {
+		pr.Cmdline = splitNul(b)
+	}
+	fds, err := ioutil.ReadDir(proc + "/fd")
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+		return pr
+	}
+	for _, fd := range fds {
+		if link, err := os.Readlink(filepath.Join(proc, "fd", fd.Name())); err == nil {
+			pr.FDs[fd.Name()] = link
+		}
+	}
+	return pr
+}
+
+// read returns the contents of the file at name, recording why not if it
+// cannot. Files that do not exist, such as controllers the host lacks, are
+// not worth recording.
+func (r *Report) read(name string) string {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		return ""
+	}
+	return string(b)
+}
+
+// WriteTar writes r to w as a gzipped tarball of files, laid out like
+// /proc: spec.json, report.json, mountinfo, net/, cgroup/ and a directory
+// for each process, named by its PID in the target.
+func (r *Report) WriteTar(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	files := make(map[string]string)
+	spec, err := json.MarshalIndent(r.Spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	files["spec.json"] = string(spec)
+	summary, err := json.MarshalIndent(struct {
+		Target    string    `json:"target"`
+		Time      time.Time `json:"time"`
+		Processes []Process `json:"processes"`
+		Errors    []string  `json:"errors,omitempty"`
+	}{r.Target, r.Time, r.processes(), r.Errors}, "", "  ")
+	if err != nil {
+		return err
+	}
+	files["report.json"] = string(summary)
+	files["mountinfo"] = r.Mounts
+	for name, s := range r.Sockets {
+		files["net/"+name] = s
+	}
+	for name, s := range r.Cgroup {
+		files["cgroup/"+name] = s
+	}
+	for _, p := range r.Processes {
+		dir := strconv.FormatUint(uint64(p.NSPid), 10) + "/"
+		files[dir+"cmdline"] = strings.Join(p.Cmdline, " ") + "\n"
+		files[dir+"status"] = p.Status
+		files[dir+"limits"] = p.Limits
+		files[dir+"maps"] = p.Maps
+		var fds strings.Builder
+		for _, fd := range sortedKeys(p.FDs) {
+			fmt.Fprintf(&fds, "%s -> %s\n", fd, p.FDs[fd])
+		}
+		files[dir+"fd"] = fds.String()
+	}
+
+	for _, name := range sortedKeys(files) {
+		// the spec has the target's environment, secrets and all
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     r.Target + "/" + name,
+			Mode:     0600,
+			Size:     int64(len(files[name])),
+			ModTime:  r.Time,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (r *Report) processes() []Process {
+	var procs []Process
+	for _, p := range r.Processes {
+		procs = append(procs, p.Process)
+	}
+	return procs
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,122 @@
+package cdbg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// LoopDevice is a host image file attached through a loop device. If Dest
+// is under /dev the device itself appears there in the debug container;
+// otherwise the filesystem in the image is mounted at Dest.
+type LoopDevice struct {
+	Image string
+	Dest  string
+}
+
+// ParseLoopDevices parses a comma-separated list of image:dest pairs.
+func ParseLoopDevices(s string) ([]LoopDevice, error) {
+	var loops []LoopDevice
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.LastIndex(spec, ":")
+		if i <= 0 || i == len(spec)-1 || spec[i+1] != '/' {
+			return nil, fmt.Errorf("%s: want image:/absolute/dest", spec)
+		}
+		loops = append(loops, LoopDevice{Image: spec[:i], Dest: spec[i+1:]})
+	}
+	return loops, nil
+}
+
+// IsDevice reports whether l exposes the block device rather than its
+// filesystem.
+func (l LoopDevice) IsDevice() bool {
+	return strings.HasPrefix(l.Dest, "/dev/")
+}
+
+// attachLoop sets up a loop device backed by image and returns its path.
+func attachLoop(image string, readOnly bool) (string, error) {
+	args := []string{"--find", "--show"}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	out, err := runLosetup(append(args, image)...)
+	return strings.TrimSpace(out), err
+}
+
+// detachLoop releases a loop device set up by attachLoop.
+func detachLoop(dev string) error {
+	_, err := runLosetup("--detach", dev)
+	return err
+}
+
+func runLosetup(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("losetup", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("losetup %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// mountLoop mounts the filesystem on dev at dir, leaving the filesystem
+// type to mount(8) to detect.
+func mountLoop(dev, dir string, readOnly bool) error {
+	args := []string{dev, dir}
+	if readOnly {
+		args = append([]string{"-o", "ro"}, args...)
+	}
+	out, err := exec.Command("mount", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mount %s: %v: %s", dev, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// WithBlockDevice creates the block device dev at dest in the container
+// and allows the container to use it.
+func WithBlockDevice(dev, dest string, readOnly bool) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		var st unix.Stat_t
+		if err := unix.Stat(dev, &st); err != nil {
+			return fmt.Errorf("stat %s: %v", dev, err)
+		}
+		major, minor := int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+		mode := os.FileMode(0660)
+		access := "rwm"
+		if readOnly {
+			access = "rm"
+		}
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		spec.Linux.Devices = append(spec.Linux.Devices, specs.LinuxDevice{
+			Path:     dest,
+			Type:     "b",
+			Major:    major,
+			Minor:    minor,
+			FileMode: &mode,
+		})
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   "b",
+			Major:  &major,
+			Minor:  &minor,
+			Access: access,
+		})
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ParseList splits a comma-separated list, dropping empty entries.
+func ParseList(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// WithTargetMounts adds the mounts of target that have an absolute source
+// (volumes and bind mounts, not /proc and friends). If include is not empty
+// only mounts matching one of its patterns are added, and mounts matching
+// an exclude pattern are always skipped.
+func WithTargetMounts(target *oci.Spec, include, exclude []string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		var mounts []specs.Mount
+		for _, m := range target.Mounts {
+			if m.Source[0] != '/' {
+				continue
+			}
+			if len(include) > 0 && !matchMount(include, m) {
+				log.G(ctx).Debugf("skipping mount %s (not included)", m.Destination)
+				continue
+			}
+			if matchMount(exclude, m) {
+				log.G(ctx).Debugf("skipping mount %s (excluded)", m.Destination)
+				continue
+			}
+			mounts = append(mounts, m)
+		}
+		return oci.WithMounts(mounts)(ctx, client, c, spec)
+	}
+}
+
+// matchMount reports whether a pattern matches the destination or source of
+// m, or a directory containing either, so that excluding /var/lib/secrets
+// also excludes the mounts below it.
+func matchMount(patterns []string, m specs.Mount) bool {
+	for _, p := range patterns {
+		if matchPath(p, m.Destination) || matchPath(p, m.Source) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(pattern, name string) bool {
+	for name = path.Clean(name); ; name = path.Dir(name) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if name == "/" || name == "." {
+			return false
+		}
+	}
+}
+
+// validatePatterns rejects malformed globs in patterns.
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return newError(ErrInvalidConfig, err, "mount pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// ParseVolume parses a docker-style host:dest[:ro|rw] bind mount.
+func ParseVolume(s string) (specs.Mount, error) {
+	parts := strings.Split(s, ":")
+	mode := "rw"
+	switch {
+	case len(parts) == 3 && (parts[2] == "ro" || parts[2] == "rw"):
+		mode = parts[2]
+	case len(parts) != 2:
+		return specs.Mount{}, fmt.Errorf("%s: want host:dest[:ro|rw]", s)
+	}
+	return bindMount(parts[0], parts[1], mode == "ro")
+}
+
+// ParseMount parses a docker-style mount description, a comma-separated
+// list of key=value pairs: type (bind or tmpfs), source (or src), target
+// (or dst, destination), readonly (or ro) and, for tmpfs, tmpfs-size and
+// tmpfs-mode.
+func ParseMount(s string) (specs.Mount, error) {
+	var (
+		typ      = "bind"
+		src, dst string
+		readOnly bool
+		tmpfs    []string
+	)
+	for _, field := range ParseList(s) {
+		kv := strings.SplitN(field, "=", 2)
+		key, value := kv[0], ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "type":
+			typ = value
+		case "source", "src":
+			src = value
+		case "target", "dst", "destination":
+			dst = value
+		case "readonly", "ro":
+			readOnly = value == "" || value == "true" || value == "1"
+		case "tmpfs-size":
+			tmpfs = append(tmpfs, "size="+value)
+		case "tmpfs-mode":
+			tmpfs = append(tmpfs, "mode="+value)
+		default:
+			return specs.Mount{}, fmt.Errorf("%s: unknown mount option %q", s, key)
+		}
+	}
+	switch typ {
+	case "bind":
+		return bindMount(src, dst, readOnly)
+	case "tmpfs":
+		if readOnly {
+			tmpfs = append(tmpfs, "ro")
+		}
+		return tmpfsMount(dst, tmpfs)
+	}
+	return specs.Mount{}, fmt.Errorf("%s: unsupported mount type %q", s, typ)
+}
+
+// bindMount binds host path src at dst, which must be absolute.
+func bindMount(src, dst string, readOnly bool) (specs.Mount, error) {
+	if !path.IsAbs(dst) {
+		return specs.Mount{}, fmt.Errorf("mount destination %q is not absolute", dst)
+	}
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return specs.Mount{}, err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return specs.Mount{}, err
+	}
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	return specs.Mount{
+		Destination: dst,
+		Type:        "bind",
+		Source:      src,
+		Options:     []string{"rbind", mode},
+	}, nil
+}
+
+// ParseTmpfs parses a docker-style tmpfs mount, dest[:options] where
+// options are tmpfs mount options such as size=64m,mode=1777.
+func ParseTmpfs(s string) (specs.Mount, error) {
+	parts := strings.SplitN(s, ":", 2)
+	var options []string
+	if len(parts) == 2 {
+		options = ParseList(parts[1])
+	}
+	return tmpfsMount(parts[0], options)
+}
+
+// tmpfsMount mounts a fresh tmpfs at dst, which must be absolute.
+func tmpfsMount(dst string, options []string) (specs.Mount, error) {
+	if !path.IsAbs(dst) {
+		return specs.Mount{}, fmt.Errorf("mount destination %q is not absolute", dst)
+	}
+	return specs.Mount{
+		Destination: dst,
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     append([]string{"nosuid", "nodev"}, options...),
+	}, nil
+}
@@ -0,0 +1,129 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// joinableNamespaces maps the names accepted by ParseNamespaces to the target namespaces cdbg can join.
+var joinableNamespaces = map[string]specs.LinuxNamespaceType{
+	"pid":  specs.PIDNamespace,
+	"net":  specs.NetworkNamespace,
+	"ipc":  specs.IPCNamespace,
+	"uts":  specs.UTSNamespace,
+	"user": specs.UserNamespace,
+}
+
+// Network settings for Config.Network.
+const (
+	// NetworkHost shares the host's network namespace
+	NetworkHost = "host"
+	// NetworkNone gives the debug container a network namespace of its
+	// own, with only a loopback interface
+	NetworkNone = "none"
+)
+
+// nsProcNames maps namespace types to their entry under /proc/<pid>/ns.
+var nsProcNames = map[specs.LinuxNamespaceType]string{
+	specs.PIDNamespace:     "pid",
+	specs.NetworkNamespace: "net",
+	specs.MountNamespace:   "mnt",
+	specs.IPCNamespace:     "ipc",
+	specs.UTSNamespace:     "uts",
+	specs.UserNamespace:    "user",
+	specs.CgroupNamespace:  "cgroup",
+}
+
+// ParseNamespaces parses a comma-separated list of target namespaces to join,
+// such as "pid".
+func ParseNamespaces(s string) ([]specs.LinuxNamespaceType, error) {
+	var joined []specs.LinuxNamespaceType
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ns, ok := joinableNamespaces[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported namespace: %s", name)
+		}
+		if !hasNamespace(joined, ns) {
+			joined = append(joined, ns)
+		}
+	}
+	return joined, nil
+}
+
+func hasNamespace(joined []specs.LinuxNamespaceType, ns specs.LinuxNamespaceType) bool {
+	for _, j := range joined {
+		if j == ns {
+			return true
+		}
+	}
+	return false
+}
+
+func nsPath(pid uint32, ns specs.LinuxNamespaceType) string {
+	return fmt.Sprintf("/proc/%d/ns/%s", pid, nsProcNames[ns])
+}
+
+// WithTargetNamespace joins the namespace of type ns belonging to pid. The
+// user namespace brings the uid and gid mappings of pid along, which the
+// runtime needs to set up the process.
+func WithTargetNamespace(pid uint32, ns specs.LinuxNamespaceType) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if ns == specs.UserNamespace {
+			var err error
+			spec.Linux.UIDMappings, err = readIDMap(fmt.Sprintf("/proc/%d/uid_map", pid))
+			if err != nil {
+				return err
+			}
+			spec.Linux.GIDMappings, err = readIDMap(fmt.Sprintf("/proc/%d/gid_map", pid))
+			if err != nil {
+				return err
+			}
+		}
+		return oci.WithLinuxNamespace(specs.LinuxNamespace{
+			Type: ns,
+			Path: nsPath(pid, ns),
+		})(ctx, client, c, spec)
+	}
+}
+
+// InSeparateUserNamespace reports whether pid runs in a different user
+// namespace than cdbg, as containers of a userns-remapped Docker do.
+func InSeparateUserNamespace(pid uint32) (bool, error) {
+	target, err := os.Readlink(nsPath(pid, specs.UserNamespace))
+	if err != nil {
+		return false, err
+	}
+	self, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		return false, err
+	}
+	return target != self, nil
+}
+
+// readIDMap parses a /proc/<pid>/[ug]id_map file.
+func readIDMap(path string) ([]specs.LinuxIDMapping, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []specs.LinuxIDMapping
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var m specs.LinuxIDMapping
+		if _, err := fmt.Sscan(line, &m.ContainerID, &m.HostID, &m.Size); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
@@ -0,0 +1,374 @@
+package cdbg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// TargetPath is where the target's root filesystem appears, as it is and
+// read-only unless it cannot be overlaid, in the debug container.
+const TargetPath = "/.cdbg/target"
+
+// NoOverlayTargetPath is where the target's root filesystem appears with
+// NoOverlay, which leaves all of / to the debug image.
+const NoOverlayTargetPath = "/target"
+
+// Workspace is the scratch directory of a session. The debug image view is
+// mounted at DebugRoot and the combined overlay at Root; writable sessions
+// keep their changes in UpperDir.
+type Workspace struct {
+	Dir string
+}
+
+func (w Workspace) DebugRoot() string { return filepath.Join(w.Dir, "dbg") }
+func (w Workspace) Root() string      { return filepath.Join(w.Dir, "root") }
+func (w Workspace) FIFODir() string   { return filepath.Join(w.Dir, "fifos") }
+func (w Workspace) UpperDir() string  { return filepath.Join(w.Dir, "upperdir") }
+func (w Workspace) WorkDir() string   { return filepath.Join(w.Dir, "workdir") }
+
+// MountpointDir is the top lowerdir of the overlay, with nothing but the
+// mountpoints of the session's own mounts: a read-only overlay cannot have
+// them made in it.
+func (w Workspace) MountpointDir() string { return filepath.Join(w.Dir, "mnt") }
+
+// TargetRoot is where the rootfs of a stopped target is mounted.
+func (w Workspace) TargetRoot() string { return filepath.Join(w.Dir, "targetfs") }
+
+// StateRoot holds the persistent workspaces named by Config.StateDir.
+const StateRoot = "/var/lib/cdbg/state"
+
+// stateTarget returns the ID of the target the workspace was last used
+// with, if it is persistent.
+func (w Workspace) stateTarget() string {
+	b, err := ioutil.ReadFile(filepath.Join(w.Dir, "target"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (w Workspace) setStateTarget(id string) error {
+	return ioutil.WriteFile(filepath.Join(w.Dir, "target"), []byte(id+"\n"), 0644)
+}
+
+// LoopDir is where the filesystem of the nth loop device is mounted.
+func (w Workspace) LoopDir(n int) string { return filepath.Join(w.Dir, "loop", strconv.Itoa(n)) }
+
+// NewWorkspace lays out a workspace in dir, or in a new temporary directory
+// if dir is empty.
+func NewWorkspace(dir string) (Workspace, error) {
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir("", "cdbg")
+		if err != nil {
+			return Workspace{}, newError(ErrMountFailed, err, "temp dir")
+		}
+	}
+	ws := Workspace{Dir: dir}
+	// overlay refuses a workdir left over from an earlier session, and
+	// the mountpoints are those of this one
+	for _, d := range []string{ws.WorkDir(), ws.MountpointDir()} {
+		if err := clearDir(d); err != nil {
+			return ws, newError(ErrMountFailed, err, "clear %s", filepath.Base(d))
+		}
+	}
+	err := makeSubDirs(
+		ws.DebugRoot(),
+		ws.Root(),
+		ws.FIFODir(),
+		ws.UpperDir(),
+		ws.WorkDir(),
+		filepath.Join(ws.MountpointDir(), TargetPath),
+	)
+	if err != nil {
+		return ws, newError(ErrMountFailed, err, "mkdir")
+	}
+	return ws, nil
+}
+
+// newTmpfsWorkspace is NewWorkspace in a new temporary directory with a
+// tmpfs mounted on it, for targets whose root holds the temporary directory:
+// overlay refuses an upperdir inside its lowerdir.
+func newTmpfsWorkspace() (Workspace, error) {
+	dir, err := ioutil.TempDir("", "cdbg")
+	if err != nil {
+		return Workspace{}, newError(ErrMountFailed, err, "temp dir")
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", 0, "mode=0700"); err != nil {
+		os.Remove(dir)
+		return Workspace{}, newError(ErrMountFailed, err, "tmpfs: %s", dir)
+	}
+	ws, err := NewWorkspace(dir)
+	if err != nil {
+		if unix.Unmount(dir, 0) == nil {
+			os.RemoveAll(dir)
+		}
+	}
+	return ws, err
+}
+
+// Layerings for Config.Layering.
+const (
+	// LayeringDebugOverTarget shadows the target's files with the debug
+	// image's
+	LayeringDebugOverTarget = "debug-over-target"
+	// LayeringTargetOverDebug shadows the debug image's files with the
+	// target's, so its /etc, /usr/bin and libraries are the ones used
+	LayeringTargetOverDebug = "target-over-debug"
+)
+
+// OverlayOptions returns the overlay mount options that combine the debug
+// image mounted in ws with the target's root filesystem at targetRoot,
+// layered as layering says. Without a layering a read-only session has the
+// debug image over the target, and a writable one the target alone. Either
+// way the mountpoints of ws are on top.
+func OverlayOptions(ws Workspace, targetRoot string, readOnly bool, layering string) []string {
+	// the first lowerdir is the top one
+	lower := strings.Join(append([]string{ws.MountpointDir()}, overlayLowers(ws, targetRoot, readOnly, layering)...), ":")
+	if readOnly {
+		return []string{"lowerdir=" + lower}
+	}
+	return []string{
+		fmt.Sprintf("lowerdir=%s", lower),
+		fmt.Sprintf("upperdir=%s", ws.UpperDir()),
+		fmt.Sprintf("workdir=%s", ws.WorkDir()),
+	}
+}
+
+// overlayLowers returns the lowerdirs of OverlayOptions below the
+// mountpoints of ws, the top one first.
+func overlayLowers(ws Workspace, targetRoot string, readOnly bool, layering string) []string {
+	if layering == "" && readOnly {
+		layering = LayeringDebugOverTarget
+	}
+	switch layering {
+	case LayeringDebugOverTarget:
+		return []string{ws.DebugRoot(), targetRoot}
+	case LayeringTargetOverDebug:
+		return []string{targetRoot, ws.DebugRoot()}
+	}
+	return []string{targetRoot}
+}
+
+// makeMountpoints lays out in dir, the top lowerdir of an overlay over
+// lowers, the destinations of mounts that the overlay would not have:
+// runc cannot make them in a read-only one. Each is a directory, or an
+// empty file for the bind mount of a file. A destination under anything
+// but a directory in lowers, such as a symlink, is left alone, as laying
+// it out would shadow that.
+func makeMountpoints(dir string, lowers []string, mounts []specs.Mount) error {
+	for _, m := range mounts {
+		dest := filepath.Clean("/" + m.Destination)
+		if !missingFrom(lowers, dest) {
+			continue
+		}
+		path := filepath.Join(dir, dest)
+		if !isFileBind(m) {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// missingFrom reports whether path is missing from an overlay of lowers,
+// the top one first, under directories it has.
+func missingFrom(lowers []string, path string) bool {
+	if path == "/" {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i := range parts {
+		p := filepath.Join(parts[:i+1]...)
+		// as overlay looks it up: the top entry wins, and directories
+		// merge with those below down to the first that is not one
+		var top os.FileInfo
+		var dirs []string
+		for _, l := range lowers {
+			fi, err := os.Lstat(filepath.Join(l, p))
+			if err != nil {
+				continue
+			}
+			if top == nil {
+				top = fi
+			}
+			if !fi.IsDir() {
+				break
+			}
+			dirs = append(dirs, l)
+		}
+		if top == nil {
+			return true
+		}
+		if !top.IsDir() || i == len(parts)-1 {
+			return false
+		}
+		lowers = dirs
+	}
+	return false
+}
+
+// isFileBind reports whether m bind mounts a file rather than a directory.
+func isFileBind(m specs.Mount) bool {
+	if m.Type != "bind" && !hasOption(m.Options, "bind") && !hasOption(m.Options, "rbind") {
+		return false
+	}
+	fi, err := os.Stat(m.Source)
+	return err == nil && !fi.IsDir()
+}
+
+// MountOverlay mounts an overlay filesystem with options at target.
+func MountOverlay(target string, options []string) error {
+	overlay := mount.Mount{
+		Type:    "overlay",
+		Source:  "overlay",
+		Options: options,
+	}
+	err := overlay.Mount(target)
+	if err == unix.ENODEV {
+		return newError(ErrOverlayUnsupported, err, "mount: overlay: this kernel has no overlay filesystem support")
+	}
+	if err != nil {
+		return newError(ErrMountFailed, err, "mount: overlay %+v", overlay)
+	}
+	return nil
+}
+
+// overlaySupported reports whether the kernel has the overlay filesystem.
+// If that cannot be told it is assumed to.
+func overlaySupported() bool {
+	b, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return true
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(strings.TrimPrefix(line, "nodev")) == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// mountTypes lists the filesystem types of mounts, which tell the
+// snapshotter that produced them.
+func mountTypes(mounts []mount.Mount) string {
+	var types []string
+	for _, m := range mounts {
+		types = append(types, m.Type)
+	}
+	return strings.Join(types, ",")
+}
+
+// withTargetRoot bind mounts the target's root filesystem root at path.
+func withTargetRoot(root, path string, readOnly bool) oci.SpecOpts {
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	return oci.WithMounts([]specs.Mount{{
+		Destination: path,
+		Type:        "bind",
+		Source:      root,
+		Options:     []string{"rbind", mode},
+	}})
+}
+
+func makeSubDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// removeWorkspace removes the workspace directory dir and everything in it.
+// It refuses while anything is mounted there, and never descends into
+// another filesystem, so that the files of a loop image or target root
+// left mounted in it are not deleted with it.
+func removeWorkspace(dir string) error {
+	mounts, err := mount.Self()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if within(dir, m.Mountpoint) {
+			return fmt.Errorf("%s: %s is still mounted", dir, m.Mountpoint)
+		}
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(dir, &st); err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return &os.PathError{Op: "lstat", Path: dir, Err: err}
+	}
+	return removeSameDevice(dir, st.Dev)
+}
+
+// removeSameDevice removes p and, if it is a directory, everything in it,
+// failing at anything not on device dev.
+func removeSameDevice(p string, dev uint64) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(p, &st); err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return &os.PathError{Op: "lstat", Path: p, Err: err}
+	}
+	if uint64(st.Dev) != dev {
+		return fmt.Errorf("%s: on another filesystem", p)
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := removeSameDevice(filepath.Join(p, name), dev); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(p)
+}
+
+// within reports whether path p is dir or below it.
+func within(dir, p string) bool {
+	dir = filepath.Clean(dir)
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// clearDir removes dir and everything in it, if it exists.
+func clearDir(dir string) error {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dir, err)
+	}
+	return nil
+}
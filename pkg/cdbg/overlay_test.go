@@ -0,0 +1,289 @@
+package cdbg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestNewWorkspaceWorkDir(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		prepare func(ws Workspace) error
+	}{
+		{
+			name:    "new",
+			prepare: func(ws Workspace) error { return nil },
+		},
+		{
+			name:    "empty",
+			prepare: func(ws Workspace) error { return os.MkdirAll(ws.WorkDir(), 0755) },
+		},
+		{
+			name: "populated",
+			prepare: func(ws Workspace) error {
+				// as an earlier overlay leaves it
+				work := filepath.Join(ws.WorkDir(), "work", "#1")
+				if err := os.MkdirAll(work, 0755); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(filepath.Join(work, "f"), []byte("x"), 0644)
+			},
+		},
+		{
+			name: "file",
+			prepare: func(ws Workspace) error {
+				return ioutil.WriteFile(ws.WorkDir(), []byte("x"), 0644)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cdbg-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			ws := Workspace{Dir: dir}
+			if err := tt.prepare(ws); err != nil {
+				t.Fatal(err)
+			}
+			// the upperdir of a reused scratch directory is kept
+			if err := os.MkdirAll(ws.UpperDir(), 0755); err != nil {
+				t.Fatal(err)
+			}
+			kept := filepath.Join(ws.UpperDir(), "kept")
+			if err := ioutil.WriteFile(kept, []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ws, err = NewWorkspace(dir)
+			if err != nil {
+				t.Fatalf("NewWorkspace: %v", err)
+			}
+			names, err := ioutil.ReadDir(ws.WorkDir())
+			if err != nil {
+				t.Fatalf("workdir: %v", err)
+			}
+			if len(names) != 0 {
+				t.Errorf("workdir has %d entries, want none", len(names))
+			}
+			if _, err := os.Stat(kept); err != nil {
+				t.Errorf("upperdir: %v", err)
+			}
+			for _, d := range []string{ws.DebugRoot(), ws.Root(), ws.FIFODir(), filepath.Join(ws.MountpointDir(), TargetPath)} {
+				if fi, err := os.Stat(d); err != nil || !fi.IsDir() {
+					t.Errorf("%s is not a directory: %v", d, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOverlayOptions(t *testing.T) {
+	ws := Workspace{Dir: "/ws"}
+	for _, tt := range []struct {
+		readOnly bool
+		layering string
+		want     []string
+	}{
+		{
+			readOnly: true,
+			want:     []string{"lowerdir=/ws/mnt:/ws/dbg:/target"},
+		},
+		{
+			readOnly: true,
+			layering: LayeringTargetOverDebug,
+			want:     []string{"lowerdir=/ws/mnt:/target:/ws/dbg"},
+		},
+		{
+			want: []string{"lowerdir=/ws/mnt:/target", "upperdir=/ws/upperdir", "workdir=/ws/workdir"},
+		},
+		{
+			layering: LayeringDebugOverTarget,
+			want:     []string{"lowerdir=/ws/mnt:/ws/dbg:/target", "upperdir=/ws/upperdir", "workdir=/ws/workdir"},
+		},
+	} {
+		got := OverlayOptions(ws, "/target", tt.readOnly, tt.layering)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("OverlayOptions(readOnly=%v, %q) = %q, want %q", tt.readOnly, tt.layering, got, tt.want)
+		}
+	}
+}
+
+func TestMakeMountpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdbg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mnt, dbg, target := filepath.Join(dir, "mnt"), filepath.Join(dir, "dbg"), filepath.Join(dir, "target")
+	// the debug image has /etc and a /var/run symlink, the target /app
+	for _, d := range []string{mnt, filepath.Join(dbg, "etc"), filepath.Join(dbg, "var"), filepath.Join(target, "app")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/run", filepath.Join(dbg, "var", "run")); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "dlv")
+	if err := ioutil.WriteFile(file, []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := []specs.Mount{
+		{Destination: "/data", Type: "bind", Source: dir, Options: []string{"rbind", "ro"}},
+		{Destination: "/.cdbg/dlv", Type: "bind", Source: file, Options: []string{"rbind", "ro"}},
+		{Destination: "/scratch", Type: "tmpfs", Source: "tmpfs"},
+		{Destination: "/etc/app", Type: "bind", Source: dir, Options: []string{"rbind"}},
+		{Destination: "/app", Type: "bind", Source: dir, Options: []string{"rbind"}},
+		{Destination: "/var/run/secrets", Type: "bind", Source: dir, Options: []string{"rbind"}},
+	}
+	if err := makeMountpoints(mnt, []string{dbg, target}, mounts); err != nil {
+		t.Fatalf("makeMountpoints: %v", err)
+	}
+	for _, tt := range []struct {
+		path string
+		dir  bool
+	}{
+		{path: "data", dir: true},
+		{path: ".cdbg/dlv"},
+		{path: "scratch", dir: true},
+		{path: "etc/app", dir: true},
+	} {
+		fi, err := os.Lstat(filepath.Join(mnt, tt.path))
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if fi.IsDir() != tt.dir || !fi.IsDir() && fi.Size() != 0 {
+			t.Errorf("%s: mode %v, size %d; want a directory %v", tt.path, fi.Mode(), fi.Size(), tt.dir)
+		}
+	}
+	// the target has it, and laying it out would shadow the symlink
+	for _, path := range []string{"app", "var"} {
+		if _, err := os.Lstat(filepath.Join(mnt, path)); !os.IsNotExist(err) {
+			t.Errorf("%s was laid out: %v", path, err)
+		}
+	}
+}
+
+// TestSessionMountpoints checks that the mounts cdbg adds to the debug
+// container have their mountpoints laid out over a debug image without
+// them, as a read-only overlay needs.
+func TestSessionMountpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdbg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "exe")
+	if err := ioutil.WriteFile(exe, []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	volume, err := ParseVolume(dir + ":/data:ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileMount, err := ParseMount("type=bind,src=" + exe + ",dst=/etc/app.conf,ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfs, err := ParseTmpfs("/scratch:size=64m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		cfg  func(cfg *Config)
+		opts []oci.SpecOpts
+		path string
+		dir  bool
+	}{
+		{
+			name: "init",
+			cfg:  func(cfg *Config) { cfg.AsPID1, cfg.InitBinary = true, exe },
+			path: InitPath,
+		},
+		{
+			name: "logs",
+			opts: []oci.SpecOpts{withTargetLogs(dir)},
+			path: LogsPath,
+			dir:  true,
+		},
+		{
+			// as cdbg dlv mounts the host's dlv
+			name: "file bind",
+			cfg: func(cfg *Config) {
+				cfg.Mounts = []specs.Mount{{Destination: "/.cdbg/dlv", Type: "bind", Source: exe, Options: []string{"rbind", "ro"}}}
+			},
+			path: "/.cdbg/dlv",
+		},
+		{
+			// as cdbg coredump mounts the directory gcore writes to
+			name: "directory bind",
+			cfg: func(cfg *Config) {
+				cfg.Mounts = []specs.Mount{{Destination: "/.cdbg/core", Type: "bind", Source: dir, Options: []string{"rbind", "rw"}}}
+			},
+			path: "/.cdbg/core",
+			dir:  true,
+		},
+		{
+			name: "volume",
+			cfg: func(cfg *Config) {
+				cfg.Mounts = []specs.Mount{volume}
+			},
+			path: "/data",
+			dir:  true,
+		},
+		{
+			name: "file mount",
+			cfg: func(cfg *Config) {
+				cfg.Mounts = []specs.Mount{fileMount}
+			},
+			path: "/etc/app.conf",
+		},
+		{
+			name: "tmpfs",
+			cfg:  func(cfg *Config) { cfg.Mounts = []specs.Mount{tmpfs} },
+			path: "/scratch",
+			dir:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := Workspace{Dir: filepath.Join(dir, tt.name)}
+			if err := makeSubDirs(ws.MountpointDir(), ws.DebugRoot()); err != nil {
+				t.Fatal(err)
+			}
+			cfg := DefaultConfig()
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			ctx, spec := newSpec(t)
+			opts := append([]oci.SpecOpts{DebugSpec(cfg, nil, ws.Root(), &oci.Spec{}, 42)}, tt.opts...)
+			for _, o := range opts {
+				if err := o(ctx, nil, &containers.Container{ID: "test"}, spec); err != nil {
+					t.Fatalf("spec: %v", err)
+				}
+			}
+			if err := makeMountpoints(ws.MountpointDir(), []string{ws.DebugRoot()}, spec.Mounts); err != nil {
+				t.Fatalf("makeMountpoints: %v", err)
+			}
+			fi, err := os.Stat(filepath.Join(ws.MountpointDir(), tt.path))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.path, err)
+			}
+			if fi.IsDir() != tt.dir {
+				t.Errorf("%s: mode %v; want a directory %v", tt.path, fi.Mode(), tt.dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/go-digest"
+)
+
+// persistLabel marks committed debug image snapshots kept by PersistView.
+// The value is the image reference the snapshot was created from.
+const persistLabel = "cdbg.persist"
+
+// persistKey names the persisted view of ref for platform; the default
+// platform is left out, keeping the keys of earlier versions.
+func persistKey(ref, platform string) string {
+	id := normalizeRef(ref)
+	if platform != "" {
+		id += "@" + platform
+	}
+	return "cdbg-persist-" + digest.FromString(id).Hex()
+}
+
+// loadPersistedView returns the key of a previously persisted snapshot for
+// ref and platform and the matching local image, or an empty key and nil
+// image if there is nothing to reuse.
+func loadPersistedView(ctx context.Context, client *containerd.Client, ss snapshots.Snapshotter, ref, platform string) (string, containerd.Image) {
+	key := persistKey(ref, platform)
+	info, err := ss.Stat(ctx, key)
+	if err != nil {
+		return "", nil
+	}
+	// only reuse a view committed on top of an image's chain ID
+	if _, err := digest.Parse(info.Parent); err != nil {
+		log.G(ctx).Debugf("persisted view %s: parent %q: %v", key, info.Parent, err)
+		return "", nil
+	}
+	// image config (entrypoint, env) still comes from the local image
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return "", nil
+	}
+	p, err := platformMatcher(platform)
+	if err != nil {
+		return "", nil
+	}
+	return key, containerd.NewImageWithPlatform(client, img, p)
+}
+
+// createPersistedView commits a snapshot on top of parent under a stable key
+// for ref, so later runs can view it directly.
+func createPersistedView(ctx context.Context, ss snapshots.Snapshotter, ref, platform, parent string) (string, error) {
+	key := persistKey(ref, platform)
+	active := key + "-active"
+	if _, err := ss.Prepare(ctx, active, parent); err != nil {
+		return "", fmt.Errorf("prepare: %v", err)
+	}
+	labels := map[string]string{
+		persistLabel: ref,
+		// keep the snapshot from being garbage collected
+		"containerd.io/gc.root": time.Now().UTC().Format(time.RFC3339),
+	}
+	err := ss.Commit(ctx, key, active, snapshots.WithLabels(labels))
+	if err != nil {
+		ss.Remove(ctx, active)
+		return "", fmt.Errorf("commit: %v", err)
+	}
+	return key, nil
+}
+
+// PrunePersistedViews removes every snapshot kept by Config.PersistView and
+// returns their keys.
+func PrunePersistedViews(ctx context.Context, ss snapshots.Snapshotter) ([]string, error) {
+	var keys []string
+	err := ss.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if _, ok := info.Labels[persistLabel]; ok {
+			keys = append(keys, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for n, key := range keys {
+		if err := ss.Remove(ctx, key); err != nil {
+			return keys[:n], fmt.Errorf("remove: %s: %v", key, err)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,106 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+)
+
+// KubernetesNamespace is the containerd namespace of the CRI plugin, which
+// holds the containers of Kubernetes pods.
+const KubernetesNamespace = "k8s.io"
+
+// Labels the CRI plugin puts on the containers it creates.
+const (
+	podNameLabel       = "io.kubernetes.pod.name"
+	podNamespaceLabel  = "io.kubernetes.pod.namespace"
+	containerNameLabel = "io.kubernetes.container.name"
+	podUIDLabel        = "io.kubernetes.pod.uid"
+	criKindLabel       = "io.cri-containerd.kind"
+)
+
+// ParsePod splits a pod reference, [namespace/]pod[/container], into its
+// Kubernetes namespace, pod name and container name. A container given
+// separately as container takes precedence.
+func ParsePod(ref, container string) (ns, pod, name string) {
+	parts := strings.Split(ref, "/")
+	switch len(parts) {
+	case 1:
+		pod = parts[0]
+	case 2:
+		pod, name = parts[0], parts[1]
+	default:
+		ns, pod, name = parts[0], parts[1], strings.Join(parts[2:], "/")
+	}
+	if container != "" {
+		name = container
+	}
+	return ns, pod, name
+}
+
+// ResolvePod finds the container name of the Kubernetes pod in Kubernetes
+// namespace ns; ns and name may be empty to match any. Pod sandboxes are
+// never matched, and when a container has been restarted the running
+// instance wins over exited ones. Several matches result in an
+// *AmbiguousError.
+func ResolvePod(ctx context.Context, client *containerd.Client, ns, pod, name string) (containerd.Container, error) {
+	match := []string{
+		fmt.Sprintf("labels.%q==%q", podNameLabel, pod),
+		fmt.Sprintf("labels.%q==%q", criKindLabel, "container"),
+	}
+	if ns != "" {
+		match = append(match, fmt.Sprintf("labels.%q==%q", podNamespaceLabel, ns))
+	}
+	if name != "" {
+		match = append(match, fmt.Sprintf("labels.%q==%q", containerNameLabel, name))
+	}
+	// separate filters are ORed; the fields of a single one are ANDed
+	cs, err := client.Containers(ctx, strings.Join(match, ","))
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "containers")
+	}
+
+	var candidates, running []containers.Container
+	for _, c := range cs {
+		info, err := c.Info(ctx)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "info: %s", c.ID())
+		}
+		candidates = append(candidates, info)
+		if t, err := c.Task(ctx, nil); err == nil {
+			if s, err := t.Status(ctx); err == nil && s.Status == containerd.Running {
+				running = append(running, info)
+			}
+		}
+	}
+	if len(running) > 0 {
+		candidates = running
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	query := pod
+	if ns != "" {
+		query = ns + "/" + query
+	}
+	if name != "" {
+		query += "/" + name
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, newError(ErrTargetNotFound, errdefs.ErrNotFound, "pod %s", query)
+	case 1:
+		c, err := client.LoadContainer(ctx, candidates[0].ID)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "load %s", candidates[0].ID)
+		}
+		return c, nil
+	}
+	return nil, &AmbiguousError{Query: query, Candidates: candidates}
+}
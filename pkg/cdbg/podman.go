@@ -0,0 +1,62 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PodmanAddress is the socket of the API service of rootful podman.
+const PodmanAddress = "/run/podman/podman.sock"
+
+// libpodAPIVersion is the version of the libpod endpoints used, which
+// podman 2 and later serve.
+const libpodAPIVersion = "v2.0.0"
+
+// podmanClient talks to the API service of podman: the libpod endpoints
+// to find targets, and the Docker-compatible ones to run the debug
+// container.
+type podmanClient struct {
+	*dockerClient
+	libpod *dockerClient
+}
+
+// NewPodmanBackend returns the Backend for podman, whose API service
+// (podman system service) listens at address. If empty, that is
+// PodmanAddress for root and the socket in $XDG_RUNTIME_DIR for rootless
+// podman. As with NewDockerBackend, the debug image runs in the target's
+// pid, net and ipc namespaces.
+func NewPodmanBackend(address string) Backend {
+	if address == "" {
+		address = PodmanAddress
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+			address = filepath.Join(dir, "podman", "podman.sock")
+		}
+	}
+	p := &podmanClient{
+		dockerClient: newDockerClient(address),
+		libpod:       newDockerClient(address),
+	}
+	p.daemon, p.cli = "podman", "podman"
+	p.libpod.prefix = "/" + libpodAPIVersion + "/libpod"
+	return p
+}
+
+func (p *podmanClient) Target(ctx context.Context, query string) (*Target, error) {
+	var c dockerContainer
+	err := p.libpod.do(ctx, "GET", "/containers/"+query+"/json", nil, nil, &c)
+	if isDockerNotFound(err) {
+		return nil, newError(ErrTargetNotFound, err, "%s", query)
+	}
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "inspect %s", query)
+	}
+	t := c.target()
+	// the merged directory of rootless podman is in its own mount
+	// namespace, not ours
+	if _, err := os.Stat(t.Rootfs); err != nil && t.Pid != 0 {
+		t.Rootfs = fmt.Sprintf("/proc/%d/root", t.Pid)
+	}
+	return t, nil
+}
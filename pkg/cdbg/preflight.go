@@ -0,0 +1,104 @@
+package cdbg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// CheckPrivileges verifies up front that cdbg may join the namespaces of
+// pid, instead of letting the runtime fail later with an opaque error.
+func CheckPrivileges(pid uint32, joined []specs.LinuxNamespaceType) error {
+	if os.Geteuid() != 0 {
+		ok, err := hasCapability(unix.CAP_SYS_ADMIN)
+		if err != nil {
+			return newError(ErrPermission, err, "capabilities")
+		}
+		if !ok {
+			return newError(ErrPermission, errors.New("cdbg must run as root or with CAP_SYS_ADMIN"), "insufficient privileges")
+		}
+	}
+	for _, ns := range joined {
+		path := nsPath(pid, ns)
+		f, err := os.Open(path)
+		if err != nil {
+			return newError(ErrPermission, err, "insufficient privileges to join %s namespace", nsProcNames[ns])
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// capabilityNames lists the Linux capabilities by number.
+var capabilityNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER",
+	"CAP_FSETID", "CAP_KILL", "CAP_SETGID", "CAP_SETUID",
+	"CAP_SETPCAP", "CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER",
+	"CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD",
+	"CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ",
+}
+
+// boundedCapabilities splits caps into those in the bounding set of this
+// process, which the runtime can grant, and those it cannot. Names it does
+// not know are passed through for the runtime to judge.
+func boundedCapabilities(caps []string) (granted, missing []string, err error) {
+	bnd, err := capabilitySet("CapBnd")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range caps {
+		n := -1
+		for i, c := range capabilityNames {
+			if c == name {
+				n = i
+			}
+		}
+		if n >= 0 && bnd&(1<<uint(n)) == 0 {
+			missing = append(missing, name)
+			continue
+		}
+		granted = append(granted, name)
+	}
+	return granted, missing, nil
+}
+
+// hasCapability reports whether capability c is in the effective set of this process.
+func hasCapability(c int) (bool, error) {
+	set, err := capabilitySet("CapEff")
+	if err != nil {
+		return false, err
+	}
+	return set&(1<<uint(c)) != 0, nil
+}
+
+// capabilitySet reads the named capability mask (CapEff, CapBnd, ...) of
+// this process from /proc/self/status.
+func capabilitySet(name string) (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) == 2 && kv[0] == name {
+			return strconv.ParseUint(strings.TrimSpace(kv[1]), 16, 64)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s not found in /proc/self/status", name)
+}
@@ -0,0 +1,81 @@
+package cdbg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Process is a process in a target's PID namespace, as found by Processes.
+type Process struct {
+	// Pid is the process ID on the host, NSPid that in the PID namespace
+	// it was found in, which is what a tool joining it attaches to
+	Pid   uint32 `json:"pid"`
+	NSPid uint32 `json:"nspid"`
+	// Comm is the process's command name
+	Comm string `json:"comm"`
+}
+
+// Processes returns the processes in the PID namespace of pid, such as a
+// target's task, ordered by Pid. If filter is not empty only those whose
+// command name contains it are returned.
+func Processes(pid uint32, filter string) ([]Process, error) {
+	ns, err := os.Readlink(nsPath(pid, specs.PIDNamespace))
+	if err != nil {
+		return nil, newError(ErrPermission, err, "PID namespace of %d", pid)
+	}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var procs []Process
+	for _, e := range entries {
+		n, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		p := Process{Pid: uint32(n)}
+		// processes come and go while we look; skip those that went
+		if other, err := os.Readlink(nsPath(p.Pid, specs.PIDNamespace)); err != nil || other != ns {
+			continue
+		}
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", p.Pid))
+		if err != nil {
+			continue
+		}
+		p.Comm = strings.TrimSpace(string(b))
+		if filter != "" && !strings.Contains(p.Comm, filter) {
+			continue
+		}
+		if p.NSPid, err = namespacePid(p.Pid); err != nil {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	return procs, nil
+}
+
+// namespacePid returns the ID of process pid in its own PID namespace, the
+// last of the NSpid line of its status. Kernels before 4.1 lack the line,
+// which leaves pid as it is.
+func namespacePid(pid uint32) (uint32, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "NSpid:" {
+			continue
+		}
+		n, err := strconv.ParseUint(f[len(f)-1], 10, 32)
+		return uint32(n), err
+	}
+	return pid, nil
+}
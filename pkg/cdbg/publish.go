@@ -0,0 +1,144 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// PublishedPort forwards TCP connections to a local address to a port on
+// localhost in the network namespace of the debug process.
+type PublishedPort struct {
+	HostIP        string
+	HostPort      int
+	ContainerPort int
+}
+
+func (p PublishedPort) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.HostIP, p.HostPort, p.ContainerPort)
+}
+
+// ParsePublish parses a docker-style [host-ip:]host-port:container-port
+// port to publish. Without a host IP it listens on 127.0.0.1 only.
+func ParsePublish(s string) (PublishedPort, error) {
+	p := PublishedPort{HostIP: "127.0.0.1"}
+	s = strings.TrimSuffix(s, "/tcp")
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return p, fmt.Errorf("%s: want [host-ip:]host-port:container-port", s)
+	}
+	host, container := s[:i], s[i+1:]
+	if j := strings.LastIndex(host, ":"); j >= 0 {
+		p.HostIP = strings.Trim(host[:j], "[]")
+		host = host[j+1:]
+	}
+	var err error
+	if p.HostPort, err = parsePort(host); err != nil {
+		return p, fmt.Errorf("%s: host port: %v", s, err)
+	}
+	if p.ContainerPort, err = parsePort(container); err != nil {
+		return p, fmt.Errorf("%s: container port: %v", s, err)
+	}
+	return p, nil
+}
+
+func parsePort(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("%d is out of range", n)
+	}
+	return n, nil
+}
+
+// publish listens on the host address of p and forwards each connection to
+// the container port of p in the network namespace of pid, until the
+// returned listener is closed.
+func publish(ctx context.Context, p PublishedPort, pid uint32) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(p.HostIP, strconv.Itoa(p.HostPort)))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go forward(ctx, conn, pid, p.ContainerPort)
+		}
+	}()
+	return l, nil
+}
+
+// forward copies between conn and a connection to port in the network
+// namespace of pid until both are done.
+func forward(ctx context.Context, conn net.Conn, pid uint32, port int) {
+	defer conn.Close()
+	remote, err := dialInNamespace(ctx, pid, port)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("publish: connect to port %d", port)
+		return
+	}
+	defer remote.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, conn)
+		closeWrite(remote)
+		close(done)
+	}()
+	io.Copy(conn, remote)
+	closeWrite(conn)
+	<-done
+}
+
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+}
+
+// dialInNamespace connects to port on localhost in the network namespace
+// of pid. The socket belongs to the namespace the thread was in when it
+// was created, so the thread enters the namespace just for that.
+func dialInNamespace(ctx context.Context, pid uint32, port int) (net.Conn, error) {
+	runtime.LockOSThread()
+	self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	defer self.Close()
+	target, err := os.Open(nsPath(pid, specs.NetworkNamespace))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	defer target.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	var d net.Dialer
+	conn, dialErr := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err := unix.Setns(int(self.Fd()), unix.CLONE_NEWNET); err != nil {
+		// the thread stays locked, and so is discarded with the goroutine
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	runtime.UnlockOSThread()
+	return conn, dialErr
+}
@@ -0,0 +1,150 @@
+package cdbg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newResolver returns the resolver used to pull the debug image.
+func newResolver(ctx context.Context, cfg Config) (remotes.Resolver, error) {
+	transport := newTransport(ctx, cfg.Proxy)
+	host := imageHost(cfg.Image)
+	insecure, plainHTTP := registryInsecurity(cfg.InsecureRegistries, host)
+	if insecure || cfg.RegistryCA != "" {
+		tlsConfig, err := registryTLSConfig(cfg.RegistryCA, insecure)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if insecure {
+		log.G(ctx).Debugf("registry %s is insecure (plain http: %v)", host, plainHTTP)
+	}
+	return docker.NewResolver(docker.ResolverOptions{
+		Credentials: cfg.credentials,
+		PlainHTTP:   plainHTTP,
+		Client: &http.Client{
+			Transport: transport,
+		},
+	}), nil
+}
+
+// imageHost returns the registry host of ref, or "" if it does not parse.
+func imageHost(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
+
+// registryInsecurity reports whether host is one of the insecure
+// registries, and whether it was listed as http://host to use plain HTTP
+// rather than TLS without verification.
+func registryInsecurity(insecure []string, host string) (skipVerify, plainHTTP bool) {
+	for _, r := range insecure {
+		switch {
+		case r == host:
+			return true, false
+		case r == "http://"+host:
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// registryTLSConfig trusts the system roots plus the PEM certificates in
+// caFile, if set, or skips verification altogether if insecure.
+func registryTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	if insecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("registry CA: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("registry CA: no certificates in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// newTransport returns the HTTP transport for registry requests. Fields of
+// override that are set take precedence over the proxy environment.
+func newTransport(ctx context.Context, override httpproxy.Config) *http.Transport {
+	proxy := httpproxy.FromEnvironment()
+	if override.HTTPProxy != "" {
+		proxy.HTTPProxy = override.HTTPProxy
+	}
+	if override.HTTPSProxy != "" {
+		proxy.HTTPSProxy = override.HTTPSProxy
+	}
+	if override.NoProxy != "" {
+		proxy.NoProxy = override.NoProxy
+	}
+	log.G(ctx).Debugf("registry proxy: http=%q https=%q no_proxy=%q",
+		redactProxy(proxy.HTTPProxy), redactProxy(proxy.HTTPSProxy), proxy.NoProxy)
+	proxyFunc := proxy.ProxyFunc()
+
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := proxyFunc(req.URL)
+			if err != nil {
+				// an invalid proxy address is quoted in the error whole
+				msg := err.Error()
+				for _, p := range []string{proxy.HTTPProxy, proxy.HTTPSProxy} {
+					if p != "" {
+						msg = strings.Replace(msg, p, redactProxy(p), -1)
+					}
+				}
+				return nil, errors.New(msg)
+			}
+			return u, nil
+		},
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 5 * time.Second,
+	}
+}
+
+// redactProxy returns the proxy address with the credentials in its
+// userinfo, if any, replaced. The address need not have a scheme.
+func redactProxy(proxy string) string {
+	scheme, rest := "", proxy
+	if i := strings.Index(proxy, "://"); i >= 0 {
+		scheme, rest = proxy[:i+3], proxy[i+3:]
+	}
+	host := rest
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		host = rest[:i]
+	}
+	at := strings.LastIndexByte(host, '@')
+	if at < 0 {
+		return proxy
+	}
+	return scheme + "xxxxx" + rest[at:]
+}
@@ -0,0 +1,192 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// AmbiguousError is returned by ResolveContainer when a query matches more
+// than one container.
+type AmbiguousError struct {
+	Query      string
+	Candidates []containers.Container
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("%s matches %d containers", e.Query, len(e.Candidates))
+}
+
+// nerdctlNameLabel is the name nerdctl gives a container.
+const nerdctlNameLabel = "nerdctl/name"
+
+// ContainerName returns the human-readable name of the container with
+// labels, as nerdctl or Kubernetes named it, or "" if it has none. The name
+// of a Kubernetes container is pod/container.
+func ContainerName(labels map[string]string) string {
+	if name := labels[nerdctlNameLabel]; name != "" {
+		return name
+	}
+	if pod, name := labels[podNameLabel], labels[containerNameLabel]; pod != "" && name != "" {
+		return pod + "/" + name
+	}
+	return ""
+}
+
+// ResolveContainer finds the container identified by query. An exact ID
+// always wins; otherwise any container whose ID starts with query is a
+// candidate. Failing those, a container whose name (see ContainerName) is
+// query wins, and any whose name contains query is a candidate. Several
+// candidates result in an *AmbiguousError listing them, sorted by ID.
+func ResolveContainer(ctx context.Context, client *containerd.Client, query string) (containerd.Container, error) {
+	c, err := client.LoadContainer(ctx, query)
+	if err == nil {
+		return c, nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return nil, newError(ErrContainerd, err, "load %s", query)
+	}
+
+	all, err := client.Containers(ctx)
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "containers")
+	}
+	var candidates, named, exact []containers.Container
+	for _, c := range all {
+		info, err := c.Info(ctx)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "info: %s", c.ID())
+		}
+		if strings.HasPrefix(c.ID(), query) {
+			candidates = append(candidates, info)
+			continue
+		}
+		name := ContainerName(info.Labels)
+		switch {
+		case name == query:
+			exact = append(exact, info)
+		case name != "" && strings.Contains(name, query):
+			named = append(named, info)
+		}
+	}
+	// an ID prefix is the more deliberate choice
+	if len(candidates) == 0 {
+		candidates = exact
+		if len(exact) == 0 {
+			candidates = named
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	switch len(candidates) {
+	case 0:
+		return nil, newError(ErrTargetNotFound, errdefs.ErrNotFound, "%s", query)
+	case 1:
+		c, err := client.LoadContainer(ctx, candidates[0].ID)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "load %s", candidates[0].ID)
+		}
+		return c, nil
+	}
+	return nil, &AmbiguousError{Query: query, Candidates: candidates}
+}
+
+// FindNamespace searches every containerd namespace for the container
+// identified by query, as ResolveContainer would, and returns the one
+// namespace that has it.
+func FindNamespace(ctx context.Context, client *containerd.Client, query string) (string, error) {
+	all, err := client.NamespaceService().List(ctx)
+	if err != nil {
+		return "", newError(ErrContainerd, err, "namespaces")
+	}
+	var found []string
+	for _, ns := range all {
+		_, err := ResolveContainer(namespaces.WithNamespace(ctx, ns), client, query)
+		if KindOf(err) == ErrTargetNotFound {
+			continue
+		}
+		// an ambiguous prefix is left for the caller to resolve within ns
+		if err != nil && KindOf(err) != ErrAmbiguousTarget {
+			return "", newError(KindOf(err), err, "namespace %s", ns)
+		}
+		found = append(found, ns)
+	}
+	switch len(found) {
+	case 0:
+		return "", newError(ErrTargetNotFound, errdefs.ErrNotFound, "%s: in any namespace", query)
+	case 1:
+		return found[0], nil
+	}
+	return "", newError(ErrAmbiguousTarget,
+		fmt.Errorf("found in namespaces %s; choose one with -namespace", strings.Join(found, ", ")), "%s", query)
+}
+
+// ParseFilter turns a target selector, label=key[=value] or image=name,
+// into a containerd filter. An image selector matches any image reference
+// containing name.
+func ParseFilter(s string) (string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return "", newError(ErrInvalidConfig, fmt.Errorf("want label=key[=value] or image=name"), "filter %q", s)
+	}
+	switch kv[0] {
+	case "label":
+		label := strings.SplitN(kv[1], "=", 2)
+		key := "labels." + strconv.Quote(label[0])
+		if len(label) == 1 {
+			return key, nil
+		}
+		return key + "==" + strconv.Quote(label[1]), nil
+	case "image":
+		return "image~=" + strconv.Quote(regexp.QuoteMeta(kv[1])), nil
+	}
+	return "", newError(ErrInvalidConfig, fmt.Errorf("unknown selector %s", kv[0]), "filter %q", s)
+}
+
+// ResolveFilter finds the container matching all of the target selectors,
+// see ParseFilter. Several matches result in an *AmbiguousError listing
+// them, sorted by ID, unless first is set; then the first of them wins.
+func ResolveFilter(ctx context.Context, client *containerd.Client, selectors []string, first bool) (containerd.Container, error) {
+	var filters []string
+	for _, s := range selectors {
+		f, err := ParseFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	query := strings.Join(selectors, ",")
+	// within one filter, comma-separated terms must all match
+	all, err := client.Containers(ctx, strings.Join(filters, ","))
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "containers: %s", query)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ID() < all[j].ID()
+	})
+	switch {
+	case len(all) == 0:
+		return nil, newError(ErrTargetNotFound, errdefs.ErrNotFound, "no container matches %s", query)
+	case len(all) == 1 || first:
+		return all[0], nil
+	}
+	var candidates []containers.Container
+	for _, c := range all {
+		info, err := c.Info(ctx)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "info: %s", c.ID())
+		}
+		candidates = append(candidates, info)
+	}
+	return nil, &AmbiguousError{Query: query, Candidates: candidates}
+}
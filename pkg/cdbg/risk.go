@@ -0,0 +1,56 @@
+package cdbg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// mutatingNamespaces are the namespaces whose shared state (interfaces,
+// mounts, hostname, IPC objects...) the debug process can change for the
+// target by joining them.
+var mutatingNamespaces = map[specs.LinuxNamespaceType]bool{
+	specs.NetworkNamespace: true,
+	specs.MountNamespace:   true,
+	specs.IPCNamespace:     true,
+	specs.UTSNamespace:     true,
+	specs.UserNamespace:    true,
+	specs.CgroupNamespace:  true,
+}
+
+// Risks describes the ways a session with cfg could affect its target
+// beyond observing it. An empty result means the session is read-only and
+// unprivileged.
+func Risks(cfg Config) []string {
+	var risks []string
+	if cfg.Privileged {
+		risks = append(risks, "privileged: all capabilities and host devices")
+	}
+	for _, c := range cfg.capabilities() {
+		if cfg.Privileged {
+			break
+		}
+		if c == "CAP_SYS_ADMIN" {
+			risks = append(risks, "privileged: the debug process has CAP_SYS_ADMIN")
+			break
+		}
+	}
+	if cfg.UnmaskProc && !cfg.Privileged {
+		risks = append(risks, "unmasked /proc and /sys")
+	}
+	if !cfg.ReadOnly {
+		risks = append(risks, "read-write: the debug root filesystem is writable")
+	}
+	var shared []string
+	for _, ns := range cfg.Namespaces {
+		if mutatingNamespaces[ns] {
+			shared = append(shared, nsProcNames[ns])
+		}
+	}
+	if len(shared) > 0 {
+		risks = append(risks, fmt.Sprintf("shares the target's %s namespaces, changes there affect the target",
+			strings.Join(shared, ", ")))
+	}
+	return risks
+}
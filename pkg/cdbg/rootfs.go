@@ -0,0 +1,132 @@
+package cdbg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// bundleRoots are where containerd keeps the bundles of tasks, by runtime
+// version, under its default state directory; a relative root path in a
+// spec is relative to the bundle.
+var bundleRoots = []string{
+	"/run/containerd/io.containerd.runtime.v2.task",
+	"/run/containerd/io.containerd.runtime.v1.linux",
+}
+
+// targetRootfs returns a host path of the root filesystem of the target
+// described by info and spec, with main process pid, or 0 if it is stopped
+// and has no snapshot to mount. The spec's root path can be relative to
+// the task's bundle, or mounted only in the mount namespace of a shim, so
+// for a running target a candidate is used only if it is the root of pid;
+// failing that, the root is reached through /proc/<pid>/root.
+func targetRootfs(ctx context.Context, info containers.Container, spec *oci.Spec, pid uint32) (string, error) {
+	var candidates []string
+	if spec.Root != nil && spec.Root.Path != "" {
+		if filepath.IsAbs(spec.Root.Path) {
+			candidates = append(candidates, spec.Root.Path)
+		} else if ns, err := namespaces.NamespaceRequired(ctx); err == nil {
+			for _, root := range bundleRoots {
+				candidates = append(candidates, filepath.Join(root, ns, info.ID, spec.Root.Path))
+			}
+		}
+	}
+
+	if pid == 0 {
+		// with no snapshot, an unmounted root is at best an empty directory
+		for _, path := range candidates {
+			if nonEmptyDir(path) {
+				return path, nil
+			}
+		}
+		return "", newError(ErrMountFailed, errors.New("no snapshot, and its root path is not on the host"), "target %s root filesystem", info.ID)
+	}
+
+	proc := fmt.Sprintf("/proc/%d/root", pid)
+	root, err := os.Stat(proc)
+	if err != nil {
+		return "", newError(ErrPermission, err, "target %s root filesystem", info.ID)
+	}
+	for _, path := range candidates {
+		if fi, err := os.Stat(path); err == nil && os.SameFile(fi, root) {
+			return path, nil
+		}
+		log.G(ctx).Debugf("root path %s is not the target's root", path)
+	}
+	return proc, nil
+}
+
+// nonEmptyDir reports whether path is a directory with anything in it.
+func nonEmptyDir(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == nil
+}
+
+// readOnlyRoot reports whether the target's root filesystem, root in its
+// spec and at path on the host, is read-only: a read-only root is mounted
+// read-only wherever it can be, so the debug session does not make an
+// immutable target writable.
+func readOnlyRoot(root *specs.Root, path string) bool {
+	return root != nil && root.Readonly || readOnlyMount(path)
+}
+
+// readOnlyMount reports whether path is on a read-only mount.
+func readOnlyMount(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	// ST_RDONLY has the value of MS_RDONLY
+	return st.Flags&unix.MS_RDONLY != 0
+}
+
+// readOnlyMounts returns mounts, as a snapshotter gives them, changed to
+// mount read-only: an overlay's upperdir becomes its top lowerdir, so
+// neither it nor the workdir need be writable, or not in use by another
+// overlay.
+func readOnlyMounts(mounts []mount.Mount) []mount.Mount {
+	ro := make([]mount.Mount, len(mounts))
+	for i, m := range mounts {
+		var upper, lower string
+		var opts []string
+		for _, o := range m.Options {
+			switch {
+			case strings.HasPrefix(o, "upperdir="):
+				upper = strings.TrimPrefix(o, "upperdir=")
+			case strings.HasPrefix(o, "lowerdir="):
+				lower = strings.TrimPrefix(o, "lowerdir=")
+			case strings.HasPrefix(o, "workdir="), o == "rw":
+			default:
+				opts = append(opts, o)
+			}
+		}
+		if m.Type == "overlay" && upper != "" {
+			if lower != "" {
+				upper += ":" + lower
+			}
+			lower = upper
+		}
+		if lower != "" {
+			opts = append(opts, "lowerdir="+lower)
+		}
+		m.Options = append(opts, "ro")
+		ro[i] = m
+	}
+	return ro
+}
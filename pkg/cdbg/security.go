@@ -0,0 +1,128 @@
+package cdbg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Seccomp profiles for Config.Seccomp, besides the path of a JSON profile.
+const (
+	// SeccompDefault is containerd's default profile
+	SeccompDefault = "default"
+	// SeccompUnconfined filters no syscalls
+	SeccompUnconfined = "unconfined"
+)
+
+// WithSeccomp sets the seccomp profile of the debug process: SeccompDefault,
+// SeccompUnconfined or the path of a profile in the runtime spec's JSON
+// format. An empty profile leaves the spec as it is.
+func WithSeccomp(profile string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		switch profile {
+		case "":
+			return nil
+		case SeccompDefault:
+			return seccomp.WithDefaultProfile()(ctx, client, c, spec)
+		case SeccompUnconfined:
+			spec.Linux.Seccomp = nil
+			return nil
+		}
+		s, err := loadSeccompProfile(profile)
+		if err != nil {
+			return err
+		}
+		spec.Linux.Seccomp = s
+		return nil
+	}
+}
+
+func loadSeccompProfile(path string) (*specs.LinuxSeccomp, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("seccomp profile: %v", err)
+	}
+	var s specs.LinuxSeccomp
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("seccomp profile %s: %v", path, err)
+	}
+	return &s, nil
+}
+
+// AppArmorUnconfined runs the debug process without an AppArmor profile.
+const AppArmorUnconfined = "unconfined"
+
+// WithAppArmorProfile confines the debug process to the named AppArmor
+// profile, or AppArmorUnconfined. An empty name leaves the spec as it is.
+func WithAppArmorProfile(name string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if name != "" {
+			spec.Process.ApparmorProfile = name
+		}
+		return nil
+	}
+}
+
+// checkAppArmorProfile verifies that the named profile is loaded, so a
+// typo fails before the runtime does. Hosts whose profiles cannot be read
+// are given the benefit of the doubt.
+func checkAppArmorProfile(name string) error {
+	if name == "" || name == AppArmorUnconfined {
+		return nil
+	}
+	b, err := ioutil.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// "name (enforce)"
+		if i := strings.LastIndex(line, " ("); i >= 0 && line[:i] == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("apparmor profile %q is not loaded", name)
+}
+
+// SELinuxTarget, as Config.SELinuxLabel, gives the debug process the
+// target's process and mount labels, so it can read the target's files
+// and ptrace its processes.
+const SELinuxTarget = "target"
+
+// WithSELinuxLabels sets the SELinux label of the debug process and of its
+// mounts; SELinuxTarget copies both from target. Empty labels are left as
+// they are, and disable clears both so the runtime applies none.
+func WithSELinuxLabels(process, mount string, disable bool, target *oci.Spec) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		if disable {
+			spec.Process.SelinuxLabel = ""
+			spec.Linux.MountLabel = ""
+			return nil
+		}
+		if process == SELinuxTarget {
+			if target.Process != nil {
+				spec.Process.SelinuxLabel = target.Process.SelinuxLabel
+			}
+			if target.Linux != nil && mount == "" {
+				spec.Linux.MountLabel = target.Linux.MountLabel
+			}
+		} else if process != "" {
+			spec.Process.SelinuxLabel = process
+		}
+		if mount != "" {
+			spec.Linux.MountLabel = mount
+		}
+		return nil
+	}
+}
+
+// validSELinuxLabel reports whether label looks like user:role:type:level.
+func validSELinuxLabel(label string) bool {
+	return len(strings.SplitN(label, ":", 4)) == 4
+}
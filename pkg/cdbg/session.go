@@ -0,0 +1,295 @@
+package cdbg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/console"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Session is a debug session for programs that embed cdbg. New finds the
+// target, Start runs the debug process in the background, Attach connects
+// streams to it until it ends, and Close ends it and removes what it
+// created.
+type Session struct {
+	cfg     Config
+	backend Backend
+	target  *Target
+	// stdin feeds the debug process, if it has stdin
+	stdin     *io.PipeWriter
+	openStdin bool
+
+	mu sync.Mutex
+	// stdout and stderr are the streams attached, nil when detached
+	stdout, stderr io.Writer
+	// disconnect stops the copying of the attached stdin
+	disconnect func()
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	code   int
+	err    error
+}
+
+// sessionOptions are what an Option sets.
+type sessionOptions struct {
+	cfg       Config
+	backend   string
+	openStdin bool
+}
+
+// Option configures a Session created by New.
+type Option func(*sessionOptions)
+
+// WithBackend finds the target and runs the session with the registered
+// backend name, rather than containerd.
+func WithBackend(name string) Option {
+	return func(o *sessionOptions) { o.backend = name }
+}
+
+// WithImage sets the reference of the debug image.
+func WithImage(ref string) Option {
+	return func(o *sessionOptions) { o.cfg.Image = ref }
+}
+
+// WithCommand runs args instead of the entrypoint and command of the debug
+// image.
+func WithCommand(args ...string) Option {
+	return func(o *sessionOptions) { o.cfg.Command = args }
+}
+
+// WithNamespaces sets the namespaces of the target that the debug process
+// joins, replacing the default of its pid namespace.
+func WithNamespaces(ns ...specs.LinuxNamespaceType) Option {
+	return func(o *sessionOptions) { o.cfg.Namespaces = ns }
+}
+
+// WithMounts adds mounts to the debug container.
+func WithMounts(mounts ...specs.Mount) Option {
+	return func(o *sessionOptions) { o.cfg.Mounts = append(o.cfg.Mounts, mounts...) }
+}
+
+// WithIO attaches stdin, stdout and stderr to the session from its start.
+// Without a stdin here, or WithOpenStdin, the debug process has none and
+// Attach cannot give it one. Streams that are nil are not attached.
+func WithIO(stdin io.Reader, stdout, stderr io.Writer) Option {
+	return func(o *sessionOptions) {
+		o.cfg.Stdin, o.cfg.Stdout, o.cfg.Stderr = stdin, stdout, stderr
+	}
+}
+
+// WithOpenStdin gives the debug process a stdin that only Attach feeds,
+// for sessions that start without streams.
+func WithOpenStdin() Option {
+	return func(o *sessionOptions) { o.openStdin = true }
+}
+
+// WithTTY allocates a terminal for the debug process that follows the
+// size of con, if not nil, which is put in raw mode meanwhile.
+func WithTTY(con console.Console) Option {
+	return func(o *sessionOptions) {
+		o.cfg.TTY = true
+		o.cfg.Console = con
+	}
+}
+
+// WithConfig calls f to change any other part of the session's Config.
+func WithConfig(f func(cfg *Config)) Option {
+	return func(o *sessionOptions) { f(&o.cfg) }
+}
+
+// New finds the target container identified by target, as Config.Target,
+// for a session configured by opts on top of DefaultConfig, but without a
+// TTY and with no streams attached.
+func New(ctx context.Context, target string, opts ...Option) (*Session, error) {
+	o := sessionOptions{cfg: DefaultConfig(), backend: "containerd"}
+	o.cfg.TTY = false
+	o.cfg.Stdin, o.cfg.Stdout, o.cfg.Stderr, o.cfg.Messages = nil, nil, nil, nil
+	o.cfg.Target = target
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.cfg.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := NewBackend(o.backend, o.cfg)
+	if err != nil {
+		return nil, err
+	}
+	t, err := b.Target(ctx, target)
+	if err != nil {
+		if c, ok := b.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
+	}
+	o.cfg.setID(t.ID)
+	return &Session{cfg: o.cfg, backend: b, target: t, openStdin: o.openStdin}, nil
+}
+
+// Start runs the debug process and returns once it is running. The
+// session lasts until the debug process exits, Close is called or ctx is
+// done.
+func (s *Session) Start(ctx context.Context) error {
+	if s.done != nil {
+		return newError(ErrInvalidConfig, errors.New("already started"), "session %s", s.cfg.ID)
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+
+	cfg := s.cfg
+	var stdin io.ReadCloser
+	if cfg.Stdin != nil || s.openStdin {
+		stdin, s.stdin = io.Pipe()
+		cfg.Stdin = stdin
+	}
+	cfg.Stdout = &sessionWriter{s: s}
+	cfg.Stderr = &sessionWriter{s: s, stderr: true}
+	s.connect(s.cfg.Stdin, s.cfg.Stdout, s.cfg.Stderr)
+
+	started := make(chan struct{})
+	var once sync.Once
+	cfg.Events = func(e Event) {
+		if e.Type == EventStarted {
+			once.Do(func() { close(started) })
+		}
+		if s.cfg.Events != nil {
+			s.cfg.Events(e)
+		} else if e.Type == EventMessage && s.cfg.Messages != nil {
+			fmt.Fprintln(s.cfg.Messages, e.Message)
+		}
+	}
+	go func() {
+		s.code, s.err = DebugTarget(ctx, s.backend, s.target, cfg)
+		if stdin != nil {
+			stdin.Close()
+		}
+		close(s.done)
+	}()
+
+	select {
+	case <-started:
+		return nil
+	case <-s.done:
+		return s.err
+	}
+}
+
+// Attach connects stdin, stdout and stderr to the started session in place
+// of those attached before, and waits for it to end, returning the exit
+// code of the debug process. The end of stdin closes the debug process's
+// stdin. When ctx is done the streams are detached and the session runs
+// on.
+func (s *Session) Attach(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if s.done == nil {
+		return 0, newError(ErrInvalidConfig, errors.New("not started"), "session %s", s.cfg.ID)
+	}
+	s.connect(stdin, stdout, stderr)
+	defer s.connect(nil, nil, nil)
+	select {
+	case <-s.done:
+		return s.code, s.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// ID returns the ID of the debug container.
+func (s *Session) ID() string {
+	return s.cfg.ID
+}
+
+// Done returns a channel that is closed when the started session has
+// ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits for the started session to end and returns the exit code of
+// the debug process.
+func (s *Session) Wait() (int, error) {
+	if s.done == nil {
+		return 0, newError(ErrInvalidConfig, errors.New("not started"), "session %s", s.cfg.ID)
+	}
+	<-s.done
+	return s.code, s.err
+}
+
+// Close ends the session, if it was started, killing the debug process and
+// removing what the session created, and releases the backend.
+func (s *Session) Close() error {
+	if s.done != nil {
+		s.cancel()
+		<-s.done
+	}
+	if c, ok := s.backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// connect attaches stdin, stdout and stderr to the session, detaching
+// those attached before.
+func (s *Session) connect(stdin io.Reader, stdout, stderr io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnect != nil {
+		s.disconnect()
+		s.disconnect = nil
+	}
+	s.stdout, s.stderr = stdout, stderr
+	if stdin == nil || s.stdin == nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.disconnect = func() { close(stop) }
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdin.Read(buf)
+			select {
+			case <-stop:
+				// a read pending when detached is dropped
+				return
+			default:
+			}
+			if n > 0 {
+				if _, err := s.stdin.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err == io.EOF {
+				s.stdin.Close()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// sessionWriter writes the output of the debug process to the stream of
+// the session attached at the time, or discards it if there is none.
+type sessionWriter struct {
+	s      *Session
+	stderr bool
+}
+
+func (w *sessionWriter) Write(p []byte) (int, error) {
+	w.s.mu.Lock()
+	out := w.s.stdout
+	if w.stderr {
+		out = w.s.stderr
+	}
+	w.s.mu.Unlock()
+	if out == nil {
+		return len(p), nil
+	}
+	// a detached stream that fails must not end the session
+	out.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,317 @@
+package cdbg
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// targetLabel marks debug containers and their snapshots with the ID of
+// their target, and sessionSnapshotLabel the snapshots of a session with
+// its ID.
+const (
+	targetLabel          = "cdbg.target"
+	sessionSnapshotLabel = "cdbg.session"
+)
+
+// startGrace is how long a session may take to start. Its snapshot,
+// container and workspace exist before its task does, so ones younger than
+// this may be a starting session's rather than left behind.
+const startGrace = 2 * time.Minute
+
+// SessionID returns a new ID for a session against the container target:
+// cdbg-, the start of target's ID and random hex digits, so that sessions
+// against the same target or several do not collide.
+func SessionID(target string) string {
+	if len(target) > 12 {
+		target = target[:12]
+	}
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("cdbg-%s-%x", target, b)
+}
+
+// setID gives cfg a new session ID against target unless it has one.
+func (cfg *Config) setID(target string) {
+	if cfg.ID == "" {
+		cfg.ID = SessionID(target)
+	}
+}
+
+// SessionInfo is a debug container found by ListSessions.
+type SessionInfo struct {
+	ID        string
+	Namespace string
+	Target    string
+	// Image is the debug image, empty in native mode
+	Image   string
+	Created time.Time
+	// Status of the debug task, or "none" if it has none
+	Status string
+}
+
+// ListSessions returns the debug sessions in the namespace of ctx, or in
+// every namespace if all is set.
+func ListSessions(ctx context.Context, client *containerd.Client, all bool) ([]SessionInfo, error) {
+	var nss []string
+	if all {
+		var err error
+		nss, err = client.NamespaceService().List(ctx)
+		if err != nil {
+			return nil, newError(ErrContainerd, err, "namespaces")
+		}
+	} else {
+		ns, err := namespaces.NamespaceRequired(ctx)
+		if err != nil {
+			return nil, newError(ErrInvalidConfig, err, "namespace")
+		}
+		nss = append(nss, ns)
+	}
+
+	var sessions []SessionInfo
+	for _, ns := range nss {
+		ctx := namespaces.WithNamespace(ctx, ns)
+		cs, err := client.Containers(ctx, fmt.Sprintf("labels.%q", targetLabel))
+		if err != nil {
+			return sessions, newError(ErrContainerd, err, "containers: %s", ns)
+		}
+		for _, c := range cs {
+			info, err := c.Info(ctx)
+			if err != nil {
+				return sessions, newError(ErrContainerd, err, "session %s", c.ID())
+			}
+			s := SessionInfo{
+				ID:        c.ID(),
+				Namespace: ns,
+				Target:    info.Labels[targetLabel],
+				Image:     info.Image,
+				Created:   info.CreatedAt,
+				Status:    "none",
+			}
+			if t, err := c.Task(ctx, nil); err == nil {
+				if st, err := t.Status(ctx); err == nil {
+					s.Status = string(st.Status)
+				}
+			}
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// RemoveSession removes the debug session id and everything it holds. A
+// running session is only removed, killing its debug process, if force is
+// set.
+func RemoveSession(ctx context.Context, client *containerd.Client, id string, force bool) error {
+	c, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		return newError(ErrTargetNotFound, err, "session %s", id)
+	}
+	if _, ok, err := sessionOf(ctx, c); err != nil || !ok {
+		if err == nil {
+			err = errors.New("not a debug session")
+		}
+		return newError(ErrInvalidConfig, err, "%s", id)
+	}
+	if !force && sessionRunning(ctx, c) {
+		return newError(ErrInvalidConfig, errors.New("session is running; force removal to kill it"), "%s", id)
+	}
+	return cleanupSession(ctx, client, c)
+}
+
+// claimID checks that nothing holds the session ID of cfg: a debug
+// container or snapshot of that name. With cfg.Force, what a session that
+// is gone left behind is removed; a running session is never touched, nor
+// is anything younger than startGrace, which a session may be starting with.
+func claimID(ctx context.Context, client *containerd.Client, ss snapshots.Snapshotter, cfg Config) error {
+	c, err := client.LoadContainer(ctx, cfg.ID)
+	switch {
+	case errdefs.IsNotFound(err):
+	case err != nil:
+		return newError(ErrContainerd, err, "session %s", cfg.ID)
+	default:
+		labels, ok, err := sessionOf(ctx, c)
+		if err != nil {
+			return newError(ErrContainerd, err, "session %s", cfg.ID)
+		}
+		if !ok {
+			return newError(ErrSessionInUse, errors.New("a container that is not a debug session has this ID"), "session %s", cfg.ID)
+		}
+		if sessionRunning(ctx, c) {
+			return newError(ErrSessionInUse, fmt.Errorf("already in use, debugging %s", labels[targetLabel]), "session %s", cfg.ID)
+		}
+		if !cfg.Force {
+			return newError(ErrSessionInUse, errors.New("left behind by a session that is gone; force to reclaim it"), "session %s", cfg.ID)
+		}
+		info, err := c.Info(ctx)
+		if err != nil {
+			return newError(ErrContainerd, err, "session %s", cfg.ID)
+		}
+		if time.Since(info.CreatedAt) < startGrace {
+			return newError(ErrSessionInUse, errors.New("held by a session that may still be starting; try again later"), "session %s", cfg.ID)
+		}
+		cfg.printf("reclaiming session %s, left behind by a session that is gone\n", cfg.ID)
+		if err := cleanupSession(ctx, client, c); err != nil {
+			return err
+		}
+	}
+
+	// a snapshot without a container is of a session that crashed, or one
+	// that has yet to create its container
+	info, err := ss.Stat(ctx, cfg.ID)
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return newError(ErrContainerd, err, "snapshot %s", cfg.ID)
+	}
+	if _, ok := info.Labels[sessionSnapshotLabel]; !ok {
+		return newError(ErrSessionInUse, errors.New("a snapshot that is not a debug session's has this ID"), "session %s", cfg.ID)
+	}
+	if !cfg.Force {
+		return newError(ErrSessionInUse, errors.New("its snapshot is held by a session that is starting or gone; force to reclaim it"), "session %s", cfg.ID)
+	}
+	if time.Since(info.Created) < startGrace {
+		return newError(ErrSessionInUse, errors.New("its snapshot is held by a session that may still be starting; try again later"), "session %s", cfg.ID)
+	}
+	cfg.printf("reclaiming snapshot %s, left behind by a session that is gone\n", cfg.ID)
+	if err := ss.Remove(ctx, cfg.ID); err != nil && !errdefs.IsNotFound(err) {
+		return newError(ErrCleanup, err, "remove: %s", cfg.ID)
+	}
+	return nil
+}
+
+// errInUse is the error of another session taking id first.
+func errInUse(id string) error {
+	return newError(ErrSessionInUse, errors.New("already in use"), "session %s", id)
+}
+
+// sessionOf returns the labels of c if it is a debug container.
+func sessionOf(ctx context.Context, c containerd.Container) (map[string]string, bool, error) {
+	labels, err := c.Labels(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	_, ok := labels[targetLabel]
+	return labels, ok, nil
+}
+
+// PruneSessions removes what crashed or killed sessions left behind in
+// the namespace of ctx: debug containers without a running task, with
+// their mounts, snapshots and workspaces, snapshots in ss of sessions
+// whose container is gone, and workspace mounts no session uses. Anything
+// younger than startGrace is left to the session that may be starting
+// with it. It returns what it removed.
+func PruneSessions(ctx context.Context, client *containerd.Client, ss snapshots.Snapshotter) ([]string, error) {
+	var removed []string
+	live := map[string]bool{}
+	workspaces := map[string]bool{}
+	cs, err := client.Containers(ctx, fmt.Sprintf("labels.%q", targetLabel))
+	if err != nil {
+		return nil, newError(ErrContainerd, err, "containers")
+	}
+	for _, c := range cs {
+		labels, err := c.Labels(ctx)
+		if err != nil {
+			return removed, newError(ErrContainerd, err, "session %s", c.ID())
+		}
+		info, err := c.Info(ctx)
+		if err != nil {
+			return removed, newError(ErrContainerd, err, "session %s", c.ID())
+		}
+		if sessionRunning(ctx, c) || time.Since(info.CreatedAt) < startGrace {
+			live[c.ID()] = true
+			workspaces[labels[workspaceLabel]] = true
+			continue
+		}
+		if err := cleanupSession(ctx, client, c); err != nil {
+			return removed, err
+		}
+		removed = append(removed, "session "+c.ID())
+	}
+
+	var orphans []string
+	err = ss.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if id, ok := info.Labels[sessionSnapshotLabel]; ok && !live[id] && time.Since(info.Created) >= startGrace {
+			orphans = append(orphans, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, newError(ErrContainerd, err, "snapshots")
+	}
+	for _, key := range orphans {
+		if err := ss.Remove(ctx, key); err != nil && !errdefs.IsNotFound(err) {
+			return removed, newError(ErrCleanup, err, "remove: %s", key)
+		}
+		removed = append(removed, "snapshot "+key)
+	}
+
+	mounts, err := mount.Self()
+	if err != nil {
+		return removed, newError(ErrCleanup, err, "mounts")
+	}
+	// deepest first, so loop mounts go before the root they are under
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+	for _, m := range mounts {
+		ws, ok := workspaceOf(m.Mountpoint)
+		if !ok || workspaces[ws] || recent(ws) {
+			continue
+		}
+		if err := mount.UnmountAll(m.Mountpoint, 0); err != nil {
+			return removed, newError(ErrCleanup, err, "unmount: %s", m.Mountpoint)
+		}
+		removed = append(removed, "mount "+m.Mountpoint)
+	}
+	return removed, nil
+}
+
+// recent reports whether the workspace dir was laid out, or last
+// changed, within startGrace.
+func recent(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && time.Since(fi.ModTime()) < startGrace
+}
+
+// sessionRunning reports whether the debug container c has a live task.
+func sessionRunning(ctx context.Context, c containerd.Container) bool {
+	t, err := c.Task(ctx, nil)
+	if err != nil {
+		return false
+	}
+	st, err := t.Status(ctx)
+	return err == nil && st.Status != containerd.Stopped
+}
+
+// workspaceOf returns the workspace directory of a session mount point:
+// its root, debug root, stopped target or a loop device mount, in a
+// temporary workspace or under StateRoot.
+func workspaceOf(mountpoint string) (string, bool) {
+	dir, base := filepath.Split(mountpoint)
+	dir = filepath.Clean(dir)
+	if filepath.Base(dir) == "loop" {
+		dir, base = filepath.Dir(dir), "loop"
+	}
+	if base != "root" && base != "dbg" && base != "loop" && base != "targetfs" {
+		return "", false
+	}
+	if filepath.Dir(dir) == StateRoot {
+		return dir, true
+	}
+	if filepath.Dir(dir) == filepath.Clean(os.TempDir()) && strings.HasPrefix(filepath.Base(dir), "cdbg") {
+		return dir, true
+	}
+	return "", false
+}
@@ -0,0 +1,215 @@
+package cdbg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// DebugSpec returns the spec options for the debug container: rootfs is
+// the mounted overlay, target the spec of the target container and pid the
+// target's init process, whose namespaces are joined. A nil image (native
+// mode) runs cfg.Command with the target's environment and working
+// directory instead of the image's.
+func DebugSpec(cfg Config, image containerd.Image, rootfs string, target *oci.Spec, pid uint32) oci.SpecOpts {
+	args := withTargetProcess(target, cfg.Command)
+	if image != nil {
+		args = oci.WithImageConfigArgs(image, cfg.Command)
+	}
+
+	opts := []oci.SpecOpts{
+		oci.WithDefaultSpec(),
+		oci.WithRootFSPath(rootfs),
+		args,
+		WithTargetMounts(target, cfg.MountInclude, cfg.MountExclude),
+		oci.WithMounts(cfg.Mounts),
+		oci.WithNoNewPrivileges, // not privileged
+		WithAddedCapabilities(cfg.Capabilities...),
+		WithDroppedCapabilities(cfg.DropCapabilities...),
+	}
+	// joining the target's network namespace replaces either of these
+	if !hasNamespace(cfg.Namespaces, specs.NetworkNamespace) && cfg.Network != NetworkNone {
+		opts = append(opts, oci.WithHostNamespace(specs.NetworkNamespace))
+	}
+	for _, ns := range cfg.Namespaces {
+		opts = append(opts, WithTargetNamespace(pid, ns))
+	}
+	if cfg.Privileged {
+		opts = append(opts, WithPrivileged)
+	} else if cfg.UnmaskProc {
+		opts = append(opts, WithUnmaskedPaths)
+	}
+	opts = append(opts,
+		WithUser(cfg.User, target),
+		WithSeccomp(cfg.Seccomp),
+		WithAppArmorProfile(cfg.AppArmor),
+		WithSELinuxLabels(cfg.SELinuxLabel, cfg.SELinuxMountLabel, cfg.SELinuxDisable, target),
+	)
+	if cfg.TargetCgroup {
+		opts = append(opts, WithTargetCgroup(target))
+	} else {
+		if cfg.MirrorLimits {
+			opts = append(opts, WithTargetLimits(target))
+		}
+		opts = append(opts, WithLimits(cfg.Memory, cfg.CPUs), WithPidsLimit(cfg.PidsLimit))
+	}
+	if cfg.Native && cfg.ReadOnly {
+		opts = append(opts, oci.WithRootFSReadonly())
+	}
+	if cfg.AsPID1 {
+		opts = append(opts, WithInit(cfg.InitBinary))
+	}
+	if cfg.TTY {
+		opts = append(opts, oci.WithTTY)
+	}
+	if cfg.InheritEnv && target.Process != nil {
+		opts = append(opts, oci.WithEnv(target.Process.Env))
+	}
+	if len(cfg.Env) > 0 {
+		opts = append(opts, oci.WithEnv(cfg.Env))
+	}
+	return oci.Compose(opts...)
+}
+
+// WithPrivileged lifts the restrictions of the default spec: the process
+// may gain privileges, /proc and /sys are neither masked nor read-only,
+// /sys and the cgroup filesystem are writable, and the host's devices are
+// available.
+func WithPrivileged(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+	spec.Process.NoNewPrivileges = false
+	if err := WithUnmaskedPaths(ctx, client, c, spec); err != nil {
+		return err
+	}
+	for i, m := range spec.Mounts {
+		if m.Type != "sysfs" && m.Type != "cgroup" {
+			continue
+		}
+		var options []string
+		for _, o := range m.Options {
+			if o != "ro" {
+				options = append(options, o)
+			}
+		}
+		spec.Mounts[i].Options = append(options, "rw")
+	}
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: "/dev",
+		Type:        "bind",
+		Source:      "/dev",
+		Options:     []string{"rbind", "rw"},
+	})
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	spec.Linux.Resources.Devices = []specs.LinuxDeviceCgroup{{Allow: true, Access: "rwm"}}
+	return nil
+}
+
+// WithUnmaskedPaths clears the paths of /proc and /sys the default spec
+// masks or makes read-only, such as /proc/kcore and /sys/firmware, for
+// low-level debugging.
+func WithUnmaskedPaths(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+	spec.Linux.MaskedPaths = nil
+	spec.Linux.ReadonlyPaths = nil
+	return nil
+}
+
+// withTargetProcess runs args with the environment and working directory of
+// the target's process.
+func withTargetProcess(target *oci.Spec, args []string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		spec.Process.Args = args
+		if target.Process != nil {
+			spec.Process.Env = append([]string(nil), target.Process.Env...)
+			spec.Process.Cwd = target.Process.Cwd
+		}
+		return nil
+	}
+}
+
+// WorkDirTarget, as Config.WorkDir, starts the debug process in the
+// current working directory of the target's process.
+const WorkDirTarget = "target"
+
+// workDir resolves dir for the debug process, reading the working
+// directory of pid for WorkDirTarget. Without an overlay the target's
+// files are under targetPath, which is otherwise empty.
+func workDir(dir string, pid uint32, targetPath string) (string, error) {
+	if dir != WorkDirTarget {
+		return dir, nil
+	}
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return "", err
+	}
+	if targetPath != "" {
+		cwd = filepath.Join(targetPath, cwd)
+	}
+	return cwd, nil
+}
+
+// UserTarget, as Config.User, runs the debug process with the
+// credentials of the target's process.
+const UserTarget = "target"
+
+// WithUser runs the debug process as user, a numeric uid[:gid] or
+// UserTarget. An empty user keeps the image's.
+func WithUser(user string, target *oci.Spec) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		switch user {
+		case "":
+			return nil
+		case UserTarget:
+			if target.Process != nil {
+				spec.Process.User = target.Process.User
+			}
+			return nil
+		}
+		uid, gid, err := ParseUser(user)
+		if err != nil {
+			return err
+		}
+		spec.Process.User = specs.User{UID: uid, GID: gid}
+		return nil
+	}
+}
+
+// ParseUser parses a numeric uid[:gid]; the gid defaults to the uid.
+func ParseUser(user string) (uint32, uint32, error) {
+	parts := strings.SplitN(user, ":", 2)
+	uid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q: want uid[:gid] or target", user)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("user %q: want uid[:gid] or target", user)
+		}
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+func WithAddedCapabilities(add ...string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, spec *oci.Spec) error {
+		for _, caps := range []*[]string{
+			&spec.Process.Capabilities.Ambient,
+			&spec.Process.Capabilities.Bounding,
+			&spec.Process.Capabilities.Effective,
+			&spec.Process.Capabilities.Inheritable,
+			&spec.Process.Capabilities.Permitted,
+		} {
+			*caps = append(*caps, add...)
+		}
+		return nil
+	}
+}
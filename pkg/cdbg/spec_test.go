@@ -0,0 +1,245 @@
+package cdbg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseUser(t *testing.T) {
+	for _, tt := range []struct {
+		user     string
+		uid, gid uint32
+		err      bool
+	}{
+		{user: "0", uid: 0, gid: 0},
+		{user: "1000", uid: 1000, gid: 1000},
+		{user: "1000:100", uid: 1000, gid: 100},
+		{user: "", err: true},
+		{user: "root", err: true},
+		{user: "1000:", err: true},
+		{user: "1000:staff", err: true},
+		{user: "-1", err: true},
+		{user: "4294967296", err: true},
+	} {
+		uid, gid, err := ParseUser(tt.user)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseUser(%q) = %d, %d; want an error", tt.user, uid, gid)
+			}
+			continue
+		}
+		if err != nil || uid != tt.uid || gid != tt.gid {
+			t.Errorf("ParseUser(%q) = %d, %d, %v; want %d, %d", tt.user, uid, gid, err, tt.uid, tt.gid)
+		}
+	}
+}
+
+// newSpec returns the default spec the debug container starts from.
+func newSpec(t *testing.T) (context.Context, *oci.Spec) {
+	ctx := namespaces.WithNamespace(context.Background(), "test")
+	var spec oci.Spec
+	if err := oci.WithDefaultSpec()(ctx, nil, &containers.Container{ID: "test"}, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, &spec
+}
+
+func TestWithUser(t *testing.T) {
+	target := &oci.Spec{Process: &specs.Process{User: specs.User{UID: 33, GID: 33, AdditionalGids: []uint32{4}}}}
+	for _, tt := range []struct {
+		user string
+		want specs.User
+		err  bool
+	}{
+		{user: "", want: specs.User{}},
+		{user: UserTarget, want: target.Process.User},
+		{user: "1000", want: specs.User{UID: 1000, GID: 1000}},
+		{user: "1000:100", want: specs.User{UID: 1000, GID: 100}},
+		{user: "nobody", err: true},
+	} {
+		ctx, spec := newSpec(t)
+		err := WithUser(tt.user, target)(ctx, nil, &containers.Container{}, spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("WithUser(%q): want an error", tt.user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("WithUser(%q): %v", tt.user, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec.Process.User, tt.want) {
+			t.Errorf("WithUser(%q) user = %+v, want %+v", tt.user, spec.Process.User, tt.want)
+		}
+	}
+}
+
+func TestDebugSpec(t *testing.T) {
+	target := &oci.Spec{
+		Process: &specs.Process{
+			Env: []string{"PATH=/app/bin", "APP=1"},
+			Cwd: "/app",
+		},
+		Mounts: []specs.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/data", Type: "bind", Source: "/srv/data"},
+			{Destination: "/run/secrets", Type: "bind", Source: "/srv/secrets"},
+		},
+	}
+	for _, tt := range []struct {
+		name  string
+		cfg   func(cfg *Config)
+		check func(t *testing.T, spec *oci.Spec)
+	}{
+		{
+			name: "default",
+			cfg:  func(cfg *Config) {},
+			check: func(t *testing.T, spec *oci.Spec) {
+				if !reflect.DeepEqual(spec.Process.Args, []string{"/bin/bash", "-l"}) {
+					t.Errorf("args = %q", spec.Process.Args)
+				}
+				if !spec.Process.Terminal {
+					t.Error("no terminal")
+				}
+				if !spec.Process.NoNewPrivileges {
+					t.Error("may gain privileges")
+				}
+				if !contains(spec.Process.Capabilities.Effective, "CAP_SYS_PTRACE") {
+					t.Errorf("capabilities = %q", spec.Process.Capabilities.Effective)
+				}
+				if !hasNamespacePath(spec, specs.PIDNamespace, "/proc/42/ns/pid") {
+					t.Errorf("namespaces = %+v", spec.Linux.Namespaces)
+				}
+				if !hasMount(spec, "/data") || !hasMount(spec, "/run/secrets") {
+					t.Errorf("target mounts missing: %+v", spec.Mounts)
+				}
+			},
+		},
+		{
+			name: "native",
+			cfg: func(cfg *Config) {
+				cfg.Native = true
+				cfg.Command = []string{"sh"}
+			},
+			check: func(t *testing.T, spec *oci.Spec) {
+				if !reflect.DeepEqual(spec.Process.Args, []string{"sh"}) {
+					t.Errorf("args = %q", spec.Process.Args)
+				}
+				if !contains(spec.Process.Env, "PATH=/app/bin") || !contains(spec.Process.Env, "APP=1") || spec.Process.Cwd != "/app" {
+					t.Errorf("env = %q, cwd = %q; want the target's", spec.Process.Env, spec.Process.Cwd)
+				}
+				if !spec.Root.Readonly {
+					t.Error("root is writable")
+				}
+			},
+		},
+		{
+			name: "excluded mount",
+			cfg: func(cfg *Config) {
+				cfg.MountExclude = []string{"/run"}
+			},
+			check: func(t *testing.T, spec *oci.Spec) {
+				if !hasMount(spec, "/data") || hasMount(spec, "/run/secrets") {
+					t.Errorf("mounts = %+v", spec.Mounts)
+				}
+			},
+		},
+		{
+			name: "privileged",
+			cfg: func(cfg *Config) {
+				cfg.Privileged = true
+				cfg.TTY = false
+			},
+			check: func(t *testing.T, spec *oci.Spec) {
+				if spec.Process.NoNewPrivileges {
+					t.Error("may not gain privileges")
+				}
+				if spec.Process.Terminal {
+					t.Error("terminal")
+				}
+				if len(spec.Linux.MaskedPaths) != 0 {
+					t.Errorf("masked paths = %q", spec.Linux.MaskedPaths)
+				}
+			},
+		},
+		{
+			name: "unmasked",
+			cfg: func(cfg *Config) {
+				cfg.UnmaskProc = true
+			},
+			check: func(t *testing.T, spec *oci.Spec) {
+				if len(spec.Linux.MaskedPaths) != 0 || len(spec.Linux.ReadonlyPaths) != 0 {
+					t.Errorf("masked paths = %q, read-only paths = %q", spec.Linux.MaskedPaths, spec.Linux.ReadonlyPaths)
+				}
+				for _, m := range spec.Mounts {
+					if m.Type == "sysfs" && !contains(m.Options, "ro") {
+						t.Errorf("sysfs options = %q; want it read-only", m.Options)
+					}
+				}
+			},
+		},
+		{
+			name: "user and env",
+			cfg: func(cfg *Config) {
+				cfg.User = "1000"
+				cfg.Env = []string{"DEBUG=1"}
+			},
+			check: func(t *testing.T, spec *oci.Spec) {
+				if spec.Process.User.UID != 1000 {
+					t.Errorf("user = %+v", spec.Process.User)
+				}
+				if !contains(spec.Process.Env, "DEBUG=1") {
+					t.Errorf("env = %q", spec.Process.Env)
+				}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.cfg(&cfg)
+			ctx, spec := newSpec(t)
+			err := DebugSpec(cfg, nil, "/rootfs", target, 42)(ctx, nil, &containers.Container{ID: "test"}, spec)
+			if err != nil {
+				t.Fatalf("DebugSpec: %v", err)
+			}
+			if spec.Root.Path != "/rootfs" {
+				t.Errorf("root = %q", spec.Root.Path)
+			}
+			tt.check(t, spec)
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNamespacePath(spec *oci.Spec, typ specs.LinuxNamespaceType, path string) bool {
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == typ {
+			return ns.Path == path
+		}
+	}
+	return false
+}
+
+func hasMount(spec *oci.Spec, dest string) bool {
+	for _, m := range spec.Mounts {
+		if m.Destination == dest {
+			return true
+		}
+	}
+	return false
+}
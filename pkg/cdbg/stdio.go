@@ -0,0 +1,72 @@
+package cdbg
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+)
+
+// withStreams is cio.WithStreams for streams that may not be attached:
+// containerd copies the process's stdout (and stderr, without a TTY)
+// whether or not there is a writer for it, so a nil one is discarded.
+func withStreams(stdin io.Reader, stdout, stderr io.Writer) cio.Opt {
+	return cio.WithStreams(stdin, discardIfNil(stdout), discardIfNil(stderr))
+}
+
+// discardIfNil returns w, or a writer that discards all if w is nil, for
+// an output stream that is not attached.
+func discardIfNil(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
+
+// stdinCloser passes stdin through to a process without a TTY and, when it
+// ends, closes the process's stdin so that it reads EOF, as `docker exec -i`
+// does: containerd keeps the FIFO open until told otherwise, and a filter
+// such as `sh` reading a piped script would never exit.
+type stdinCloser struct {
+	r   io.Reader
+	mu  sync.Mutex
+	ctx context.Context
+	p   containerd.Process
+	eof bool
+}
+
+func newStdinCloser(r io.Reader) *stdinCloser {
+	return &stdinCloser{r: r}
+}
+
+func (s *stdinCloser) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		s.mu.Lock()
+		s.eof = true
+		s.closeIO()
+		s.mu.Unlock()
+	}
+	return n, err
+}
+
+// setProcess sets the process to close the stdin of. Stdin is copied from
+// the moment the process's IO is created, so it may already have ended.
+func (s *stdinCloser) setProcess(ctx context.Context, p containerd.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx, s.p = ctx, p
+	s.closeIO()
+}
+
+func (s *stdinCloser) closeIO() {
+	if !s.eof || s.p == nil {
+		return
+	}
+	// the process may be gone already, and then there is nothing to close
+	s.p.CloseIO(s.ctx, containerd.WithStdinCloser)
+	s.p = nil
+}
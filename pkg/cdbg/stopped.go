@@ -0,0 +1,81 @@
+package cdbg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// LogsPath is where the logs of a stopped target appear in the debug
+// container.
+const LogsPath = "/.cdbg/logs"
+
+// targetState returns the task of c and whether c is stopped: it has no
+// task, or its task has exited.
+func targetState(ctx context.Context, c containerd.Container) (containerd.Task, bool, error) {
+	t, err := c.Task(ctx, nil)
+	if errdefs.IsNotFound(err) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, newError(ErrContainerd, err, "target task")
+	}
+	st, err := t.Status(ctx)
+	if err != nil {
+		return nil, false, newError(ErrContainerd, err, "target task")
+	}
+	return t, st.Status == containerd.Stopped, nil
+}
+
+// mountTargetSnapshot mounts the rootfs snapshot of the stopped container
+// described by info at dir, read-only.
+func mountTargetSnapshot(ctx context.Context, client *containerd.Client, info containers.Container, dir string) error {
+	mounts, err := client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return newError(ErrContainerd, err, "target snapshot %s", info.SnapshotKey)
+	}
+	mounts = readOnlyMounts(mounts)
+	if err := makeSubDirs(dir); err != nil {
+		return newError(ErrMountFailed, err, "mkdir")
+	}
+	if err := mount.All(mounts, dir); err != nil {
+		return newError(ErrMountFailed, err, "target snapshot %s", info.SnapshotKey)
+	}
+	return nil
+}
+
+// withTargetLogs bind mounts dir, the logs of a stopped target, at
+// LogsPath, read-only.
+func withTargetLogs(dir string) oci.SpecOpts {
+	return oci.WithMounts([]specs.Mount{{
+		Destination: LogsPath,
+		Type:        "bind",
+		Source:      dir,
+		Options:     []string{"rbind", "ro"},
+	}})
+}
+
+// targetLogDir returns the host directory with the logs of container id,
+// as Docker or the Kubernetes CRI keep them, or "" if there is none.
+func targetLogDir(id string, labels map[string]string) string {
+	var candidates []string
+	if uid := labels[podUIDLabel]; uid != "" {
+		candidates = append(candidates, filepath.Join("/var/log/pods",
+			labels[podNamespaceLabel]+"_"+labels[podNameLabel]+"_"+uid,
+			labels[containerNameLabel]))
+	}
+	candidates = append(candidates, filepath.Join("/var/lib/docker/containers", id))
+	for _, dir := range candidates {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package cdbg
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// DebuginfodAuto, as Config.DebuginfodURLs, uses the debuginfod server of
+// the target's distribution, as its /etc/os-release names it.
+const DebuginfodAuto = "auto"
+
+// distroDebuginfod are the debuginfod servers of distributions by their
+// os-release ID. Ubuntu's serves the contents of its ddebs.
+var distroDebuginfod = map[string]string{
+	"alpine":              "https://debuginfod.alpinelinux.org",
+	"arch":                "https://debuginfod.archlinux.org",
+	"centos":              "https://debuginfod.centos.org",
+	"debian":              "https://debuginfod.debian.net",
+	"fedora":              "https://debuginfod.fedoraproject.org",
+	"opensuse-tumbleweed": "https://debuginfod.opensuse.org",
+	"ubuntu":              "https://debuginfod.ubuntu.com",
+}
+
+// elfutilsDebuginfod federates the servers of many distributions, for
+// targets whose own is unknown.
+const elfutilsDebuginfod = "https://debuginfod.elfutils.org/"
+
+// debuginfodURLs resolves urls for the debug process against the target
+// process pid.
+func debuginfodURLs(urls string, pid uint32) string {
+	if urls != DebuginfodAuto {
+		return urls
+	}
+	if pid == 0 {
+		return elfutilsDebuginfod
+	}
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/root/%s", pid, name))
+		if err != nil {
+			continue
+		}
+		// derivatives name what they are like after their own ID
+		ids := append(osRelease(b, "ID"), osRelease(b, "ID_LIKE")...)
+		for _, id := range ids {
+			if url, ok := distroDebuginfod[id]; ok {
+				return url
+			}
+		}
+		break
+	}
+	return elfutilsDebuginfod
+}
+
+// osRelease returns the words of the variable key of an os-release file.
+func osRelease(b []byte, key string) []string {
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			return strings.Fields(strings.Trim(line[len(key)+1:], `"'`))
+		}
+	}
+	return nil
+}
+
+// setupSymbols points the debug process at debuginfod for the symbols of
+// the target's binaries and, with FetchSymbols, fetches those of the
+// executable of pid into the session before the debug command starts.
+func (cfg *Config) setupSymbols(pid uint32) {
+	urls := debuginfodURLs(cfg.DebuginfodURLs, pid)
+	cfg.Env = append(cfg.Env[:len(cfg.Env):len(cfg.Env)], "DEBUGINFOD_URLS="+urls)
+	if !cfg.FetchSymbols {
+		return
+	}
+	if pid == 0 || len(cfg.Command) == 0 {
+		cfg.printf("warning: symbols are fetched for a running target and an explicit command only; not fetching them\n")
+		return
+	}
+	id, err := BuildID(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		cfg.printf("warning: no build ID for the target's executable (%v); not fetching its symbols\n", err)
+		return
+	}
+	cfg.printf("fetching debug info of build ID %s from %s\n", id, urls)
+	cfg.Command = append([]string{"/bin/sh", "-c",
+		`debuginfod-find debuginfo "$0" >/dev/null || echo "cdbg: no debug info for build ID $0" >&2; exec "$@"`,
+		id}, cfg.Command...)
+}
+
+// BuildID returns the GNU build ID of the ELF file at path, which names
+// its separate debug info for debuginfod and gdb.
+func BuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return "", errors.New("no .note.gnu.build-id section")
+	}
+	b, err := s.Data()
+	if err != nil {
+		return "", err
+	}
+	// a note is namesz, descsz and type, then the name and the
+	// descriptor, each padded to 4 bytes
+	if len(b) < 12 {
+		return "", errors.New("short build ID note")
+	}
+	namesz := int(f.ByteOrder.Uint32(b[0:4]))
+	descsz := int(f.ByteOrder.Uint32(b[4:8]))
+	name := 12 + (namesz+3)&^3
+	if name+descsz > len(b) || !bytes.HasPrefix(b[12:], []byte("GNU\x00")) {
+		return "", errors.New("malformed build ID note")
+	}
+	return hex.EncodeToString(b[name : name+descsz]), nil
+}
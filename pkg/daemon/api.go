@@ -0,0 +1,103 @@
+// Package daemon serves debug sessions over a gRPC API, for node agents
+// and user interfaces that drive cdbg without running it: cdbg serve runs
+// a Server, and Client calls it.
+//
+// The API is the service cdbg.v1.Debug with the messages of this file,
+// encoded as JSON under the gRPC content subtype "json" rather than as
+// protocol buffers, so that it needs no generated code.
+package daemon
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// serviceName is the name of the gRPC service.
+const serviceName = "cdbg.v1.Debug"
+
+// CreateRequest creates and starts a debug session.
+type CreateRequest struct {
+	// Target identifies the container to debug, as cdbg run takes it
+	Target string `json:"target"`
+	// Backend is the registered backend to use, containerd if empty
+	Backend string `json:"backend,omitempty"`
+	// ID of the debug container; the server picks one if empty
+	ID string `json:"id,omitempty"`
+	// Image and Command override those of the server's configuration
+	Image   string   `json:"image,omitempty"`
+	Command []string `json:"command,omitempty"`
+	// Namespaces of the target to join, a comma-separated list as -ns
+	// takes
+	Namespaces string `json:"namespaces,omitempty"`
+	// Volumes are bind mounts, /host/path:/dest[:ro]
+	Volumes []string `json:"volumes,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	// TTY allocates a terminal, and Stdin gives the debug process a stdin
+	// that Attach feeds
+	TTY   bool `json:"tty,omitempty"`
+	Stdin bool `json:"stdin,omitempty"`
+}
+
+// CreateResponse is the started session.
+type CreateResponse struct {
+	ID string `json:"id"`
+}
+
+// ListRequest lists the sessions of the server.
+type ListRequest struct{}
+
+// ListResponse lists the sessions of the server, by ID.
+type ListResponse struct {
+	Sessions []SessionStatus `json:"sessions"`
+}
+
+// SessionStatus is a session of the server.
+type SessionStatus struct {
+	ID      string `json:"id"`
+	Target  string `json:"target"`
+	Backend string `json:"backend"`
+	Running bool   `json:"running"`
+	// ExitCode and Error are those of a session that ended
+	ExitCode int    `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AttachRequest is a message from the client of Attach: the first names
+// the session, and the rest carry stdin until CloseStdin.
+type AttachRequest struct {
+	ID         string `json:"id,omitempty"`
+	Stdin      []byte `json:"stdin,omitempty"`
+	CloseStdin bool   `json:"closeStdin,omitempty"`
+}
+
+// AttachResponse is a message to the client of Attach: output of the
+// debug process, or, last, its exit.
+type AttachResponse struct {
+	Stdout   []byte `json:"stdout,omitempty"`
+	Stderr   []byte `json:"stderr,omitempty"`
+	Exited   bool   `json:"exited,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+}
+
+// DestroyRequest ends a session and removes it.
+type DestroyRequest struct {
+	ID string `json:"id"`
+}
+
+// DestroyResponse is the end of a destroyed session.
+type DestroyResponse struct{}
+
+// codecName is the content subtype of the API.
+const codecName = "json"
+
+// jsonCodec encodes the messages of the API as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return codecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
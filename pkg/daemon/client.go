@@ -0,0 +1,108 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// DefaultAddress is the socket cdbg serve listens on by default.
+const DefaultAddress = "/run/cdbg/cdbg.sock"
+
+// Client calls the API of a Server.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// Dial returns a client of the server listening on the unix socket at
+// address, DefaultAddress if empty. Connecting happens on the first call.
+func Dial(address string) (*Client, error) {
+	if address == "" {
+		address = DefaultAddress
+	}
+	conn, err := grpc.Dial(strings.TrimPrefix(address, "unix://"),
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", addr)
+		}),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Create creates and starts a debug session.
+func (c *Client) Create(ctx context.Context, req *CreateRequest) (*CreateResponse, error) {
+	resp := new(CreateResponse)
+	return resp, c.conn.Invoke(ctx, "/"+serviceName+"/Create", req, resp)
+}
+
+// List lists the sessions of the server.
+func (c *Client) List(ctx context.Context) (*ListResponse, error) {
+	resp := new(ListResponse)
+	return resp, c.conn.Invoke(ctx, "/"+serviceName+"/List", &ListRequest{}, resp)
+}
+
+// Destroy ends the session id and removes it.
+func (c *Client) Destroy(ctx context.Context, id string) error {
+	return c.conn.Invoke(ctx, "/"+serviceName+"/Destroy", &DestroyRequest{ID: id}, new(DestroyResponse))
+}
+
+// Attach connects stdin, stdout and stderr to the session id until it
+// ends, and returns the exit code of the debug process. Stdin, if not nil,
+// is copied to the debug process until it ends, which closes the debug
+// process's stdin. Cancelling ctx detaches.
+func (c *Client) Attach(ctx context.Context, id string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+serviceName+"/Attach")
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.SendMsg(&AttachRequest{ID: id}); err != nil {
+		return 0, err
+	}
+	if stdin != nil {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stdin.Read(buf)
+				if n > 0 {
+					if stream.SendMsg(&AttachRequest{Stdin: buf[:n]}) != nil {
+						return
+					}
+				}
+				if err == io.EOF {
+					stream.SendMsg(&AttachRequest{CloseStdin: true})
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for {
+		var resp AttachResponse
+		if err := stream.RecvMsg(&resp); err != nil {
+			return 0, err
+		}
+		if resp.Exited {
+			return resp.ExitCode, nil
+		}
+		if len(resp.Stdout) > 0 && stdout != nil {
+			stdout.Write(resp.Stdout)
+		}
+		if len(resp.Stderr) > 0 && stderr != nil {
+			stderr.Write(resp.Stderr)
+		}
+	}
+}
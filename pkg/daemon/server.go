@@ -0,0 +1,357 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/slushie/cdbg/pkg/cdbg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server runs the debug sessions created through the API. Sessions
+// outlive the requests and attachments that use them, until they end or
+// are destroyed.
+type Server struct {
+	base cdbg.Config
+	grpc *grpc.Server
+
+	// ctx bounds every session, and cancel ends them
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is a session of the server.
+type session struct {
+	*cdbg.Session
+	target, backend string
+}
+
+// NewServer returns a server whose sessions are configured by base, apart
+// from what a CreateRequest overrides.
+func NewServer(base cdbg.Config) *Server {
+	s := &Server{
+		base:     base,
+		grpc:     grpc.NewServer(),
+		sessions: make(map[string]*session),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.grpc.RegisterService(&serviceDesc, s)
+	return s
+}
+
+// Serve serves the API on l until Close.
+func (s *Server) Serve(l net.Listener) error {
+	return s.grpc.Serve(l)
+}
+
+// Close stops serving, ends every session and removes what they created.
+func (s *Server) Close() error {
+	s.grpc.Stop()
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for id, ss := range s.sessions {
+		if err := ss.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(s.sessions, id)
+	}
+	return first
+}
+
+func (s *Server) create(ctx context.Context, req *CreateRequest) (*CreateResponse, error) {
+	opts := []cdbg.Option{cdbg.WithConfig(func(cfg *cdbg.Config) {
+		*cfg = s.base
+		// the session has no streams until attached
+		cfg.Stdin, cfg.Stdout, cfg.Stderr, cfg.Console = nil, nil, nil, nil
+		cfg.Messages, cfg.Events, cfg.Started, cfg.Resolved = nil, nil, nil, nil
+		cfg.TTY = req.TTY
+		cfg.Env = append(cfg.Env, req.Env...)
+		cfg.Target = req.Target
+		cfg.ID = req.ID
+		if cfg.ID == "" {
+			cfg.ID = newID()
+		}
+	})}
+	backend := req.Backend
+	if backend == "" {
+		backend = "containerd"
+	}
+	opts = append(opts, cdbg.WithBackend(backend))
+	if req.Image != "" {
+		opts = append(opts, cdbg.WithImage(req.Image))
+	}
+	if len(req.Command) > 0 {
+		opts = append(opts, cdbg.WithCommand(req.Command...))
+	}
+	if req.Namespaces != "" {
+		ns, err := cdbg.ParseNamespaces(req.Namespaces)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		opts = append(opts, cdbg.WithNamespaces(ns...))
+	}
+	var mounts []specs.Mount
+	for _, v := range req.Volumes {
+		m, err := cdbg.ParseVolume(v)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		mounts = append(mounts, m)
+	}
+	opts = append(opts, cdbg.WithMounts(mounts...))
+	if req.Stdin {
+		opts = append(opts, cdbg.WithOpenStdin())
+	}
+
+	ds, err := cdbg.New(ctx, req.Target, opts...)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	s.mu.Lock()
+	if _, ok := s.sessions[ds.ID()]; ok {
+		s.mu.Unlock()
+		ds.Close()
+		return nil, status.Errorf(codes.AlreadyExists, "session %s exists", ds.ID())
+	}
+	ss := &session{Session: ds, target: req.Target, backend: backend}
+	s.sessions[ds.ID()] = ss
+	s.mu.Unlock()
+
+	// the session must outlive this request
+	if err := ds.Start(s.ctx); err != nil {
+		s.remove(ds.ID())
+		ds.Close()
+		return nil, statusError(err)
+	}
+	log.G(ctx).Infof("session %s started against %s", ds.ID(), req.Target)
+	return &CreateResponse{ID: ds.ID()}, nil
+}
+
+func (s *Server) list(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &ListResponse{Sessions: []SessionStatus{}}
+	for id, ss := range s.sessions {
+		st := SessionStatus{ID: id, Target: ss.target, Backend: ss.backend, Running: true}
+		select {
+		case <-ss.Done():
+			st.Running = false
+			code, err := ss.Wait()
+			st.ExitCode = code
+			if err != nil {
+				st.Error = err.Error()
+			}
+		default:
+		}
+		resp.Sessions = append(resp.Sessions, st)
+	}
+	sort.Slice(resp.Sessions, func(i, j int) bool { return resp.Sessions[i].ID < resp.Sessions[j].ID })
+	return resp, nil
+}
+
+func (s *Server) destroy(ctx context.Context, req *DestroyRequest) (*DestroyResponse, error) {
+	ss := s.remove(req.ID)
+	if ss == nil {
+		return nil, status.Errorf(codes.NotFound, "session %s not found", req.ID)
+	}
+	if err := ss.Close(); err != nil {
+		return nil, statusError(err)
+	}
+	log.G(ctx).Infof("session %s destroyed", req.ID)
+	return &DestroyResponse{}, nil
+}
+
+// attach connects the stream to a session until it ends, or the client
+// goes away.
+func (s *Server) attach(stream grpc.ServerStream) error {
+	var first AttachRequest
+	if err := stream.RecvMsg(&first); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	ss := s.sessions[first.ID]
+	s.mu.Unlock()
+	if ss == nil {
+		return status.Errorf(codes.NotFound, "session %s not found", first.ID)
+	}
+
+	stdin, stdinW := io.Pipe()
+	defer stdin.Close()
+	go func() {
+		if len(first.Stdin) > 0 {
+			stdinW.Write(first.Stdin)
+		}
+		if first.CloseStdin {
+			stdinW.Close()
+			return
+		}
+		for {
+			var req AttachRequest
+			if err := stream.RecvMsg(&req); err != nil {
+				// the client is done sending or gone, which leaves the
+				// debug process's stdin open: only CloseStdin closes it
+				stdinW.CloseWithError(io.ErrClosedPipe)
+				return
+			}
+			if len(req.Stdin) > 0 {
+				if _, err := stdinW.Write(req.Stdin); err != nil {
+					return
+				}
+			}
+			if req.CloseStdin {
+				stdinW.Close()
+				return
+			}
+		}
+	}()
+
+	out := &streamOutput{stream: stream}
+	code, err := ss.Attach(stream.Context(), stdin, out.writer(false), out.writer(true))
+	if err != nil {
+		return statusError(err)
+	}
+	return out.send(&AttachResponse{Exited: true, ExitCode: code})
+}
+
+// remove forgets the session id and returns it, if the server has it.
+func (s *Server) remove(id string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss := s.sessions[id]
+	delete(s.sessions, id)
+	return ss
+}
+
+// streamOutput sends the output of a session on an Attach stream, which
+// takes one message at a time.
+type streamOutput struct {
+	mu     sync.Mutex
+	stream grpc.ServerStream
+}
+
+func (o *streamOutput) send(resp *AttachResponse) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stream.SendMsg(resp)
+}
+
+func (o *streamOutput) writer(stderr bool) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		b := append([]byte(nil), p...)
+		resp := &AttachResponse{Stdout: b}
+		if stderr {
+			resp = &AttachResponse{Stderr: b}
+		}
+		if err := o.send(resp); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// statusError returns err with the gRPC status code of its kind.
+func statusError(err error) error {
+	code := codes.Unknown
+	switch cdbg.KindOf(err) {
+	case cdbg.ErrInvalidConfig:
+		code = codes.InvalidArgument
+	case cdbg.ErrTargetNotFound:
+		code = codes.NotFound
+	case cdbg.ErrAmbiguousTarget, cdbg.ErrTargetNotRunning:
+		code = codes.FailedPrecondition
+	case cdbg.ErrPermission:
+		code = codes.PermissionDenied
+	case cdbg.ErrSessionInUse:
+		code = codes.AlreadyExists
+	}
+	if err == context.Canceled {
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
+
+// newID returns a random ID for a session.
+func newID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("random ID: %v", err))
+	}
+	return "cdbg-" + hex.EncodeToString(b)
+}
+
+// serviceDesc describes the API to gRPC, as generated code would.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Create",
+			Handler: unaryHandler("Create", func() interface{} { return new(CreateRequest) },
+				func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+					return s.create(ctx, req.(*CreateRequest))
+				}),
+		},
+		{
+			MethodName: "List",
+			Handler: unaryHandler("List", func() interface{} { return new(ListRequest) },
+				func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+					return s.list(ctx, req.(*ListRequest))
+				}),
+		},
+		{
+			MethodName: "Destroy",
+			Handler: unaryHandler("Destroy", func() interface{} { return new(DestroyRequest) },
+				func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+					return s.destroy(ctx, req.(*DestroyRequest))
+				}),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Attach",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*Server).attach(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// unaryHandler returns the gRPC handler of the unary method, which decodes
+// the request made by newReq and passes it to call.
+func unaryHandler(method string, newReq func() interface{}, call func(*Server, context.Context, interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(*Server), ctx, req)
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+		return interceptor(ctx, req, info, handler)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+var (
+	profilePid      uint
+	profileDuration = 30 * time.Second
+	profileOut      = "flame.svg"
+)
+
+func profileFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Image, "image", config.Image, "Reference of a debug image with perf")
+	fs.UintVar(&profilePid, "pid", profilePid, "Profile this process, by its PID in the target (default: the target's main process)")
+	fs.DurationVar(&profileDuration, "duration", profileDuration, "How long to sample for")
+	fs.StringVar(&profileOut, "out", profileOut, "Write the flame graph here, or the collapsed stacks unless it ends in .svg")
+}
+
+// profileCommand samples a process of the target with perf, as -perf
+// does, and renders the stacks as a flame graph on the host.
+func profileCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 1 {
+		usage("profile")
+	}
+	c, err := resolveContainer(ctx, client, args[0])
+	if err != nil {
+		failErr(err, "load container: %v", err)
+	}
+	p := targetProcess(ctx, c, uint32(profilePid))
+
+	var stacks bytes.Buffer
+	finish := recordPerf(int(p.NSPid), profileDuration, &stacks)
+	if err := config.Validate(); err != nil {
+		failErr(err, "%v", err)
+	}
+	debug(ctx, client, c)
+	if err := finish(); err != nil {
+		fail("profile: %v", err)
+	}
+	if stacks.Len() == 0 {
+		fail("profile: perf recorded no samples")
+	}
+
+	f, err := os.OpenFile(profileOut, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fail("profile: %v", err)
+	}
+	defer f.Close()
+	if strings.HasSuffix(profileOut, ".svg") {
+		title := fmt.Sprintf("%s: %s (pid %d), %s", c.ID(), p.Comm, p.NSPid, profileDuration)
+		err = writeFlamegraph(f, &stacks, title)
+	} else {
+		_, err = io.Copy(f, &stacks)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		fail("profile: %v", err)
+	}
+	status("wrote %s\n", profileOut)
+}
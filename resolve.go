@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/console"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+// resolveContainer resolves query like cdbg.ResolveContainer, but when it is
+// ambiguous asks the user to pick a candidate if stdin is a terminal, and
+// returns an error listing them otherwise.
+func resolveContainer(ctx context.Context, client *containerd.Client, query string) (containerd.Container, error) {
+	c, err := cdbg.ResolveContainer(ctx, client, query)
+	return pickAmbiguous(ctx, client, c, err)
+}
+
+// resolvePod resolves -pod and -c like cdbg.ResolvePod, asking the user to
+// pick when it is ambiguous.
+func resolvePod(ctx context.Context, client *containerd.Client) (containerd.Container, error) {
+	ns, pod, name := cdbg.ParsePod(config.Pod, podContainer)
+	c, err := cdbg.ResolvePod(ctx, client, ns, pod, name)
+	return pickAmbiguous(ctx, client, c, err)
+}
+
+// pickAmbiguous passes through the result of a lookup, unless err is an
+// *cdbg.AmbiguousError to resolve by asking the user.
+func pickAmbiguous(ctx context.Context, client *containerd.Client, c containerd.Container, err error) (containerd.Container, error) {
+	ambiguous, ok := err.(*cdbg.AmbiguousError)
+	if !ok {
+		return c, err
+	}
+	candidates := ambiguous.Candidates
+	if _, err := console.ConsoleFromFile(os.Stdin); err != nil {
+		return nil, &cdbg.Error{
+			Kind: cdbg.ErrAmbiguousTarget,
+			Err:  fmt.Errorf("%s is ambiguous:\n%s", ambiguous.Query, formatCandidates(candidates)),
+		}
+	}
+	picked, err := pickCandidate(os.Stdin, os.Stderr, candidates)
+	if err != nil {
+		return nil, err
+	}
+	return client.LoadContainer(ctx, picked.ID)
+}
+
+func formatCandidates(candidates []containers.Container) string {
+	var b strings.Builder
+	for n, info := range candidates {
+		name := cdbg.ContainerName(info.Labels)
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(&b, "%3d) %s\t%s\t%s\t%s\n", n+1, info.ID, name, info.Image, formatLabels(info.Labels))
+	}
+	return b.String()
+}
+
+func formatLabels(labels map[string]string) string {
+	var kv []string
+	for k, v := range labels {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+// pickCandidate prompts on w and reads a 1-based choice from r.
+func pickCandidate(r io.Reader, w io.Writer, candidates []containers.Container) (containers.Container, error) {
+	fmt.Fprint(w, formatCandidates(candidates))
+	for {
+		fmt.Fprintf(w, "select container [1-%d]: ", len(candidates))
+		line, err := readLine(r)
+		if err != nil {
+			return containers.Container{}, fmt.Errorf("no container selected")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err == nil && n >= 1 && n <= len(candidates) {
+			return candidates[n-1], nil
+		}
+	}
+}
+
+// targetPid returns the host PID of the running task of c, failing if it
+// has none.
+func targetPid(ctx context.Context, c containerd.Container) uint32 {
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		exitCode = exitCodes[cdbg.ErrTargetNotRunning]
+		fail("%s has no running task: %v", c.ID(), err)
+	}
+	return task.Pid()
+}
+
+// pickProcess returns the single process of procs, the what found in c.
+// Given none or several it fails, listing them and the flag to pick with.
+func pickProcess(c containerd.Container, procs []cdbg.Process, what, hint string) cdbg.Process {
+	switch len(procs) {
+	case 0:
+		fail("no %s in %s", what, c.ID())
+	case 1:
+		return procs[0]
+	}
+	var b strings.Builder
+	for _, p := range procs {
+		fmt.Fprintf(&b, "%8d %s\n", p.NSPid, p.Comm)
+	}
+	exitCode = exitCodes[cdbg.ErrAmbiguousTarget]
+	fail("%s runs several %s, pick one with %s:\n%s", c.ID(), what, hint, b.String())
+	return cdbg.Process{}
+}
+
+// targetProcess returns the process of c whose PID in the target is pid,
+// or its main process if pid is 0, failing if there is none.
+func targetProcess(ctx context.Context, c containerd.Container, pid uint32) cdbg.Process {
+	task := targetPid(ctx, c)
+	procs, err := cdbg.Processes(task, "")
+	if err != nil {
+		failErr(err, "%v", err)
+	}
+	for _, p := range procs {
+		if (pid == 0 && p.Pid == task) || (pid != 0 && p.NSPid == pid) {
+			return p
+		}
+	}
+	fail("no process %d in %s", pid, c.ID())
+	return cdbg.Process{}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd"
+	"github.com/slushie/cdbg/pkg/daemon"
+)
+
+var serveAddress = daemon.DefaultAddress
+
+func serveFlags(fs *flag.FlagSet) {
+	registryFlags(fs)
+	fs.StringVar(&serveAddress, "listen", serveAddress, "Unix socket to serve the gRPC API on")
+	fs.StringVar(&config.Image, "image", config.Image, "Debug image of sessions that name none")
+}
+
+// serveCommand runs the daemon until it is signalled, then ends the
+// sessions it still has.
+func serveCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) != 0 {
+		usage("serve")
+	}
+	readRegistryFlags()
+	// every session connects on its own
+	client.Close()
+
+	if err := os.MkdirAll(filepath.Dir(serveAddress), 0700); err != nil {
+		fail("serve: %v", err)
+	}
+	// left behind by a daemon that died
+	os.Remove(serveAddress)
+	l, err := net.Listen("unix", serveAddress)
+	if err != nil {
+		fail("serve: %v", err)
+	}
+	// sessions run as root, so only root may create them
+	if err := os.Chmod(serveAddress, 0600); err != nil {
+		fail("serve: %v", err)
+	}
+
+	s := daemon.NewServer(config)
+	closed := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		closed <- s.Close()
+	}()
+	status("serving on %s\n", serveAddress)
+	if err := s.Serve(l); err != nil {
+		fail("serve: %v", err)
+	}
+	if err := <-closed; err != nil {
+		failErr(err, "serve: %v", err)
+	}
+}
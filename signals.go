@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// forwardedSignals are passed on to the debug process while it runs rather
+// than interrupting cdbg, as ctr and nerdctl do. SIGINT is only forwarded
+// without a TTY: in a raw terminal ctrl-c reaches the process as input.
+var forwardedSignals = []os.Signal{unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGQUIT, unix.SIGUSR1, unix.SIGUSR2}
+
+// signalProxy forwards signals to the running debug process, if any.
+type signalProxy struct {
+	mu sync.Mutex
+	p  containerd.Process
+}
+
+var proxy signalProxy
+
+// set makes p the process to forward signals to, or stops forwarding if p
+// is nil.
+func (s *signalProxy) set(p containerd.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.p = p
+}
+
+// forward sends sig to the debug process, and reports whether it did.
+func (s *signalProxy) forward(ctx context.Context, sig os.Signal) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.p == nil {
+		return false
+	}
+	if sig == unix.SIGINT && config.TTY {
+		return false
+	}
+	if err := s.p.Kill(ctx, sig.(syscall.Signal)); err != nil {
+		logrus.WithError(err).Debugf("forward %v", sig)
+	}
+	return true
+}
+
+// handleSignals forwards signals to the debug process while it runs and
+// otherwise cancels ctx, so cdbg stops and cleans up.
+func handleSignals(ctx context.Context, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	config.Started = proxy.set
+	go func() {
+		for sig := range signals {
+			if proxy.forward(ctx, sig) {
+				continue
+			}
+			status("%v\n", sig)
+			cancel()
+			return
+		}
+	}()
+}
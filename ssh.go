@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	sshHost string
+	sshCdbg string
+	sshSudo = true
+)
+
+// sshFlags are the flags that select remote mode, and are not passed on.
+var sshFlags = map[string]bool{"ssh": true, "ssh-cdbg": true, "ssh-sudo": true}
+
+// unameMachines are what uname -m says on the architectures whose cdbg
+// binary can be copied to a node.
+var unameMachines = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"386":     "i686",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// runSSH runs the session on sshHost instead: it makes sure the node has
+// this cdbg, unless -ssh-cdbg names one there, and replaces cdbg with ssh
+// running it with args, so that the TTY and exit status come back as they
+// would locally.
+func runSSH(args []string) {
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		fail("ssh: %v", err)
+	}
+	remote := sshCdbg
+	if remote == "" {
+		remote, err = copyToNode(sshHost)
+		if err != nil {
+			fail("ssh: %v", err)
+		}
+	}
+
+	command := []string{shellQuote(remote), "run"}
+	if sshSudo {
+		command = append([]string{"sudo"}, command...)
+	}
+	for _, a := range withoutSSHFlags(args) {
+		command = append(command, shellQuote(a))
+	}
+	sshArgs := []string{"ssh", "-T"}
+	if isTerminal(os.Stdin) && config.TTY {
+		sshArgs = []string{"ssh", "-t"}
+	}
+	sshArgs = append(sshArgs, sshHost, strings.Join(command, " "))
+	logrus.WithField("args", sshArgs).Debug("running on node")
+	err = unix.Exec(sshPath, sshArgs, os.Environ())
+	fail("ssh: %v", err)
+}
+
+// copyToNode copies this executable to the home directory of the ssh user
+// on host, named after its hash so that it is copied once per build, and
+// returns its path there.
+func copyToNode(host string) (string, error) {
+	machine, ok := unameMachines[runtime.GOARCH]
+	if runtime.GOOS != "linux" || !ok {
+		return "", fmt.Errorf("cannot copy cdbg for %s/%s to a node; install cdbg there and give its path with -ssh-cdbg", runtime.GOOS, runtime.GOARCH)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	path := ".cache/cdbg/cdbg-" + hex.EncodeToString(h.Sum(nil))[:12]
+
+	// exit status 3 is a node of another architecture
+	script := fmt.Sprintf(`test -x %[1]s && exit 0
+[ "$(uname -m)" = %[2]s ] || { uname -m; exit 3; }
+mkdir -p .cache/cdbg && cat > %[1]s.tmp && chmod 0755 %[1]s.tmp && mv %[1]s.tmp %[1]s`, path, machine)
+	var stderr bytes.Buffer
+	cmd := exec.Command("ssh", "-T", host, script)
+	cmd.Stdin = f
+	cmd.Stdout = &stderr
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 3 {
+			return "", fmt.Errorf("%s is %s, not %s; install cdbg there and give its path with -ssh-cdbg", host, strings.TrimSpace(stderr.String()), machine)
+		}
+		return "", fmt.Errorf("copy cdbg to %s: %v: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+	return path, nil
+}
+
+// withoutSSHFlags returns args without the flags of remote mode, which
+// the cdbg on the node must not see.
+func withoutSSHFlags(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || !strings.HasPrefix(a, "-") {
+			// the container and command follow
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(a, "-")
+		value := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if !sshFlags[name] {
+			out = append(out, a)
+			if f := flag.CommandLine.Lookup(name); f != nil && !value && !isBoolFlag(f) && i+1 < len(args) {
+				i++
+				out = append(out, args[i])
+			}
+			continue
+		}
+		if f := flag.CommandLine.Lookup(name); !value && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return out
+}
+
+// isBoolFlag reports whether f takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strconv"
+
+	"github.com/containerd/containerd"
+	"github.com/slushie/cdbg/pkg/cdbg"
+)
+
+var (
+	stracePid  uint
+	straceName string
+)
+
+func straceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Image, "image", config.Image, "Reference of a debug image with strace")
+	fs.UintVar(&stracePid, "pid", stracePid, "Trace this process, by its PID in the target (default: the target's main process)")
+	fs.StringVar(&straceName, "name", straceName, "Trace the process whose command name contains this")
+}
+
+// straceCommand traces a process of the target with strace, from a debug
+// container in its PID namespace, until strace or the process ends. The
+// arguments after the container are strace's, -f if there are none.
+func straceCommand(ctx context.Context, client *containerd.Client, args []string) {
+	if len(args) == 0 {
+		usage("strace")
+	}
+	if stracePid != 0 && straceName != "" {
+		fail("strace: -pid and -name are exclusive")
+	}
+	c, err := resolveContainer(ctx, client, args[0])
+	if err != nil {
+		failErr(err, "load container: %v", err)
+	}
+	pid := uint32(stracePid)
+	if pid == 0 {
+		task := targetPid(ctx, c)
+		procs, err := cdbg.Processes(task, straceName)
+		if err != nil {
+			failErr(err, "strace: %v", err)
+		}
+		what := "processes named " + strconv.Quote(straceName)
+		if straceName == "" {
+			// just the target's main process
+			what = "main processes"
+			for _, p := range procs {
+				if p.Pid == task {
+					procs = []cdbg.Process{p}
+				}
+			}
+		}
+		pid = pickProcess(c, procs, what, "-pid").NSPid
+	}
+
+	straceArgs := args[1:]
+	if len(straceArgs) > 0 && straceArgs[0] == "--" {
+		// flag parsing stops at the container, before it
+		straceArgs = straceArgs[1:]
+	}
+	if len(straceArgs) == 0 {
+		straceArgs = []string{"-f"}
+	}
+	config.Command = toolCommand("strace", append([]string{"-p", strconv.FormatUint(uint64(pid), 10)}, straceArgs...)...)
+	// one-shot: ctrl-c is forwarded to strace, which detaches and exits,
+	// and the session is torn down after it
+	config.TTY = false
+	config.Stdin, config.Stdout, config.Stderr = nil, os.Stdout, os.Stderr
+	if err := config.Validate(); err != nil {
+		failErr(err, "%v", err)
+	}
+	debug(ctx, client, c)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// transcript records a session's terminal output to a file, like
+// script(1). Input is captured through the terminal's echo. A failed write,
+// such as on a full disk, is reported once and recording stops, but the
+// session carries on. Stdout and stderr are copied concurrently, so
+// writes are serialized.
+type transcript struct {
+	mu     sync.Mutex
+	f      *os.File
+	failed bool
+}
+
+func openTranscript(path string) (*transcript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &transcript{f: f}
+	fmt.Fprintf(t, "cdbg transcript started %s\n", time.Now().Format(time.RFC3339))
+	return t, nil
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failed {
+		return len(p), nil
+	}
+	if _, err := t.f.Write(p); err != nil {
+		t.failed = true
+		// the console may be raw, so terminate lines explicitly
+		fmt.Fprintf(os.Stderr, "\r\nwarning: transcript: %v; no longer recording\r\n", err)
+	}
+	return len(p), nil
+}
+
+func (t *transcript) Close() error {
+	fmt.Fprintf(t, "\ncdbg transcript ended %s\n", time.Now().Format(time.RFC3339))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
+
+// tee also writes everything sent to w to the transcript; a nil w stays
+// unattached.
+func (t *transcript) tee(w io.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return io.MultiWriter(w, t)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+// watchPollInterval is how often -watch polls containerd for new targets.
+const watchPollInterval = time.Second
+
+// watchTargets waits for running containers matching selector and debugs
+// each new one in turn, so a restarting container is followed across
+// restarts. It stops after watchMax sessions, or when no new target shows
+// up within watchTimeout.
+func watchTargets(ctx context.Context, client *containerd.Client, selector string) error {
+	seen := make(map[string]bool)
+	for n := 0; watchMax == 0 || n < watchMax; n++ {
+		c, err := waitForTarget(ctx, client, selector, seen)
+		if err != nil {
+			return err
+		}
+		seen[c.ID()] = true
+		status("attaching to %s (%d)\n", c.ID(), n+1)
+		debug(ctx, client, c)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// waitForTarget polls until a container matching selector, and not in seen,
+// has a running task.
+func waitForTarget(ctx context.Context, client *containerd.Client, selector string, seen map[string]bool) (containerd.Container, error) {
+	if watchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, watchTimeout)
+		defer cancel()
+	}
+	var filters []string
+	prefix := selector
+	if kv := strings.SplitN(selector, "=", 2); len(kv) == 2 {
+		filters = append(filters, fmt.Sprintf("labels.%q==%q", kv[0], kv[1]))
+		prefix = ""
+	}
+
+	tick := time.NewTicker(watchPollInterval)
+	defer tick.Stop()
+	for {
+		cs, err := client.Containers(ctx, filters...)
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			if seen[c.ID()] || !strings.HasPrefix(c.ID(), prefix) {
+				continue
+			}
+			if isRunning(ctx, c) {
+				return c, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("no new target matching %s after %s", selector, watchTimeout)
+			}
+			return nil, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+func isRunning(ctx context.Context, c containerd.Container) bool {
+	t, err := c.Task(ctx, nil)
+	if err != nil {
+		return false
+	}
+	status, err := t.Status(ctx)
+	return err == nil && status.Status == containerd.Running
+}